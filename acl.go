@@ -0,0 +1,153 @@
+package flockerbot
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrUnknownRole signals a rule for a role that does not exist
+	ErrUnknownRole = errors.New("Bot: Unknown role")
+)
+
+// Identity is who sent a message, as far as known.
+type Identity struct {
+	Nick    string // Nick.
+	User    string // Ident.
+	Host    string // Host.
+	Account string // Services account, empty if not logged in or unknown.
+}
+
+// Hostmask returns the identity as nick!user@host.
+func (id Identity) Hostmask() string {
+	return id.Nick + "!" + id.User + "@" + id.Host
+}
+
+// Rule assigns a role to the users it matches. Mask and Account must both match if set; a rule
+// with neither matches nobody.
+type Rule struct {
+	Mask    string `json:"mask,omitempty"`    // Hostmask glob, e.g. "*!*@staff.example".
+	Account string `json:"account,omitempty"` // Services account, or "*" for any logged in user.
+	Role    string `json:"role"`              // Role to grant.
+}
+
+// matches returns true if the rule applies to id.
+func (r Rule) matches(id Identity, cm CaseMapping) bool {
+	if r.Mask == "" && r.Account == "" {
+		return false
+	}
+	if r.Mask != "" && !MatchMask(r.Mask, id.Hostmask(), cm) {
+		return false
+	}
+	if r.Account != "" {
+		if id.Account == "" || (r.Account != "*" && !cm.Equal(r.Account, id.Account)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ACL decides which commands a user may run. Users get roles by rules, and roles allow commands.
+// It is safe for concurrent use.
+type ACL struct {
+	mutex sync.RWMutex
+	roles map[string][]string // role to commands, "*" for all
+	rules []Rule
+}
+
+// aclFile is the format of ACL files.
+type aclFile struct {
+	Roles map[string][]string `json:"roles"`
+	Rules []Rule              `json:"rules"`
+}
+
+// NewACL returns an empty ACL, which denies everything.
+func NewACL() *ACL {
+	return &ACL{roles: make(map[string][]string)}
+}
+
+// LoadACL reads an ACL from a JSON file of the form
+//
+//	{
+//	  "roles": {"admin": ["*"], "op": ["kick", "ban"]},
+//	  "rules": [
+//	    {"mask": "*!*@staff.example", "role": "admin"},
+//	    {"account": "alice", "role": "op"}
+//	  ]
+//	}
+func LoadACL(path string) (*ACL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f aclFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	acl := NewACL()
+	for role, commands := range f.Roles {
+		acl.AddRole(role, commands...)
+	}
+	for _, r := range f.Rules {
+		if err := acl.Grant(r); err != nil {
+			return nil, err
+		}
+	}
+	return acl, nil
+}
+
+// AddRole defines role, allowing commands. The command "*" allows all. Commands are added to an
+// existing role.
+func (acl *ACL) AddRole(role string, commands ...string) {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+	for _, c := range commands {
+		acl.roles[role] = append(acl.roles[role], strings.ToLower(c))
+	}
+	if _, ok := acl.roles[role]; !ok {
+		acl.roles[role] = nil
+	}
+}
+
+// Grant adds a rule. The role must exist.
+func (acl *ACL) Grant(r Rule) error {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+	if _, ok := acl.roles[r.Role]; !ok {
+		return ErrUnknownRole
+	}
+	acl.rules = append(acl.rules, r)
+	return nil
+}
+
+// Roles returns the roles of id.
+func (acl *ACL) Roles(id Identity, cm CaseMapping) []string {
+	acl.mutex.RLock()
+	defer acl.mutex.RUnlock()
+	var roles []string
+	for _, r := range acl.rules {
+		if r.matches(id, cm) {
+			roles = append(roles, r.Role)
+		}
+	}
+	return roles
+}
+
+// Allowed returns true if id may run command.
+func (acl *ACL) Allowed(id Identity, command string, cm CaseMapping) bool {
+	command = strings.ToLower(command)
+	roles := acl.Roles(id, cm)
+	acl.mutex.RLock()
+	defer acl.mutex.RUnlock()
+	for _, role := range roles {
+		for _, c := range acl.roles[role] {
+			if c == "*" || c == command {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package flockerbot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchMask(t *testing.T) {
+	for _, tc := range []struct {
+		mask, hostmask string
+		want           bool
+	}{
+		{"*!*@staff.example", "alice!al@staff.example", true},
+		{"*!*@*.example", "alice!al@staff.example", true},
+		{"a?ice!*@*", "ALICE!al@host", true},
+		{"alice[m]!*@*", "ALICE{M}!al@host", true},
+		{"*!*@staff.example", "alice!al@staff.example.evil", false},
+		{"bob*", "alice!al@host", false},
+	} {
+		if got := MatchMask(tc.mask, tc.hostmask, CaseRFC1459); got != tc.want {
+			t.Errorf("MatchMask(%s, %s): got %v, want %v", tc.mask, tc.hostmask, got, tc.want)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	os.WriteFile(path, []byte(`{
+		"roles": {"admin": ["*"], "op": ["Kick", "ban"]},
+		"rules": [
+			{"mask": "*!*@staff.example", "role": "admin"},
+			{"account": "Alice", "role": "op"},
+			{"mask": "*!*@trusted.example", "account": "*", "role": "op"}
+		]
+	}`), 0600)
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		id      Identity
+		command string
+		want    bool
+	}{
+		{Identity{Nick: "root", User: "r", Host: "staff.example"}, "restart", true},
+		{Identity{Nick: "x", User: "x", Host: "h", Account: "alice"}, "kick", true},
+		{Identity{Nick: "x", User: "x", Host: "h", Account: "alice"}, "restart", false},
+		{Identity{Nick: "alice", User: "x", Host: "h"}, "kick", false},
+		{Identity{Nick: "y", User: "y", Host: "trusted.example"}, "ban", false},
+		{Identity{Nick: "y", User: "y", Host: "trusted.example", Account: "y"}, "BAN", true},
+	} {
+		if got := acl.Allowed(tc.id, tc.command, CaseRFC1459); got != tc.want {
+			t.Errorf("Allowed(%v, %s): got %v, want %v", tc.id, tc.command, got, tc.want)
+		}
+	}
+	if err := acl.Grant(Rule{Mask: "*", Role: "nope"}); err != ErrUnknownRole {
+		t.Errorf("Expected ErrUnknownRole, got %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+package flockerbot
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+var (
+	// ErrListDenied signals that the server refused to send a channel list
+	ErrListDenied = errors.New("Bot: Channel list request denied")
+	// ErrListMode signals that the mode is not a list mode FetchList knows the replies of
+	ErrListMode = errors.New("Bot: Unknown list mode")
+	// ErrExtBan signals that the server does not support the requested extban
+	ErrExtBan = errors.New("Bot: Extban not supported")
+)
+
+// listNumerics are the entry and end replies of the list modes.
+var listNumerics = map[byte][2]string{
+	'b': {"367", "368"},
+	'e': {"348", "349"},
+	'I': {"346", "347"},
+	'q': {"728", "729"}, // Quiets on charybdis and solanum.
+}
+
+// listErrors are the replies with which a list request can fail.
+var listErrors = []string{"403", "442", "482"}
+
+// ListEntry is an entry of a channel list like the ban list.
+type ListEntry struct {
+	Mask  string    // The mask.
+	SetBy string    // Who set it, if known.
+	SetAt time.Time // When it was set, zero if unknown.
+}
+
+// MaskStyle selects how BanMask builds a mask from a hostmask.
+type MaskStyle int
+
+const (
+	// MaskHost is *!*@host.
+	MaskHost MaskStyle = iota
+	// MaskUserHost is *!user@host.
+	MaskUserHost
+	// MaskDomain is *!*@*.domain, respectively *!*@1.2.3.* for IPv4 and a /64 for IPv6.
+	MaskDomain
+	// MaskUserDomain is *!user@*.domain.
+	MaskUserDomain
+	// MaskNick is nick!*@*.
+	MaskNick
+)
+
+// BanMask returns a mask matching prefix in the given style. A leading ~ of unidented users is
+// replaced by *.
+func BanMask(prefix *irc.Prefix, style MaskStyle) string {
+	user := prefix.User
+	if strings.HasPrefix(user, "~") {
+		user = "*" + user[1:]
+	}
+	if user == "" {
+		user = "*"
+	}
+	switch style {
+	case MaskUserHost:
+		return "*!" + user + "@" + prefix.Host
+	case MaskDomain:
+		return "*!*@" + domainMask(prefix.Host)
+	case MaskUserDomain:
+		return "*!" + user + "@" + domainMask(prefix.Host)
+	case MaskNick:
+		return prefix.Name + "!*@*"
+	}
+	return "*!*@" + prefix.Host
+}
+
+// domainMask wildcards the host part of a hostname or the last octet of an IPv4 address. For
+// IPv6 the last 64 bits are wildcarded. Cloaks and short hostnames are returned unchanged.
+func domainMask(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return host[:strings.LastIndexByte(host, '.')] + ".*"
+		}
+		groups := make([]string, 4)
+		for i := range groups {
+			groups[i] = strconv.FormatUint(uint64(ip[2*i])<<8|uint64(ip[2*i+1]), 16)
+		}
+		return strings.Join(groups, ":") + ":*"
+	}
+	if strings.Contains(host, "/") {
+		return host
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) < 3 {
+		return host
+	}
+	return "*." + strings.Join(labels[1:], ".")
+}
+
+// ExtBan returns the prefix and supported types of extended bans, e.g. "$" and "ajrxz". The
+// prefix is empty on servers that use the type letter alone, like InspIRCd.
+func (is *ISupport) ExtBan() (prefix, types string, ok bool) {
+	value, ok := is.Get("EXTBAN")
+	if !ok {
+		return "", "", false
+	}
+	prefix, types, _ = strings.Cut(value, ",")
+	return prefix, types, true
+}
+
+// ExtBan returns an extended ban mask of type kind with param, e.g. ExtBan('a', "alice") gives
+// "$a:alice" on charybdis and "~a:alice" on UnrealIRCd. An empty param omits the colon.
+func (b *Bot) ExtBan(kind byte, param string) (string, error) {
+	prefix, types, ok := b.ISupport().ExtBan()
+	if !ok || strings.IndexByte(types, kind) < 0 {
+		return "", ErrExtBan
+	}
+	mask := prefix + string(kind)
+	if param != "" {
+		mask += ":" + param
+	}
+	return mask, nil
+}
+
+// EditList adds masks to or removes them from the list mode of channel, e.g. 'e' for exceptions.
+func (b *Bot) EditList(channel string, mode byte, add bool, masks ...string) {
+	b.setMode(channel, add, mode, masks)
+}
+
+// pendingUnban is a timed ban that expired while the bot was disconnected.
+type pendingUnban struct {
+	channel string // folded
+	mask    string
+}
+
+// TimedBan bans mask from channel and lifts the ban after d. If the bot is disconnected by then,
+// the ban is lifted when it rejoins channel. Stop the returned timer to keep the ban.
+func (b *Bot) TimedBan(channel, mask string, d time.Duration) *time.Timer {
+	b.Ban(channel, mask)
+	return time.AfterFunc(d, func() {
+		if !b.Connected() {
+			folded := b.Fold(channel)
+			b.mutex.Lock()
+			b.pendingUnbans = append(b.pendingUnbans, pendingUnban{channel: folded, mask: mask})
+			b.mutex.Unlock()
+			return
+		}
+		b.liftBan(channel, mask)
+	})
+}
+
+// liftBan removes mask from the bans of channel, unless the ban is known to be gone.
+func (b *Bot) liftBan(channel, mask string) {
+	if c, ok := b.Channel(channel); ok {
+		if entries, known := c.Lists['b']; known && !containsFold(entries, mask, b.EqualFold) {
+			// Already removed.
+			return
+		}
+	}
+	b.Unban(channel, mask)
+}
+
+// liftPendingBans lifts the timed bans of channel that expired while we were disconnected, in as
+// few MODE lines as the MODES limit allows. Called by the main loop when we join channel; the
+// lines are queued by SendString, not waited for.
+func (b *Bot) liftPendingBans(channel string) {
+	folded := b.Fold(channel)
+	var masks []string
+	b.mutex.Lock()
+	kept := b.pendingUnbans[:0]
+	for _, u := range b.pendingUnbans {
+		if u.channel == folded {
+			masks = append(masks, u.mask)
+		} else {
+			kept = append(kept, u)
+		}
+	}
+	b.pendingUnbans = kept
+	b.mutex.Unlock()
+	if len(masks) > 0 {
+		b.Unban(channel, masks...)
+	}
+}
+
+// FetchList requests the list mode of channel from the server, e.g. 'b' for bans, and returns
+// its entries. The list is also stored in the channel state.
+func (b *Bot) FetchList(ctx context.Context, channel string, mode byte) ([]ListEntry, error) {
+	numerics, ok := listNumerics[mode]
+	if !ok {
+		return nil, ErrListMode
+	}
+	folded := b.Fold(channel)
+	match := FilterCommand(append([]string{numerics[0], numerics[1]}, listErrors...)...)
+	sub := b.Subscribe(func(ev Event) bool {
+		return match(ev) && len(ev.Message.Params) > 1 && b.Fold(ev.Message.Params[1]) == folded
+	})
+	defer sub.Cancel()
+	b.SendString("MODE " + channel + " " + string(mode))
+	var entries []ListEntry
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case ev, ok := <-sub.C:
+			if !ok {
+				return nil, ctx.Err()
+			}
+			msg := ev.Message
+			switch msg.Command {
+			case numerics[0]:
+				entries = append(entries, parseListEntry(msg))
+			case numerics[1]:
+				return entries, nil
+			default:
+				return nil, ErrListDenied
+			}
+		}
+	}
+}
+
+// parseListEntry parses a list reply: me channel [mode] mask [setter [ts]].
+func parseListEntry(msg *irc.Message) ListEntry {
+	p := params(msg)[2:]
+	if msg.Command == "728" && len(p) > 0 {
+		p = p[1:]
+	}
+	var e ListEntry
+	if len(p) > 0 {
+		e.Mask = p[0]
+	}
+	if len(p) > 1 {
+		e.SetBy = p[1]
+	}
+	if len(p) > 2 {
+		if ts, err := strconv.ParseInt(p[2], 10, 64); err == nil {
+			e.SetAt = time.Unix(ts, 0)
+		}
+	}
+	return e
+}
+
+// listMode returns the list mode of a list reply numeric and whether it ends the list.
+func listMode(numeric string) (mode byte, end, ok bool) {
+	for m, n := range listNumerics {
+		switch numeric {
+		case n[0]:
+			return m, false, true
+		case n[1]:
+			return m, true, true
+		}
+	}
+	return 0, false, false
+}
+
+// containsFold returns true if list contains s, compared with equal.
+func containsFold(list []string, s string, equal func(x, y string) bool) bool {
+	for _, e := range list {
+		if equal(e, s) {
+			return true
+		}
+	}
+	return false
+}
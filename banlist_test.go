@@ -0,0 +1,129 @@
+package flockerbot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+func TestBanMask(t *testing.T) {
+	for _, tc := range []struct {
+		prefix string
+		style  MaskStyle
+		want   string
+	}{
+		{"alice!~al@host.example.com", MaskHost, "*!*@host.example.com"},
+		{"alice!~al@host.example.com", MaskUserHost, "*!*al@host.example.com"},
+		{"alice!al@host.example.com", MaskUserDomain, "*!al@*.example.com"},
+		{"alice!al@192.0.2.17", MaskDomain, "*!*@192.0.2.*"},
+		{"alice!al@2001:db8::1", MaskDomain, "*!*@2001:db8:0:0:*"},
+		{"alice!al@user/alice", MaskDomain, "*!*@user/alice"},
+		{"alice!al@example.com", MaskDomain, "*!*@example.com"},
+		{"alice!al@host", MaskNick, "alice!*@*"},
+	} {
+		if got := BanMask(irc.ParsePrefix(tc.prefix), tc.style); got != tc.want {
+			t.Errorf("BanMask(%s, %d): got %s, want %s", tc.prefix, tc.style, got, tc.want)
+		}
+	}
+}
+
+func TestExtBan(t *testing.T) {
+	b := testBot("flocker")
+	if _, err := b.ExtBan('a', "alice"); err != ErrExtBan {
+		t.Errorf("Expected ErrExtBan without EXTBAN, got %v", err)
+	}
+	b.track(irc.ParseMessage(":irc.example 005 flocker EXTBAN=$,ajrxz :are supported by this server"), nil)
+	if mask, err := b.ExtBan('a', "alice"); err != nil || mask != "$a:alice" {
+		t.Errorf("Unexpected extban %q %v", mask, err)
+	}
+	if _, err := b.ExtBan('R', "alice"); err != ErrExtBan {
+		t.Errorf("Expected ErrExtBan for unsupported type, got %v", err)
+	}
+}
+
+func TestFetchList(t *testing.T) {
+	b := testBot("flocker")
+	b.track(irc.ParseMessage(":flocker!f@h JOIN #flocker"), nil)
+	nextLine(t, b)
+	b.track(irc.ParseMessage(":alice!a@h MODE #flocker +b stale!*@*"), nil)
+	go func() {
+		if l := nextLine(t, b); l != "MODE #Flocker b" {
+			t.Errorf("Unexpected request %q", l)
+		}
+		for _, l := range []string{
+			":irc.example 367 flocker #flocker *!*@spam.example alice 1600000000",
+			":irc.example 367 flocker #flocker troll!*@*",
+			":irc.example 368 flocker #flocker :End of Channel Ban List",
+		} {
+			msg := irc.ParseMessage(l)
+			b.track(msg, nil)
+			b.dispatch(msg)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	entries, err := b.FetchList(ctx, "#Flocker", 'b')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].SetBy != "alice" || entries[0].SetAt.Unix() != 1600000000 || entries[1].Mask != "troll!*@*" {
+		t.Errorf("Unexpected entries %v", entries)
+	}
+	c, _ := b.Channel("#flocker")
+	if bans := c.Lists['b']; len(bans) != 2 || bans[0] != "*!*@spam.example" {
+		t.Errorf("Ban list not cached: %v", bans)
+	}
+	if _, err := b.FetchList(ctx, "#flocker", 'x'); err != ErrListMode {
+		t.Errorf("Expected ErrListMode, got %v", err)
+	}
+}
+
+func TestTimedBanReconnect(t *testing.T) {
+	b := testBot("flocker")
+	b.track(irc.ParseMessage(":irc.example 005 flocker MODES=3 :are supported by this server"), nil)
+	b.setConnected(false)
+	masks := []string{"a!*@*", "b!*@*", "c!*@*", "d!*@*"}
+	for _, mask := range masks {
+		b.TimedBan("#Flocker", mask, time.Millisecond)
+		if l := nextLine(t, b); l != "MODE #Flocker +b "+mask {
+			t.Errorf("Unexpected ban %q", l)
+		}
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		b.mutex.RLock()
+		pending := len(b.pendingUnbans)
+		b.mutex.RUnlock()
+		if pending == len(masks) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expired bans not queued while disconnected")
+		}
+	}
+	b.setConnected(true)
+	// track runs on the main loop, which must not wait for room in socketChan.
+	b.socketChan = make(chan *channelString, 1)
+	b.socketChan <- &channelString{Dir: socketRead, Data: "busy"}
+	done := make(chan struct{})
+	go func() {
+		b.track(irc.ParseMessage(":flocker!f@h JOIN #other"), nil)
+		b.track(irc.ParseMessage(":flocker!f@h JOIN #flocker"), nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Lifting the bans blocked on a full socketChan")
+	}
+	<-b.socketChan
+	var lines []string
+	for i := 0; i < 4; i++ {
+		lines = append(lines, nextLine(t, b))
+	}
+	if !strings.HasPrefix(lines[2], "MODE #flocker -bbb ") || !strings.HasPrefix(lines[3], "MODE #flocker -b ") {
+		t.Errorf("Bans not lifted on rejoin in MODES sized lines: %q", lines)
+	}
+}
@@ -0,0 +1,45 @@
+package flockerbot
+
+import (
+	"context"
+	"strings"
+)
+
+// requestBatch sends line and collects the messages of the batch answering it, the first batch
+// with a type for which isType returns true. A FAIL reply for the command of line is returned as
+// *RejectedError. Requests are serialized, as the batches can not be told apart otherwise.
+func (b *Bot) requestBatch(ctx context.Context, line string, isType func(string) bool) ([]Event, error) {
+	command, _, _ := strings.Cut(line, " ")
+	b.batchMutex.Lock()
+	defer b.batchMutex.Unlock()
+	batch := ""
+	sub := b.subscribe(func(ev Event) bool {
+		return ev.Type == EventMessage && (ev.Message.Command == "BATCH" || ev.Message.Command == "FAIL" || ev.Tags["batch"] != "")
+	}, true)
+	defer sub.Cancel()
+	b.SendString(line)
+	var events []Event
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case ev, ok := <-sub.C:
+			if !ok {
+				return nil, ctx.Err()
+			}
+			m := ev.Message
+			p := params(m)
+			switch {
+			case m.Command == "FAIL" && len(p) > 0 && p[0] == command:
+				return nil, rejection(m)
+			case m.Command == "BATCH" && batch == "" && len(p) > 1 && isType(p[1]):
+				// BATCH +ref type [params]
+				batch = strings.TrimPrefix(p[0], "+")
+			case m.Command == "BATCH" && batch != "" && len(p) > 0 && p[0] == "-"+batch:
+				return events, nil
+			case batch != "" && ev.Tags["batch"] == batch:
+				events = append(events, ev)
+			}
+		}
+	}
+}
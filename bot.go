@@ -1,15 +1,19 @@
 // Package flockerbot implements a simple IRC bot. To use it, populate a Bot struct and call Connect() on it.
 // To send messages, use the SendString and SendStruct methods. For receiving messages, make sure the
 // handler field is set. The handler function will be called on reception of messages, with the message
-// struct as the parameter.
+// struct as the parameter. Alternatively, messages, connection state changes and errors can be consumed
+// from a channel returned by Events or Subscribe.
 package flockerbot
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
+	"log/slog"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -24,32 +28,85 @@ const (
 )
 
 var (
-	// ErrTimeout signals timeout
+	// ErrTimeout signals timeout. Timeouts are returned as *TimeoutError, which carries the details, so
+	// compare with errors.Is(err, ErrTimeout) instead of ==.
 	ErrTimeout = errors.New("Bot: Timeout")
 )
 
 // Bot implements the bot
 type Bot struct {
-	ConnectAddress string // where to connect to. IP:Port.
-	User           string // Username for USER command.
-	Nick           string // Nickname for NICK command.
-	Password       string // Password for authentication. If empty, no authentication will be used.
-	IsServer       bool   // Register as server, not client. User field is used as the server name.
-	Timeout        int64  // Connect and ping timeout.
-	TLS            bool   // connect via TLS
+	ConnectAddress  string          // where to connect to. IP:Port.
+	User            string          // Username for USER command.
+	Nick            string          // Nickname for NICK command.
+	Password        string          // Password for authentication. If empty, no authentication will be used.
+	IsServer        bool            // Link as server, not client. User field is used as the server name, Password as link password.
+	LinkProtocol    LinkProtocol    // Server protocol for IsServer: TS6 (default), InspIRCd or UnrealIRCd.
+	SID             string          // Server ID for IsServer, e.g. "42X".
+	ServerDesc      string          // Server description for IsServer.
+	AcceptPassword  string          // If set with IsServer, the password the uplink has to send.
+	Timeout         int64           // Connect and ping timeout.
+	PingInterval    int64           // Seconds between lag measuring PINGs. If 0, PINGs are only sent after 60 seconds of silence.
+	MaxLag          int64           // If > 0, a lag above MaxLag seconds is treated as a dead connection. Independent of Timeout.
+	ISONInterval    int64           // Seconds between ISON polls for monitored nicks not covered by MONITOR or WATCH. If 0, 60 seconds.
+	TLS             bool            // connect via TLS
+	StartTLS        bool            // Upgrade a plaintext connection via CAP tls and STARTTLS before registration.
+	RequireStartTLS bool            // Abort the connection if StartTLS is set and the upgrade fails.
+	StartTLSAnyCert bool            // Accept any certificate for StartTLS, e.g. a self-signed one. By default it is verified against the host of ConnectAddress.
+	CatchUp         bool            // On rejoining a channel, deliver the messages missed since the last one seen as EventHistory, via CHATHISTORY.
+	Playback        bool            // Behind ZNC, request the messages since the last one seen via znc.in/playback on connect.
+	BouncerNetID    string          // Behind soju, the ID of the network to bind to via soju.im/bouncer-networks.
+	BouncerControl  bool            // Behind soju, request soju.im/bouncer-networks without binding, for BouncerNetworks.
+	Store           Store           // Optional persistent storage for handlers and plugins, see Bucket.
+	Caps            []string        // IRCv3 capabilities to request in addition to those the bot uses itself.
+	Proxy           string          // Proxy URL: socks5://, socks5h:// (DNS on proxy, always used for .onion) or http:// (CONNECT). May contain user:password.
+	Logger          *slog.Logger    // Optional logger for connection lifecycle and errors. Protocol lines are logged at debug level, with credentials redacted.
+	Metrics         Metrics         // Optional metrics sink.
+	ReconnectPolicy ReconnectPolicy // Decides about reconnects in StayConnected. If nil, DefaultReconnectPolicy is used.
 
-	Handler          func(msg *irc.Message) // Handler for messages. The handler will not be called for PING, 001 and 443 messages.
-	ConnectedHandler func()                 // Handler that is called on connect
+	Handler          func(msg *irc.Message)                         // Handler for messages. The handler will not be called for PING, 001 and 443 messages.
+	TagsHandler      func(msg *irc.Message, tags map[string]string) // Like Handler, with the IRCv3 message tags. Called in addition to Handler.
+	ConnectedHandler func()                                         // Handler that is called on connect
 
-	activeNick    string              // The actual active nick.
-	err           error               // Last error.
-	nickCount     int                 // counter for nick modification if nick is in use
-	socket        net.Conn            // connection
-	socketChan    chan *channelString // Message stream
-	userSet       bool                // if the user has been set
-	connected     bool                // true as soon as we are connected
-	mutex         *sync.RWMutex
-	autoReconnect bool // Should we autoreconnect?
+	activeNick     string              // The actual active nick.
+	err            error               // Last error.
+	nickCount      int                 // counter for nick modification if nick is in use
+	socket         net.Conn            // connection
+	socketChan     chan *channelString // Message stream
+	userSet        bool                // if the user has been set
+	connected      bool                // true as soon as we are connected
+	mutex          *sync.RWMutex
+	autoReconnect  bool                     // Should we autoreconnect?
+	pendingPings   []pendingPing            // PINGs waiting for PONG, oldest first.
+	lastPing       time.Time                // When the last PING was sent.
+	lag            time.Duration            // Round-trip time of the last answered PING.
+	smoothedLag    time.Duration            // Moving average of lag.
+	registeredAt   time.Time                // When the last connection completed registration.
+	link           *LinkState               // Network state in server mode.
+	remoteSID      string                   // SID of our uplink in server mode.
+	linkBurstDone  bool                     // True when the uplink finished its burst.
+	pseudoClients  map[string]*PseudoClient // Pseudo-clients in server mode, by UID.
+	uidCounter     int                      // Counter for UID generation.
+	subMutex       sync.Mutex
+	subscriptions  []*Subscription   // Event subscribers.
+	lifecycle      []*lifecycleHook  // Called with EventConnected and EventDisconnected, see onLifecycle.
+	events         *Subscription     // Subscription returned by Events.
+	isupport       *ISupport         // Features announced by the server.
+	state          *state            // Channels we are in and their users.
+	capsAvailable  map[string]string // Capabilities offered by the server, with values.
+	capsEnabled    map[string]bool   // Capabilities acknowledged by the server.
+	capNegotiating bool              // True until CAP END was sent.
+	presence       *presence         // Nicks to watch for EventOnline and EventOffline.
+	labelCount     int               // Counter for labels of SendAndConfirm.
+	batchMutex     sync.Mutex        // Serializes requests answered with a batch, like CHATHISTORY.
+	batches        map[string]string // Open batches by reference, with their type.
+	lastSeen       map[string]string // History reference of the latest message by folded channel, for CatchUp.
+	lastMessage    time.Time         // Server time of the latest message, for Playback.
+	pendingUnbans  []pendingUnban    // Timed bans to lift when their channel is rejoined.
+	sendMutex      sync.Mutex        // Guards socketChan writes, sendQueue, sendPending, pumping and sendClosed.
+	sendQueue      []*channelString  // Lines waiting for room in socketChan, see SendString.
+	sendPending    int               // Lines accepted by SendString and not yet written.
+	pumping        bool              // True while pump forwards sendQueue.
+	sendClosed     bool              // True once socketChan is closed.
 
 	ErrChan chan error // Channel to send errors to
 }
@@ -100,12 +157,61 @@ func (b *Bot) SendStruct(msg *irc.Message) {
 	b.SendString(msg.String())
 }
 
-// SendString sends a string.
+// SendString sends a string. It never blocks: lines the main loop has no room for are queued, as
+// the loop itself sends while it handles incoming lines. Lines sent without a connection, also
+// one that just ended, are dropped.
 func (b *Bot) SendString(msg string) {
-	b.socketChan <- &channelString{
+	m := &channelString{
 		Dir:  socketWrite,
 		Data: msg + "\r\n",
 	}
+	b.sendMutex.Lock()
+	defer b.sendMutex.Unlock()
+	if b.sendClosed || b.socketChan == nil {
+		return
+	}
+	b.sendPending++
+	b.metricSendQueue()
+	if !b.pumping {
+		select {
+		case b.socketChan <- m:
+			return
+		default:
+		}
+		b.pumping = true
+		go b.pump(b.socketChan)
+	}
+	b.sendQueue = append(b.sendQueue, m)
+}
+
+// sent accounts for a line the main loop wrote.
+func (b *Bot) sent() {
+	b.sendMutex.Lock()
+	defer b.sendMutex.Unlock()
+	if b.sendPending > 0 {
+		b.sendPending--
+	}
+	b.metricSendQueue()
+}
+
+// pump forwards the queued lines to c in order, waiting for the main loop to make room. It ends
+// when the queue is empty or the connection of c is gone.
+func (b *Bot) pump(c chan *channelString) {
+	defer func() {
+		recover() // c was closed.
+	}()
+	for {
+		b.sendMutex.Lock()
+		if len(b.sendQueue) == 0 || b.socketChan != c {
+			b.pumping = false
+			b.sendMutex.Unlock()
+			return
+		}
+		m := b.sendQueue[0]
+		b.sendQueue = b.sendQueue[1:]
+		b.sendMutex.Unlock()
+		c <- m
+	}
 }
 
 // Disconnect the bot.
@@ -113,14 +219,16 @@ func (b *Bot) Disconnect() error {
 	b.mutex.RLock()
 	defer b.mutex.RUnlock()
 	err := b.err
-	b.socket.Close()
+	if b.socket != nil {
+		b.socket.Close()
+	}
 	return err
 }
 
 // ReplyTo returns a string containing where to reply to.
 func (b *Bot) ReplyTo(msg *irc.Message) string {
 	if len(msg.Params) > 0 {
-		if msg.Params[0] != b.activeNick {
+		if !b.isMe(msg.Params[0]) {
 			return msg.Params[0]
 		}
 	}
@@ -135,23 +243,65 @@ func (b *Bot) Setup() {
 	if b.mutex == nil {
 		b.mutex = new(sync.RWMutex)
 	}
+	if b.state == nil {
+		b.resetState()
+	}
 }
 
-// StayConnected keeps the bot connected
+// StayConnected keeps the bot connected as long as auto reconnect is set. After each connection
+// the ReconnectPolicy decides whether to try again. The error that made it give up is returned.
 func (b *Bot) StayConnected() error {
+	return b.StayConnectedContext(context.Background())
+}
+
+// StayConnectedContext is StayConnected until ctx is done. Cancelling ctx closes the connection,
+// also one that is still being established, and returns nil.
+func (b *Bot) StayConnectedContext(ctx context.Context) error {
+	policy := b.ReconnectPolicy
+	if policy == nil {
+		policy = DefaultReconnectPolicy
+	}
+	attempt := 0
 	for {
-		if !b.isAutoConnect() {
+		if !b.isAutoConnect() || ctx.Err() != nil {
+			return nil
+		}
+		attempt++
+		start := time.Now()
+		err, loopErr := b.connect(ctx)
+		if ctx.Err() != nil {
 			return nil
 		}
-		if err, _ := b.Connect(); err != nil {
+		if err == nil {
+			err = loopErr
+		}
+		if b.registeredSince(start) {
+			attempt = 1
+		}
+		retry, delay := policy(err, attempt)
+		if !retry {
 			return err
 		}
+		if b.Metrics != nil && b.isAutoConnect() {
+			b.Metrics.Reconnect(reconnectCause(err))
+		}
+		b.logInfo("reconnecting", "attempt", attempt, "delay", delay, "cause", reconnectCause(err))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
 	}
-	return nil
 }
 
 // Connect the bot and go into main loop.
 func (b *Bot) Connect() (err, loopError error) {
+	return b.connect(context.Background())
+}
+
+// connect is Connect until ctx is done. It checks ctx once the connection is established, as
+// Disconnect cannot close a connection that is still being dialed.
+func (b *Bot) connect(ctx context.Context) (err, loopError error) {
 	defer func() {
 		recover()
 	}()
@@ -159,53 +309,109 @@ func (b *Bot) Connect() (err, loopError error) {
 	var tmpSocket net.Conn
 	lastTime := now()
 	b.nickCount = -1
-	dialer := &net.Dialer{
-		Timeout:   time.Second * time.Duration(b.Timeout),
-		KeepAlive: time.Second * 15,
+	b.resetLag()
+	b.resetState()
+	if b.IsServer && (!validSID(b.SID) || !strings.Contains(b.User, ".")) {
+		b.setError(ErrLinkConfig)
+		return ErrLinkConfig, nil
+	}
+	b.logInfo("connecting", "address", b.ConnectAddress, "tls", b.TLS, "starttls", b.StartTLS, "proxy", redactProxy(b.Proxy))
+	tmpSocket, err = b.dial(ctx)
+	if ctx.Err() != nil {
+		if err == nil {
+			tmpSocket.Close()
+		}
+		return ctx.Err(), nil
 	}
-	tmpSocket, err = dialer.Dial("tcp", b.ConnectAddress)
 	if err != nil {
+		err = &DialError{Address: b.ConnectAddress, Err: err}
+		b.logError("dial failed", err, "address", b.ConnectAddress)
 		b.setError(err)
 		return err, nil
 	}
-	tcpSocket := tmpSocket.(*net.TCPConn)
-	tcpSocket.SetKeepAlive(true)
-	tcpSocket.SetNoDelay(true)
+	if tcpSocket, ok := tmpSocket.(*net.TCPConn); ok {
+		tcpSocket.SetKeepAlive(true)
+		tcpSocket.SetNoDelay(true)
+	}
 	if b.TLS {
-		tlsSocket := tls.Client(tmpSocket, &tls.Config{
-			InsecureSkipVerify: true,
-		})
+		// TLS runs on top of the (possibly proxied) stream, so it is end-to-end with the server.
+		// Direct TLS does not verify the certificate, as it never did.
+		tlsSocket := tls.Client(tmpSocket, b.tlsConfig(false))
 		err := tlsSocket.Handshake()
 		if err != nil {
+			tmpSocket.Close()
+			err = &TLSError{Err: err}
+			b.logError("tls handshake failed", err)
 			b.setError(err)
 			return err, nil
 		}
 		tmpSocket = tlsSocket
+	} else if b.StartTLS {
+		upgraded, err := b.startTLS(tmpSocket)
+		if err != nil {
+			tmpSocket.Close()
+			err = &TLSError{Err: err}
+			b.logError("starttls failed", err)
+			b.setError(err)
+			return err, nil
+		}
+		if upgraded == tmpSocket {
+			b.logInfo("starttls not available, continuing in plaintext")
+		} else {
+			b.logInfo("starttls established")
+		}
+		tmpSocket = upgraded
+	}
+	if err := ctx.Err(); err != nil {
+		tmpSocket.Close()
+		return err, nil
 	}
+	b.mutex.Lock()
 	b.socket = tmpSocket
-	defer b.socket.Close()
+	b.mutex.Unlock()
+	defer tmpSocket.Close()
+	stop := context.AfterFunc(ctx, func() { tmpSocket.Close() })
+	defer stop()
+	b.sendMutex.Lock()
 	b.socketChan = make(chan *channelString, 30)
+	b.sendQueue, b.sendPending, b.pumping, b.sendClosed = nil, 0, false, false
+	b.sendMutex.Unlock()
 	go b.socketReader()
 	go b.ticker()
 	outWriter := bufio.NewWriter(b.socket)
-	b.sendPass()
-	b.setNick()
-	b.setUser()
+	if b.IsServer {
+		b.linkRegister()
+	} else {
+		b.capLS()
+		b.sendPass()
+		b.setNick()
+		b.setUser()
+	}
+	var fatal error // error announced by the server before it closes the connection
 SocketLoop:
 	for m := range b.socketChan {
 		if m == nil {
 			if lastTime < now()-b.Timeout {
-				err = ErrTimeout
+				err = &TimeoutError{Elapsed: time.Second * time.Duration(now()-lastTime)}
 				break SocketLoop
-			} else {
-				if lastTime < now()-60 {
-					b.SendString("PING : 1")
-				}
+			}
+			if b.lagExceeded() {
+				err = &TimeoutError{Lag: true, Elapsed: b.Lag()}
+				break SocketLoop
+			}
+			if b.pingDue(lastTime) {
+				b.sendPing()
+			}
+			if !b.IsServer {
+				b.pollPresence()
 			}
 			continue SocketLoop
 		}
 		switch m.Dir {
 		case socketWrite:
+			b.sent()
+			b.logLine("out", m.Data)
+			b.metricLineOut(m.Data)
 			n, err = outWriter.WriteString(m.Data)
 			if err != nil {
 				break SocketLoop
@@ -226,30 +432,77 @@ SocketLoop:
 			lastTime = now()
 			if m.Err != nil {
 				err = m.Err
+				if fatal != nil {
+					err = fatal
+				}
 				break SocketLoop
 			}
-			msg := irc.ParseMessage(m.Data)
+			b.logLine("in", m.Data)
+			tags, line := parseTags(m.Data)
+			msg := irc.ParseMessage(line)
 			if msg != nil {
+				b.metricLineIn(msg.Command, m.Data)
+				switch msg.Command {
+				case "ERROR":
+					err = serverError(msg.Trailing)
+					if fatal != nil {
+						err = fatal
+					}
+					break SocketLoop
+				case "KILL":
+					if len(msg.Params) > 0 && b.isMe(msg.Params[0]) {
+						fatal = &KilledError{Reason: msg.Trailing}
+						if msg.Prefix != nil {
+							fatal.(*KilledError).By = msg.Prefix.Name
+						}
+					}
+				}
+				if b.IsServer {
+					if err = b.handleLink(msg); err != nil {
+						break SocketLoop
+					}
+					continue SocketLoop
+				}
+				if b.inHistoryBatch(msg, tags) {
+					b.emit(Event{Type: EventMessage, Message: msg, Tags: tags, history: true})
+					continue SocketLoop
+				}
+				shared := b.track(msg, tags)
+				if msg.Command == "CAP" {
+					b.handleCap(msg)
+				}
+				b.handlePresence(msg)
+				b.handleBouncer(msg, tags)
+				if b.CatchUp {
+					b.handleHistory(msg, tags)
+				}
 				if msg.Prefix != nil {
 					if msg.Prefix.IsServer() {
 						switch msg.Command {
 						case "433":
 							b.setNick()
+						case "PONG":
+							if !b.handlePong(msg.Trailing) {
+								b.dispatchTags(msg, tags)
+							}
 						case "001":
 							b.setConnected(true)
+							b.logInfo("registered", "nick", b.CurrentNick())
+							b.emit(Event{Type: EventConnected, Message: msg})
 							if b.ConnectedHandler != nil {
-								go b.ConnectedHandler()
+								go b.runConnectedHandler()
 							}
 						default:
-							if b.Handler != nil {
-								go b.Handler(msg)
+							if !b.Connected() {
+								if err = registrationError(msg.Command, msg.Trailing); err != nil {
+									break SocketLoop
+								}
 							}
+							b.dispatchTags(msg, tags)
 						}
 						continue SocketLoop
 					}
-					if b.Handler != nil {
-						go b.Handler(msg)
-					}
+					b.dispatchEvent(Event{Type: EventMessage, Message: msg, Tags: tags, Shared: shared})
 				} else {
 					switch msg.Command {
 					case "PING":
@@ -259,9 +512,14 @@ SocketLoop:
 			}
 		}
 	}
+	b.logError("disconnected", err, "address", b.ConnectAddress)
+	b.emit(Event{Type: EventDisconnected, Err: err})
+	b.sendMutex.Lock()
+	b.sendClosed = true
+	close(b.socketChan)
+	b.sendMutex.Unlock()
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
-	close(b.socketChan)
 	b.err = err
 	b.connected = false
 	loopError = nil
@@ -269,6 +527,7 @@ SocketLoop:
 }
 
 func (b *Bot) setError(err error) {
+	b.emit(Event{Type: EventError, Err: err})
 	if b.ErrChan != nil {
 		go func() {
 			b.ErrChan <- err
@@ -283,4 +542,14 @@ func (b *Bot) setConnected(connected bool) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 	b.connected = connected
+	if connected {
+		b.registeredAt = time.Now()
+	}
+}
+
+// registeredSince returns true if registration completed after t.
+func (b *Bot) registeredSince(t time.Time) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.registeredAt.After(t)
 }
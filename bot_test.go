@@ -1,7 +1,13 @@
 package flockerbot
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -49,3 +55,127 @@ func TestBot(t *testing.T) {
 		t.Errorf("Connect: %s", b.Error())
 	}
 }
+
+// fakeServer accepts one connection, sends lines to it and discards what the bot sends. It
+// returns the address to connect to.
+func fakeServer(t *testing.T, lines ...string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+		r := bufio.NewReader(conn)
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// testFlood connects b to a server sending lines followed by n PRIVMSGs from source, and fails
+// unless all of them reach the handler.
+func testFlood(t *testing.T, b *Bot, source string, n int, lines ...string) {
+	for i := 0; i < n; i++ {
+		lines = append(lines, ":"+source+" PRIVMSG #big :flood "+strconv.Itoa(i))
+	}
+	b.ConnectAddress = fakeServer(t, lines...)
+	b.Timeout = 10
+	handled := make(chan struct{}, n)
+	b.Handler = func(msg *irc.Message) {
+		if msg.Command == "PRIVMSG" && strings.HasPrefix(msg.Trailing, "flood ") {
+			handled <- struct{}{}
+		}
+	}
+	b.Setup()
+	go b.Connect()
+	defer b.Disconnect()
+	for i := 0; i < n; i++ {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only %d of %d lines handled", i, n)
+		}
+	}
+}
+
+func TestSendAfterDisconnect(t *testing.T) {
+	b := &Bot{Nick: "flocker", User: "flocker", Timeout: 10, ConnectAddress: fakeServer(t, ":irc.example 001 flocker :Welcome")}
+	b.Setup()
+	done := make(chan struct{})
+	go func() {
+		b.Connect()
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); !b.Connected(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Not connected")
+		}
+	}
+	b.Disconnect()
+	<-done
+	// The connection is gone, so the line is dropped instead of sent on a closed channel.
+	b.SendString("PRIVMSG #flocker :too late")
+}
+
+func TestKilledCaseInsensitive(t *testing.T) {
+	b := &Bot{Nick: "flocker", User: "flocker", Timeout: 10, ConnectAddress: fakeServer(t,
+		":irc.example 001 flocker :Welcome",
+		":oper!o@h KILL FLOCKER :spam",
+		"ERROR :Closing Link: flocker (Killed (oper (spam)))",
+	)}
+	b.Setup()
+	b.Connect()
+	var killed *KilledError
+	if !errors.As(b.Error(), &killed) || killed.By != "oper" || killed.Reason != "spam" {
+		t.Errorf("Expected KilledError, got %v", b.Error())
+	}
+}
+
+type depthMetrics struct {
+	mutex sync.Mutex
+	depth int
+}
+
+func (m *depthMetrics) LineIn(string, int)           {}
+func (m *depthMetrics) LineOut(string, int)          {}
+func (m *depthMetrics) Reconnect(string)             {}
+func (m *depthMetrics) PingLatency(time.Duration)    {}
+func (m *depthMetrics) HandlerLatency(time.Duration) {}
+func (m *depthMetrics) HandlerPanic()                {}
+func (m *depthMetrics) SendQueue(depth int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.depth = depth
+}
+
+func TestSendQueueDepth(t *testing.T) {
+	// Lines waiting for room in socketChan count as well.
+	m := &depthMetrics{}
+	b := testBot("flocker")
+	b.Metrics = m
+	b.socketChan = make(chan *channelString, 1)
+	for i := 0; i < 3; i++ {
+		b.SendString("PRIVMSG #flocker :" + strconv.Itoa(i))
+	}
+	if m.depth != 3 {
+		t.Errorf("Depth %d, want 3", m.depth)
+	}
+	for i := 0; i < 3; i++ {
+		nextLine(t, b)
+		b.sent()
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.depth != 0 {
+		t.Errorf("Depth %d after writing, want 0", m.depth)
+	}
+}
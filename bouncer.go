@@ -0,0 +1,128 @@
+package flockerbot
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+var (
+	// ErrNoBouncer signals that the server did not enable soju.im/bouncer-networks
+	ErrNoBouncer = errors.New("Bot: Bouncer networks not supported")
+)
+
+// BouncerNetwork is a network behind a soju bouncer.
+type BouncerNetwork struct {
+	ID    string            // Network ID, for BouncerNetID.
+	Name  string            // Network name.
+	State string            // "connected", "connecting" or "disconnected".
+	Attrs map[string]string // All attributes, e.g. "host" and "nickname".
+}
+
+// wantedBouncerCaps returns the bouncer capabilities to request for the configuration.
+func (b *Bot) wantedBouncerCaps() []string {
+	var caps []string
+	if b.Playback {
+		caps = append(caps, "znc.in/playback")
+	}
+	if b.BouncerNetID != "" || b.BouncerControl {
+		caps = append(caps, "soju.im/bouncer-networks")
+	}
+	return caps
+}
+
+// bouncerBind binds the connection to BouncerNetID. It has to happen before CAP END.
+func (b *Bot) bouncerBind() {
+	b.mutex.RLock()
+	negotiating := b.capNegotiating
+	b.mutex.RUnlock()
+	if negotiating && b.BouncerNetID != "" && b.HasCap("soju.im/bouncer-networks") {
+		b.SendString("BOUNCER BIND " + b.BouncerNetID)
+	}
+}
+
+// BouncerNetworks lists the networks of the soju bouncer we are connected to. It requires
+// BouncerControl or BouncerNetID.
+func (b *Bot) BouncerNetworks(ctx context.Context) ([]BouncerNetwork, error) {
+	if !b.HasCap("soju.im/bouncer-networks") {
+		return nil, ErrNoBouncer
+	}
+	events, err := b.requestBatch(ctx, "BOUNCER LISTNETWORKS", func(typ string) bool {
+		return typ == "soju.im/bouncer-networks"
+	})
+	if err != nil {
+		return nil, err
+	}
+	var networks []BouncerNetwork
+	for _, ev := range events {
+		// BOUNCER NETWORK netid attributes
+		p := params(ev.Message)
+		if ev.Message.Command != "BOUNCER" || len(p) < 3 || p[0] != "NETWORK" || p[2] == "*" {
+			continue
+		}
+		attrs := parseTagList(p[2])
+		networks = append(networks, BouncerNetwork{ID: p[1], Name: attrs["name"], State: attrs["state"], Attrs: attrs})
+	}
+	return networks, nil
+}
+
+// handleBouncer records the time of the latest message and requests the playback from ZNC at
+// the end of the MOTD, for Playback.
+func (b *Bot) handleBouncer(msg *irc.Message, tags map[string]string) {
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE":
+		if t := serverTime(tags); !t.IsZero() {
+			b.mutex.Lock()
+			if t.After(b.lastMessage) {
+				b.lastMessage = t
+			}
+			b.mutex.Unlock()
+		}
+	case "376", "422": // End of MOTD, no MOTD
+		if !b.HasCap("znc.in/playback") {
+			return
+		}
+		b.mutex.RLock()
+		since := b.lastMessage
+		b.mutex.RUnlock()
+		b.SendString("PRIVMSG *playback :PLAY * " + playbackTime(since))
+	}
+}
+
+// playbackTime formats t as the Unix timestamp the playback module expects, "0" for the zero time.
+func playbackTime(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', 3, 64)
+}
+
+// AddBouncerNetworks adds a bot for each network behind the soju bouncer control is connected to,
+// named after the network, unless a network of that name exists. newBot returns the bot for a
+// network; its BouncerNetID is set to the network's ID. Returns the names of the added networks,
+// which are connected by Start.
+func (m *Manager) AddBouncerNetworks(ctx context.Context, control *Bot, newBot func(n BouncerNetwork) *Bot) ([]string, error) {
+	networks, err := control.BouncerNetworks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var added []string
+	for _, n := range networks {
+		name := n.Name
+		if name == "" {
+			name = n.ID
+		}
+		b := newBot(n)
+		b.BouncerNetID = n.ID
+		if err := m.Add(name, b); err == ErrDuplicateNetwork {
+			continue
+		} else if err != nil {
+			return added, err
+		}
+		added = append(added, name)
+	}
+	return added, nil
+}
@@ -0,0 +1,91 @@
+package flockerbot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+func TestZNCPlayback(t *testing.T) {
+	b := testBot("flocker")
+	b.Playback = true
+	b.capLS()
+	nextLine(t, b)
+	b.handleCap(irc.ParseMessage(":irc.znc.in CAP * LS :znc.in/playback server-time"))
+	if l := nextLine(t, b); l != "CAP REQ :server-time znc.in/playback" {
+		t.Errorf("Unexpected request %q", l)
+	}
+	b.handleCap(irc.ParseMessage(":irc.znc.in CAP flocker ACK :server-time znc.in/playback"))
+	nextLine(t, b) // CAP END
+	b.handleBouncer(irc.ParseMessage(":irc.znc.in 376 flocker :End of MOTD"), nil)
+	if l := nextLine(t, b); l != "PRIVMSG *playback :PLAY * 0" {
+		t.Errorf("Unexpected playback request %q", l)
+	}
+	b.handleBouncer(irc.ParseMessage(":alice!a@h PRIVMSG #flocker :hi"), map[string]string{"time": "2024-01-01T12:00:00.250Z"})
+	b.handleBouncer(irc.ParseMessage(":irc.znc.in 422 flocker :MOTD File is missing"), nil)
+	if l := nextLine(t, b); l != "PRIVMSG *playback :PLAY * 1704110400.250" {
+		t.Errorf("Unexpected playback request %q", l)
+	}
+}
+
+func TestBouncerNetworks(t *testing.T) {
+	control := testBot("flocker")
+	control.BouncerControl = true
+	control.capLS()
+	nextLine(t, control)
+	control.handleCap(irc.ParseMessage(":soju CAP * LS :soju.im/bouncer-networks batch"))
+	if l := nextLine(t, control); l != "CAP REQ :batch soju.im/bouncer-networks" {
+		t.Errorf("Unexpected request %q", l)
+	}
+	control.handleCap(irc.ParseMessage(":soju CAP flocker ACK :batch soju.im/bouncer-networks"))
+	if l := nextLine(t, control); l != "CAP END" {
+		t.Errorf("Expected CAP END without bind, got %q", l)
+	}
+
+	m := NewManager()
+	done := make(chan []string)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		added, err := m.AddBouncerNetworks(ctx, control, func(n BouncerNetwork) *Bot {
+			return &Bot{Nick: "flocker", ConnectAddress: "soju.example:6697"}
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- added
+	}()
+	if l := nextLine(t, control); l != "BOUNCER LISTNETWORKS" {
+		t.Errorf("Unexpected line %q", l)
+	}
+	feed(control,
+		":soju BATCH +n soju.im/bouncer-networks",
+		`@batch=n :soju BOUNCER NETWORK 1 name=Libera;state=connected;host=irc.libera.chat`,
+		`@batch=n :soju BOUNCER NETWORK 2 name=OFTC;state=disconnected`,
+		":soju BATCH -n",
+	)
+	added := <-done
+	if len(added) != 2 || added[0] != "Libera" || added[1] != "OFTC" {
+		t.Fatalf("Unexpected networks %v", added)
+	}
+	oftc := m.Bot("OFTC")
+	if oftc.BouncerNetID != "2" {
+		t.Errorf("Unexpected network ID %q", oftc.BouncerNetID)
+	}
+
+	// The network bot binds before ending the negotiation.
+	oftc.socketChan = make(chan *channelString, 10)
+	oftc.capLS()
+	nextLine(t, oftc)
+	oftc.handleCap(irc.ParseMessage(":soju CAP * LS :soju.im/bouncer-networks"))
+	nextLine(t, oftc)
+	oftc.handleCap(irc.ParseMessage(":soju CAP flocker ACK :soju.im/bouncer-networks"))
+	if l := nextLine(t, oftc); l != "BOUNCER BIND 2" {
+		t.Errorf("Expected bind, got %q", l)
+	}
+	if l := nextLine(t, oftc); l != "CAP END" {
+		t.Errorf("Expected CAP END, got %q", l)
+	}
+}
@@ -0,0 +1,484 @@
+package flockerbot
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sorcix/irc"
+)
+
+// BridgeFilter selects which events besides messages a Bridge relays.
+type BridgeFilter int
+
+const (
+	// RelayActions relays CTCP ACTION (/me) messages.
+	RelayActions BridgeFilter = 1 << iota
+	// RelayNotices relays NOTICE messages.
+	RelayNotices
+	// RelayJoins relays joins.
+	RelayJoins
+	// RelayParts relays parts and kicks.
+	RelayParts
+	// RelayQuits relays quits and nick changes of users in bridged channels.
+	RelayQuits
+	// RelayAll relays everything.
+	RelayAll = RelayActions | RelayNotices | RelayJoins | RelayParts | RelayQuits
+)
+
+const (
+	bridgeMaxText   = 400 // maximum bytes of text per relayed line
+	bridgeQueueSize = 256 // lines queued per network before dropping
+)
+
+// BridgeEndpoint is a channel on a network of the Manager.
+type BridgeEndpoint struct {
+	Network string // Network name in the Manager.
+	Channel string // Channel name.
+}
+
+// Bridge mirrors messages between channels on the networks of a Manager. Everything said in one
+// endpoint is relayed to all others. Create it with NewBridge.
+type Bridge struct {
+	Endpoints   []BridgeEndpoint // Linked channels.
+	NickFormat  string           // Prefix for relayed lines. {nick} and {network} are replaced. Default "<{nick}> ".
+	Relay       BridgeFilter     // Events relayed in addition to PRIVMSG.
+	IgnoreNicks []string         // Nicks that are never relayed, e.g. other relay bots.
+	LineDelay   time.Duration    // Minimum delay between lines sent to one network, after Burst lines. Default 500ms.
+	Burst       int              // Lines that may be sent without delay. Default 4.
+
+	// Puppets enables pseudo-puppet mode if set. It returns a new, unconnected bot for nick on
+	// network, which the bridge connects and uses to relay that user's messages without prefix.
+	// Until the puppet is registered, messages are relayed with prefix by the network's bot.
+	Puppets    func(network, nick string) *Bot
+	PuppetIdle time.Duration // Puppets idle longer than this are disconnected. Default 30 minutes.
+
+	manager *Manager
+	mutex   sync.Mutex
+	queues  map[string]*bridgeQueue
+	puppets map[string]*puppet
+	closed  bool
+}
+
+// bridgeQueue rate limits lines sent by one bot.
+type bridgeQueue struct {
+	lines   chan string
+	bot     func() *Bot // The bot to send with, nil if there is none.
+	dropped int
+}
+
+// puppet is a connection relaying the messages of one remote user.
+type puppet struct {
+	bot      *Bot
+	network  string // network the puppet is connected to
+	source   string // network of the user
+	nick     string // nick of the user on source
+	queue    *bridgeQueue
+	lastUsed time.Time
+}
+
+// NewBridge links the endpoints on the networks of m and registers the bridge as handler of m.
+func NewBridge(m *Manager, endpoints ...BridgeEndpoint) *Bridge {
+	br := &Bridge{
+		Endpoints:  endpoints,
+		NickFormat: "<{nick}> ",
+		LineDelay:  time.Millisecond * 500,
+		Burst:      4,
+		PuppetIdle: time.Minute * 30,
+		manager:    m,
+		queues:     make(map[string]*bridgeQueue),
+		puppets:    make(map[string]*puppet),
+	}
+	m.Handle(br.handle)
+	return br
+}
+
+// Close stops relaying and disconnects all puppets.
+func (br *Bridge) Close() {
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	if br.closed {
+		return
+	}
+	br.closed = true
+	for _, q := range br.queues {
+		close(q.lines)
+	}
+	for key, p := range br.puppets {
+		br.dropPuppet(key, p)
+	}
+}
+
+// handle is registered as Manager handler.
+func (br *Bridge) handle(ev NetworkEvent) {
+	switch ev.Type {
+	case EventConnected:
+		for _, e := range br.Endpoints {
+			if e.Network == ev.Network {
+				ev.Bot.SendString("JOIN " + e.Channel)
+			}
+		}
+		return
+	case EventMessage:
+	default:
+		return
+	}
+	msg := ev.Message
+	if msg.Prefix == nil || msg.Prefix.IsServer() || br.ignored(ev.Network, ev.Bot, msg.Prefix.Name) {
+		return
+	}
+	nick := msg.Prefix.Name
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE":
+		if len(msg.Params) == 0 {
+			return
+		}
+		text := msg.Trailing
+		action := false
+		if strings.HasPrefix(text, "\x01") {
+			if !strings.HasPrefix(text, "\x01ACTION ") || br.Relay&RelayActions == 0 {
+				return // other CTCPs are not relayed
+			}
+			text = strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+			action = true
+		}
+		if msg.Command == "NOTICE" && br.Relay&RelayNotices == 0 {
+			return
+		}
+		br.relayText(ev.Network, msg.Params[0], nick, text, action, msg.Command == "NOTICE")
+	case "JOIN":
+		if br.Relay&RelayJoins != 0 {
+			br.relayInfo(ev.Network, firstParam(msg), nick, "has joined")
+		}
+	case "PART":
+		for _, channel := range strings.Split(firstParam(msg), ",") {
+			if br.Relay&RelayParts != 0 {
+				br.relayInfo(ev.Network, channel, nick, "has left"+reason(msg.Trailing))
+			}
+			if br.bridged(ev.Network, channel) {
+				br.dropPuppets(ev.Network, nick)
+			}
+		}
+	case "KICK":
+		if br.Relay&RelayParts != 0 && len(msg.Params) > 1 {
+			br.relayInfo(ev.Network, msg.Params[0], msg.Params[1], "was kicked by "+nick+reason(msg.Trailing))
+		}
+	case "QUIT", "NICK":
+		// Quits and nick changes go to the endpoints the user was in.
+		text := "has quit" + reason(msg.Trailing)
+		if msg.Command == "NICK" {
+			text = "is now known as " + firstParam(msg)
+		}
+		// Each endpoint is told once, and not if the user was in it.
+		seen := make(map[BridgeEndpoint]bool)
+		for _, channel := range ev.Shared {
+			seen[BridgeEndpoint{ev.Network, br.fold(ev.Network, channel)}] = true
+		}
+		bridged := false
+		for _, channel := range ev.Shared {
+			for _, t := range br.targets(ev.Network, channel) {
+				bridged = true
+				key := BridgeEndpoint{t.Network, br.fold(t.Network, t.Channel)}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				if br.Relay&RelayQuits != 0 {
+					br.send(t.Network, "NOTICE "+t.Channel+" :* "+nick+" "+text)
+				}
+			}
+		}
+		if bridged {
+			br.dropPuppets(ev.Network, nick)
+		}
+	}
+}
+
+// bridged returns true if channel on network is an endpoint.
+func (br *Bridge) bridged(network, channel string) bool {
+	folded := br.fold(network, channel)
+	for _, e := range br.Endpoints {
+		if e.Network == network && br.fold(network, e.Channel) == folded {
+			return true
+		}
+	}
+	return false
+}
+
+// ignored returns true for messages of our own bots, puppets and IgnoreNicks.
+func (br *Bridge) ignored(network string, b *Bot, nick string) bool {
+	if b.EqualFold(nick, b.CurrentNick()) {
+		return true
+	}
+	for _, n := range br.IgnoreNicks {
+		if b.EqualFold(nick, n) {
+			return true
+		}
+	}
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	for _, p := range br.puppets {
+		if p.network == network && b.EqualFold(nick, p.bot.CurrentNick()) {
+			return true
+		}
+	}
+	return false
+}
+
+// targets returns all endpoints linked to channel on network, excluding itself.
+func (br *Bridge) targets(network, channel string) []BridgeEndpoint {
+	var source bool
+	var targets []BridgeEndpoint
+	folded := br.fold(network, channel)
+	for _, e := range br.Endpoints {
+		if e.Network == network && br.fold(network, e.Channel) == folded {
+			source = true
+			continue
+		}
+		targets = append(targets, e)
+	}
+	if !source {
+		return nil
+	}
+	return targets
+}
+
+// relayText relays a message or action of nick to all other endpoints.
+func (br *Bridge) relayText(network, channel, nick, text string, action, notice bool) {
+	for _, t := range br.targets(network, channel) {
+		if !notice {
+			if p := br.puppet(t.Network, network, nick); p != nil {
+				for _, chunk := range splitText(text, bridgeMaxText) {
+					if action {
+						chunk = "\x01ACTION " + chunk + "\x01"
+					}
+					br.sendPuppet(p, "PRIVMSG "+t.Channel+" :"+chunk)
+				}
+				continue
+			}
+		}
+		prefix := br.prefix(network, nick)
+		if action {
+			prefix = "* " + nick + " "
+		}
+		command := "PRIVMSG "
+		if notice {
+			command = "NOTICE "
+		}
+		for _, chunk := range splitText(text, bridgeMaxText-len(prefix)) {
+			br.send(t.Network, command+t.Channel+" :"+prefix+chunk)
+		}
+	}
+}
+
+// relayInfo relays a join/part/quit style notice about nick.
+func (br *Bridge) relayInfo(network, channel, nick, text string) {
+	for _, t := range br.targets(network, channel) {
+		br.send(t.Network, "NOTICE "+t.Channel+" :* "+nick+" "+text)
+	}
+}
+
+// prefix returns the formatted nick prefix.
+func (br *Bridge) prefix(network, nick string) string {
+	// A zero width space in the nick prevents highlighting the user on the other side.
+	if len(nick) > 1 {
+		_, size := utf8.DecodeRuneInString(nick)
+		nick = nick[:size] + "\u200b" + nick[size:]
+	}
+	return strings.NewReplacer("{nick}", nick, "{network}", network).Replace(br.NickFormat)
+}
+
+// send queues line for the bot of network, respecting the rate limit.
+func (br *Bridge) send(network, line string) {
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	if br.closed {
+		return
+	}
+	q, ok := br.queues[network]
+	if !ok {
+		q = br.newQueue(func() *Bot { return br.manager.Bot(network) })
+		br.queues[network] = q
+	}
+	q.push(line)
+}
+
+// sendPuppet queues line for puppet p, with the rate limit of the network bots.
+func (br *Bridge) sendPuppet(p *puppet, line string) {
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	if br.closed {
+		return
+	}
+	if p.queue == nil {
+		bot := p.bot
+		p.queue = br.newQueue(func() *Bot { return bot })
+	}
+	p.queue.push(line)
+}
+
+// newQueue returns a queue sending with bot, and starts its sender.
+func (br *Bridge) newQueue(bot func() *Bot) *bridgeQueue {
+	q := &bridgeQueue{lines: make(chan string, bridgeQueueSize), bot: bot}
+	go br.sender(q)
+	return q
+}
+
+// push queues line, or drops it if the queue is full. Must be called with the bridge mutex held.
+func (q *bridgeQueue) push(line string) {
+	select {
+	case q.lines <- line:
+	default:
+		q.dropped++
+	}
+}
+
+// sender sends the queued lines of q, allowing Burst lines at once and then one per LineDelay.
+func (br *Bridge) sender(q *bridgeQueue) {
+	tokens := br.Burst
+	last := time.Now()
+	for line := range q.lines {
+		if br.LineDelay > 0 {
+			tokens += int(time.Since(last) / br.LineDelay)
+			if tokens > br.Burst {
+				tokens = br.Burst
+			}
+			if tokens <= 0 {
+				time.Sleep(br.LineDelay)
+				tokens = 1
+			}
+			tokens--
+			last = time.Now()
+		}
+		if b := q.bot(); b != nil && b.Connected() {
+			// SendString drops the line if the connection ends meanwhile.
+			b.SendString(line)
+		}
+	}
+}
+
+// puppet returns the registered puppet on network for nick of the source network, or nil if
+// puppets are disabled or the puppet is not ready yet. A missing puppet is created and connected.
+func (br *Bridge) puppet(network, source, nick string) *puppet {
+	if br.Puppets == nil {
+		return nil
+	}
+	key := network + " " + source + " " + br.fold(source, nick)
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	if br.closed {
+		return nil
+	}
+	br.reapPuppets()
+	p, ok := br.puppets[key]
+	if !ok {
+		b := br.Puppets(network, nick)
+		if b == nil {
+			return nil
+		}
+		p = &puppet{bot: b, network: network, source: source, nick: nick}
+		br.puppets[key] = p
+		channels := br.channels(network)
+		b.Setup()
+		b.ConnectedHandler = func() {
+			for _, c := range channels {
+				b.SendString("JOIN " + c)
+			}
+		}
+		b.SetAutoReconnect(true)
+		go b.StayConnected()
+	}
+	p.lastUsed = time.Now()
+	if !p.bot.Connected() {
+		return nil
+	}
+	return p
+}
+
+// fold folds a nick or channel name with the case mapping of network.
+func (br *Bridge) fold(network, s string) string {
+	if b := br.manager.Bot(network); b != nil {
+		return b.Fold(s)
+	}
+	return CaseRFC1459.Fold(s)
+}
+
+// channels returns the endpoint channels on network.
+func (br *Bridge) channels(network string) []string {
+	var channels []string
+	for _, e := range br.Endpoints {
+		if e.Network == network {
+			channels = append(channels, e.Channel)
+		}
+	}
+	return channels
+}
+
+// reapPuppets disconnects idle puppets. Must be called with mutex held.
+func (br *Bridge) reapPuppets() {
+	for key, p := range br.puppets {
+		if time.Since(p.lastUsed) > br.PuppetIdle {
+			br.dropPuppet(key, p)
+		}
+	}
+}
+
+// dropPuppet disconnects p and forgets it. Must be called with mutex held.
+func (br *Bridge) dropPuppet(key string, p *puppet) {
+	p.bot.SetAutoReconnect(false)
+	p.bot.Disconnect()
+	if p.queue != nil {
+		close(p.queue.lines)
+	}
+	delete(br.puppets, key)
+}
+
+// dropPuppets disconnects the puppets of nick of the source network.
+func (br *Bridge) dropPuppets(source, nick string) {
+	folded := br.fold(source, nick)
+	br.mutex.Lock()
+	defer br.mutex.Unlock()
+	for key, p := range br.puppets {
+		if p.source == source && br.fold(source, p.nick) == folded {
+			br.dropPuppet(key, p)
+		}
+	}
+}
+
+// firstParam returns the first parameter of msg, which may be the trailing one.
+func firstParam(msg *irc.Message) string {
+	if len(msg.Params) > 0 {
+		return msg.Params[0]
+	}
+	return msg.Trailing
+}
+
+// reason formats an optional part/quit/kick reason.
+func reason(text string) string {
+	if text == "" {
+		return ""
+	}
+	return " (" + text + ")"
+}
+
+// splitText splits text into chunks of at most max bytes, preferring to split at spaces and
+// never splitting UTF-8 sequences.
+func splitText(text string, max int) []string {
+	if max < 16 {
+		max = 16
+	}
+	var chunks []string
+	for len(text) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		if i := strings.LastIndexByte(text[:cut], ' '); i > max/2 {
+			cut = i
+		}
+		chunks = append(chunks, text[:cut])
+		text = strings.TrimLeft(text[cut:], " ")
+	}
+	return append(chunks, text)
+}
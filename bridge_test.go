@@ -0,0 +1,133 @@
+package flockerbot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+func testBot(nick string) *Bot {
+	b := &Bot{Nick: nick, activeNick: nick, connected: true}
+	b.Setup()
+	b.socketChan = make(chan *channelString, 30)
+	return b
+}
+
+func nextLine(t *testing.T, b *Bot) string {
+	select {
+	case m := <-b.socketChan:
+		return strings.TrimRight(m.Data, "\r\n")
+	case <-time.After(time.Second):
+		t.Fatal("No line sent")
+	}
+	return ""
+}
+
+func TestBridge(t *testing.T) {
+	m := NewManager()
+	libera, oftc := testBot("relay"), testBot("relay")
+	m.Add("libera", libera)
+	m.Add("oftc", oftc)
+	br := NewBridge(m, BridgeEndpoint{"libera", "#flocker"}, BridgeEndpoint{"oftc", "#Flocker"})
+	br.Relay = RelayActions
+	br.IgnoreNicks = []string{"otherbot"}
+	defer br.Close()
+
+	br.handle(NetworkEvent{Network: "libera", Bot: libera, Event: Event{Type: EventMessage, Message: irc.ParseMessage(":relay!r@h PRIVMSG #flocker :loop")}})
+	br.handle(NetworkEvent{Network: "libera", Bot: libera, Event: Event{Type: EventMessage, Message: irc.ParseMessage(":otherbot!r@h PRIVMSG #flocker :loop")}})
+	br.handle(NetworkEvent{Network: "libera", Bot: libera, Event: Event{Type: EventMessage, Message: irc.ParseMessage(":alice!a@h PRIVMSG #other :unbridged")}})
+	br.handle(NetworkEvent{Network: "libera", Bot: libera, Event: Event{Type: EventMessage, Message: irc.ParseMessage(":alice!a@h JOIN #flocker")}})
+	br.handle(NetworkEvent{Network: "libera", Bot: libera, Event: Event{Type: EventMessage, Message: irc.ParseMessage(":alice!a@h PRIVMSG #flocker :hello")}})
+	br.handle(NetworkEvent{Network: "oftc", Bot: oftc, Event: Event{Type: EventMessage, Message: irc.ParseMessage(":bob!b@h PRIVMSG #flocker :\x01ACTION waves\x01")}})
+	if l := nextLine(t, oftc); l != "PRIVMSG #Flocker :<a\u200blice> hello" {
+		t.Errorf("Unexpected relay %q", l)
+	}
+	if l := nextLine(t, libera); l != "PRIVMSG #flocker :* bob waves" {
+		t.Errorf("Unexpected action relay %q", l)
+	}
+	if len(oftc.socketChan) != 0 || len(libera.socketChan) != 0 {
+		t.Error("Unexpected extra lines relayed")
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	chunks := splitText(strings.Repeat("äbc ", 20), 20)
+	for _, c := range chunks {
+		if len(c) > 20 || !strings.HasPrefix(c, "äbc") {
+			t.Errorf("Bad chunk %q", c)
+		}
+	}
+	if strings.TrimSpace(strings.Join(chunks, " ")) != strings.TrimSpace(strings.Repeat("äbc ", 20)) {
+		t.Error("Text lost while splitting")
+	}
+}
+
+func TestBridgeQuit(t *testing.T) {
+	m := NewManager()
+	libera, oftc := testBot("relay"), testBot("relay")
+	m.Add("libera", libera)
+	m.Add("oftc", oftc)
+	br := NewBridge(m, BridgeEndpoint{"libera", "#flocker"}, BridgeEndpoint{"libera", "#side"}, BridgeEndpoint{"oftc", "#Flocker"})
+	br.Relay = RelayQuits
+	defer br.Close()
+	quit := func(network string, b *Bot, nick string, shared ...string) {
+		br.handle(NetworkEvent{Network: network, Bot: b, Event: Event{Type: EventMessage, Message: irc.ParseMessage(":" + nick + "!u@h QUIT :bye"), Shared: shared}})
+	}
+	quit("libera", libera, "stranger", "#other")
+	quit("libera", libera, "alice", "#FLOCKER", "#side", "#other")
+	if l := nextLine(t, oftc); l != "NOTICE #Flocker :* alice has quit (bye)" {
+		t.Errorf("Unexpected relay %q", l)
+	}
+	if len(oftc.socketChan) != 0 || len(libera.socketChan) != 0 {
+		t.Error("Quit relayed to unrelated endpoints or twice")
+	}
+}
+
+func TestBridgeDropPuppets(t *testing.T) {
+	m := NewManager()
+	libera, oftc := testBot("relay"), testBot("relay")
+	m.Add("libera", libera)
+	m.Add("oftc", oftc)
+	br := NewBridge(m, BridgeEndpoint{"libera", "#flocker"}, BridgeEndpoint{"oftc", "#flocker"})
+	defer br.Close()
+	// alice of libera is puppeted on oftc, another alice of oftc on libera.
+	br.puppets["oftc libera alice"] = &puppet{bot: testBot("alice[l]"), network: "oftc", source: "libera", nick: "Alice", lastUsed: time.Now()}
+	br.puppets["libera oftc alice"] = &puppet{bot: testBot("alice[o]"), network: "libera", source: "oftc", nick: "alice", lastUsed: time.Now()}
+	event := func(network string, b *Bot, line string) {
+		br.handle(NetworkEvent{Network: network, Bot: b, Event: Event{Type: EventMessage, Message: irc.ParseMessage(line)}})
+	}
+	event("libera", libera, ":alice!a@h PART #unbridged")
+	event("oftc", oftc, ":Alice!a@h PART #flocker")
+	if _, ok := br.puppets["oftc libera alice"]; !ok || len(br.puppets) != 1 {
+		t.Errorf("Unexpected puppets after parts %v", br.puppets)
+	}
+	event("libera", libera, ":ALICE!a@h PART #Flocker")
+	if len(br.puppets) != 0 {
+		t.Errorf("Puppet not dropped on part %v", br.puppets)
+	}
+}
+
+func TestBridgePuppetRateLimit(t *testing.T) {
+	m := NewManager()
+	libera, oftc := testBot("relay"), testBot("relay")
+	m.Add("libera", libera)
+	m.Add("oftc", oftc)
+	br := NewBridge(m, BridgeEndpoint{"libera", "#flocker"}, BridgeEndpoint{"oftc", "#flocker"})
+	br.Puppets = func(network, nick string) *Bot { return nil }
+	br.Burst, br.LineDelay = 1, time.Hour
+	defer br.Close()
+	alice := testBot("alice[l]")
+	br.puppets["oftc libera alice"] = &puppet{bot: alice, network: "oftc", source: "libera", nick: "alice", lastUsed: time.Now()}
+	for _, text := range []string{"one", "two"} {
+		br.handle(NetworkEvent{Network: "libera", Bot: libera, Event: Event{Type: EventMessage, Message: irc.ParseMessage(":alice!a@h PRIVMSG #flocker :" + text)}})
+	}
+	if l := nextLine(t, alice); l != "PRIVMSG #flocker :one" {
+		t.Errorf("Unexpected puppet line %q", l)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(alice.socketChan) != 0 {
+		t.Error("Puppet line sent beyond the burst")
+	}
+}
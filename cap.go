@@ -0,0 +1,139 @@
+package flockerbot
+
+import (
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// defaultCaps are the IRCv3 capabilities requested if the server offers them.
+var defaultCaps = []string{
+	"cap-notify",
+	"multi-prefix",
+	"userhost-in-names",
+	"account-notify",
+	"extended-join",
+	"account-tag",
+	"away-notify",
+	"chghost",
+	"setname",
+	"invite-notify",
+	"batch",
+	"labeled-response",
+	"server-time",
+	"message-tags",
+	"draft/chathistory",
+}
+
+// HasCap returns true if capability name is enabled on the current connection.
+func (b *Bot) HasCap(name string) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.capsEnabled[name]
+}
+
+// CapValue returns the value the server announced for capability name, e.g. "LATEST,BEFORE" for
+// a capability with a list, and whether it is offered.
+func (b *Bot) CapValue(name string) (string, bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	value, ok := b.capsAvailable[name]
+	return value, ok
+}
+
+// wantedCaps returns the capabilities to request: the defaults, those for the bouncer options and Caps.
+func (b *Bot) wantedCaps() []string {
+	caps := append(defaultCaps[:len(defaultCaps):len(defaultCaps)], b.wantedBouncerCaps()...)
+	return append(caps, b.Caps...)
+}
+
+// capLS starts the capability negotiation. Registration is held until CAP END.
+func (b *Bot) capLS() {
+	b.mutex.Lock()
+	b.capNegotiating = true
+	b.mutex.Unlock()
+	b.SendString("CAP LS 302")
+}
+
+// handleCap processes a CAP reply: me subcommand [*] :capabilities.
+func (b *Bot) handleCap(msg *irc.Message) {
+	p := params(msg)
+	if len(p) < 3 {
+		return
+	}
+	caps := strings.Fields(p[len(p)-1])
+	switch strings.ToUpper(p[1]) {
+	case "LS", "NEW":
+		b.mutex.Lock()
+		for _, c := range caps {
+			name, value, _ := strings.Cut(c, "=")
+			b.capsAvailable[name] = value
+		}
+		b.mutex.Unlock()
+		if len(p) > 3 && p[2] == "*" {
+			// More lines to come.
+			return
+		}
+		b.capRequest()
+	case "ACK":
+		b.mutex.Lock()
+		for _, c := range caps {
+			if name, ok := strings.CutPrefix(c, "-"); ok {
+				delete(b.capsEnabled, name)
+			} else {
+				b.capsEnabled[c] = true
+			}
+		}
+		b.mutex.Unlock()
+		b.bouncerBind()
+		b.capEnd()
+	case "NAK":
+		b.capEnd()
+	case "DEL":
+		b.mutex.Lock()
+		for _, c := range caps {
+			delete(b.capsAvailable, c)
+			delete(b.capsEnabled, c)
+		}
+		b.mutex.Unlock()
+	}
+}
+
+// capRequest requests the wanted capabilities that are offered and not enabled yet, or ends the
+// negotiation if there are none.
+func (b *Bot) capRequest() {
+	var req []string
+	b.mutex.RLock()
+	for _, c := range b.wantedCaps() {
+		if _, ok := b.capsAvailable[c]; ok && !b.capsEnabled[c] && !containsString(req, c) {
+			req = append(req, c)
+		}
+	}
+	b.mutex.RUnlock()
+	if len(req) == 0 {
+		b.capEnd()
+		return
+	}
+	b.SendString("CAP REQ :" + strings.Join(req, " "))
+}
+
+// capEnd ends the negotiation if it is still open.
+func (b *Bot) capEnd() {
+	b.mutex.Lock()
+	negotiating := b.capNegotiating
+	b.capNegotiating = false
+	b.mutex.Unlock()
+	if negotiating {
+		b.SendString("CAP END")
+	}
+}
+
+// containsString returns true if list contains s.
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package flockerbot
+
+import (
+	"strings"
+	"unicode"
+)
+
+// CaseMapping is the rule by which the server compares nicks and channel names, as announced in
+// the CASEMAPPING token of ISUPPORT.
+type CaseMapping string
+
+const (
+	// CaseASCII folds A-Z only.
+	CaseASCII CaseMapping = "ascii"
+	// CaseRFC1459 folds A-Z and []\~ to {}|^. The default if the server does not announce one.
+	CaseRFC1459 CaseMapping = "rfc1459"
+	// CaseStrictRFC1459 folds A-Z and []\ to {}|.
+	CaseStrictRFC1459 CaseMapping = "strict-rfc1459"
+	// CaseRFC7613 folds Unicode case and fullwidth characters. Normalization is not applied.
+	CaseRFC7613 CaseMapping = "rfc7613"
+)
+
+// Fold returns s folded for comparison.
+func (cm CaseMapping) Fold(s string) string {
+	switch cm {
+	case CaseASCII:
+		return foldASCII(s, 'Z')
+	case CaseStrictRFC1459:
+		return foldASCII(s, ']')
+	case CaseRFC7613:
+		return strings.Map(func(r rune) rune {
+			if r >= 0xFF01 && r <= 0xFF5E {
+				// Fullwidth to ASCII.
+				r -= 0xFEE0
+			}
+			return unicode.ToLower(r)
+		}, s)
+	}
+	return foldASCII(s, '^')
+}
+
+// Equal returns true if a and b are equal under the case mapping.
+func (cm CaseMapping) Equal(a, b string) bool {
+	return cm.Fold(a) == cm.Fold(b)
+}
+
+// foldASCII lowercases the range from 'A' to last, which is 'Z', ']' or '^'. The characters
+// []\^ are the uppercase of {}|~ in the rfc1459 mappings.
+func foldASCII(s string, last byte) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 'A' && s[i] <= last {
+			buf := []byte(s)
+			for j := i; j < len(buf); j++ {
+				if buf[j] >= 'A' && buf[j] <= last {
+					buf[j] += 'a' - 'A'
+				}
+			}
+			return string(buf)
+		}
+	}
+	return s
+}
+
+// CaseMapping returns the case mapping of the server, rfc1459 if none or an unknown one was
+// announced.
+func (is *ISupport) CaseMapping() CaseMapping {
+	switch cm := CaseMapping(is.get("CASEMAPPING", "")); cm {
+	case CaseASCII, CaseStrictRFC1459, CaseRFC7613:
+		return cm
+	}
+	return CaseRFC1459
+}
+
+// Fold returns s folded with the case mapping of the server.
+func (b *Bot) Fold(s string) string {
+	return b.ISupport().CaseMapping().Fold(s)
+}
+
+// EqualFold returns true if the nicks or channel names x and y are equal with the case mapping
+// of the server.
+func (b *Bot) EqualFold(x, y string) bool {
+	return b.ISupport().CaseMapping().Equal(x, y)
+}
+
+// FoldMap is a map with case-insensitive string keys, e.g. NewFoldMap[int](bot.Fold). It keeps
+// the key as first set. A FoldMap is not safe for concurrent use.
+type FoldMap[V any] struct {
+	fold func(string) string
+	m    map[string]foldEntry[V]
+}
+
+type foldEntry[V any] struct {
+	key   string
+	value V
+}
+
+// NewFoldMap returns an empty map folding keys with fold, e.g. CaseRFC1459.Fold or Bot.Fold.
+func NewFoldMap[V any](fold func(string) string) *FoldMap[V] {
+	return &FoldMap[V]{fold: fold, m: make(map[string]foldEntry[V])}
+}
+
+// Get returns the value for key.
+func (fm *FoldMap[V]) Get(key string) (V, bool) {
+	e, ok := fm.m[fm.fold(key)]
+	return e.value, ok
+}
+
+// Set sets the value for key.
+func (fm *FoldMap[V]) Set(key string, value V) {
+	k := fm.fold(key)
+	if e, ok := fm.m[k]; ok {
+		key = e.key
+	}
+	fm.m[k] = foldEntry[V]{key: key, value: value}
+}
+
+// Delete removes key.
+func (fm *FoldMap[V]) Delete(key string) {
+	delete(fm.m, fm.fold(key))
+}
+
+// Len returns the number of keys.
+func (fm *FoldMap[V]) Len() int {
+	return len(fm.m)
+}
+
+// Range calls f for each key and value until f returns false.
+func (fm *FoldMap[V]) Range(f func(key string, value V) bool) {
+	for _, e := range fm.m {
+		if !f(e.key, e.value) {
+			return
+		}
+	}
+}
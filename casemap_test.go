@@ -0,0 +1,53 @@
+package flockerbot
+
+import (
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestCaseMapping(t *testing.T) {
+	for _, tc := range []struct {
+		cm       CaseMapping
+		in, want string
+	}{
+		{CaseASCII, "Nick[]\\^", "nick[]\\^"},
+		{CaseRFC1459, "Nick[]\\^", "nick{}|~"},
+		{CaseStrictRFC1459, "Nick[]\\^", "nick{}|^"},
+		{CaseRFC7613, "ÄＡb", "äab"},
+	} {
+		if got := tc.cm.Fold(tc.in); got != tc.want {
+			t.Errorf("%s.Fold(%q): got %q, want %q", tc.cm, tc.in, got, tc.want)
+		}
+	}
+	b := testBot("Flocker[1]")
+	if !b.EqualFold("flocker{1}", "FLOCKER[1]") {
+		t.Error("rfc1459 is not the default")
+	}
+	b.track(irc.ParseMessage(":irc.example 005 Flocker[1] CASEMAPPING=ascii :are supported by this server"), nil)
+	if b.EqualFold("flocker{1}", "FLOCKER[1]") || b.ISupport().CaseMapping() != CaseASCII {
+		t.Error("CASEMAPPING not applied")
+	}
+	if to := b.ReplyTo(irc.ParseMessage(":alice!a@h PRIVMSG FLOCKER[1] :hi")); to != "alice" {
+		t.Errorf("ReplyTo: got %q, want alice", to)
+	}
+}
+
+func TestFoldMap(t *testing.T) {
+	m := NewFoldMap[int](CaseRFC1459.Fold)
+	m.Set("Alice[m]", 1)
+	m.Set("alice{M}", 2)
+	if v, ok := m.Get("ALICE[M]"); !ok || v != 2 || m.Len() != 1 {
+		t.Errorf("Unexpected value %d %v", v, ok)
+	}
+	m.Range(func(key string, value int) bool {
+		if key != "Alice[m]" {
+			t.Errorf("Key not kept: %q", key)
+		}
+		return true
+	})
+	m.Delete("alice[m]")
+	if m.Len() != 0 {
+		t.Error("Key not deleted")
+	}
+}
@@ -0,0 +1,125 @@
+package flockerbot
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// DialError is returned if the connection to the server (or proxy) could not be established.
+type DialError struct {
+	Address string // Address we tried to connect to.
+	Err     error  // Underlying error.
+}
+
+func (e *DialError) Error() string { return "Bot: Dial " + e.Address + ": " + e.Err.Error() }
+func (e *DialError) Unwrap() error { return e.Err }
+
+// TLSError is returned if the TLS handshake or the STARTTLS upgrade failed.
+type TLSError struct {
+	Err error // Underlying error.
+}
+
+func (e *TLSError) Error() string { return "Bot: TLS: " + e.Err.Error() }
+func (e *TLSError) Unwrap() error { return e.Err }
+
+// RegistrationError is returned if the server rejected the registration with a numeric.
+type RegistrationError struct {
+	Numeric string // The numeric reply, e.g. "432" or "464".
+	Message string // Text of the reply.
+}
+
+func (e *RegistrationError) Error() string {
+	return "Bot: Registration failed: " + e.Numeric + " " + e.Message
+}
+
+// BannedError is returned if the server refused us because of a ban (465, or a K/G/Z-line on ERROR).
+type BannedError struct {
+	Numeric string // "465", or empty if detected from an ERROR line.
+	Message string // Text of the reply.
+}
+
+func (e *BannedError) Error() string { return "Bot: Banned: " + e.Message }
+
+// KilledError is returned if the connection was killed by an operator or server.
+type KilledError struct {
+	By     string // Who issued the KILL.
+	Reason string // Reason given.
+}
+
+func (e *KilledError) Error() string { return "Bot: Killed by " + e.By + ": " + e.Reason }
+
+// ServerError is returned if the server closed the connection with ERROR.
+type ServerError struct {
+	Message string // Text of the ERROR line.
+}
+
+func (e *ServerError) Error() string { return "Bot: Server error: " + e.Message }
+
+// TimeoutError is returned if the server did not respond within Timeout, or the lag exceeded MaxLag.
+// It matches ErrTimeout, respectively ErrLag, with errors.Is.
+type TimeoutError struct {
+	Lag     bool          // True if caused by MaxLag instead of Timeout.
+	Elapsed time.Duration // Silence, respectively lag, at the time of the timeout.
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Lag {
+		return ErrLag.Error() + " (" + e.Elapsed.String() + ")"
+	}
+	return ErrTimeout.Error() + " (" + e.Elapsed.String() + ")"
+}
+
+// Is makes TimeoutError match the ErrTimeout and ErrLag sentinels.
+func (e *TimeoutError) Is(target error) bool {
+	if e.Lag {
+		return target == ErrLag
+	}
+	return target == ErrTimeout
+}
+
+// ReconnectPolicy decides after a failed or closed connection whether StayConnected should
+// reconnect, and how long to wait before. Attempt counts the connection attempts since the last
+// successful registration, starting at 1.
+type ReconnectPolicy func(err error, attempt int) (retry bool, delay time.Duration)
+
+// DefaultReconnectPolicy does not retry if we are banned or the registration or connection setup
+// failed, and otherwise reconnects with a linear backoff of up to five minutes.
+func DefaultReconnectPolicy(err error, attempt int) (bool, time.Duration) {
+	var (
+		banned       *BannedError
+		registration *RegistrationError
+		dial         *DialError
+		tlsErr       *TLSError
+	)
+	if errors.As(err, &banned) || errors.As(err, &registration) || errors.As(err, &dial) || errors.As(err, &tlsErr) {
+		return false, 0
+	}
+	delay := time.Duration(attempt-1) * 5 * time.Second
+	if delay > 5*time.Minute {
+		delay = 5 * time.Minute
+	}
+	return true, delay
+}
+
+// registrationError returns the error for a fatal numeric received before registration completed, or nil.
+func registrationError(numeric, text string) error {
+	switch numeric {
+	case "465", "466": // ERR_YOUREBANNEDCREEP, ERR_YOUWILLBEBANNED
+		return &BannedError{Numeric: numeric, Message: text}
+	case "432", "436", "462", "464", "468": // erroneous nick, collision, already registered, bad password, invalid username
+		return &RegistrationError{Numeric: numeric, Message: text}
+	}
+	return nil
+}
+
+// serverError returns the error for an ERROR line. Bans show up in the text, e.g. "Closing Link: ... (K-Lined)".
+func serverError(text string) error {
+	lower := strings.ToLower(text)
+	for _, ban := range []string{"k-lined", "g-lined", "z-lined", "d-lined", "banned"} {
+		if strings.Contains(lower, ban) {
+			return &BannedError{Message: text}
+		}
+	}
+	return &ServerError{Message: text}
+}
@@ -0,0 +1,46 @@
+package flockerbot
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestErrorTypes(t *testing.T) {
+	var banned *BannedError
+	if !errors.As(serverError("Closing Link: 127.0.0.1 (K-Lined: spam)"), &banned) {
+		t.Error("K-line not detected as ban")
+	}
+	var server *ServerError
+	if !errors.As(serverError("Closing Link: 127.0.0.1 (Ping timeout)"), &server) {
+		t.Error("Expected ServerError")
+	}
+	var registration *RegistrationError
+	if err := registrationError("432", "Erroneous Nickname"); !errors.As(err, &registration) || registration.Numeric != "432" {
+		t.Errorf("Expected RegistrationError, got %v", err)
+	}
+	if err := registrationError("465", "You are banned"); !errors.As(err, &banned) {
+		t.Errorf("Expected BannedError, got %v", err)
+	}
+	if registrationError("372", "motd") != nil {
+		t.Error("Non-fatal numeric treated as error")
+	}
+	if !errors.Is(&TimeoutError{}, ErrTimeout) || errors.Is(&TimeoutError{}, ErrLag) || !errors.Is(&TimeoutError{Lag: true}, ErrLag) {
+		t.Error("TimeoutError does not match sentinels")
+	}
+	if !errors.Is(&DialError{Address: "x", Err: io.EOF}, io.EOF) {
+		t.Error("DialError does not unwrap")
+	}
+}
+
+func TestDefaultReconnectPolicy(t *testing.T) {
+	if retry, _ := DefaultReconnectPolicy(&BannedError{Numeric: "465"}, 1); retry {
+		t.Error("Retry when banned")
+	}
+	if retry, delay := DefaultReconnectPolicy(&TimeoutError{}, 1); !retry || delay != 0 {
+		t.Error("First reconnect after timeout must be immediate")
+	}
+	if retry, delay := DefaultReconnectPolicy(&KilledError{}, 1000); !retry || delay.Minutes() != 5 {
+		t.Errorf("Expected capped backoff, got %s", delay)
+	}
+}
@@ -0,0 +1,232 @@
+package flockerbot
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// EventBuffer is the channel buffer size of subscriptions. Events that do not fit are dropped.
+var EventBuffer = 128
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventMessage is a message from the server, as passed to Handler. Messages of chat history
+	// batches are not delivered: they are returned by the History methods, or as EventHistory.
+	EventMessage EventType = iota
+	// EventConnected signals that registration completed (001). Message is the 001 reply.
+	EventConnected
+	// EventDisconnected signals that the connection was closed. Err is the reason.
+	EventDisconnected
+	// EventError signals an error connecting to the server. Err is the error.
+	EventError
+	// EventAway signals that a user went away or came back. User has the new state.
+	EventAway
+	// EventHostChange signals a new ident or host of a user (chghost). User has the new values.
+	EventHostChange
+	// EventRealnameChange signals a new realname of a user (setname). User has the new value.
+	EventRealnameChange
+	// EventInvite signals an invite, to us or, with invite-notify, to another user. User is the
+	// inviter, Target the invited nick and Channel the channel.
+	EventInvite
+	// EventOnline signals that a nick on the presence list (Bot.Monitor) came online. User has
+	// the nick, and ident and host if the server told them.
+	EventOnline
+	// EventOffline signals that a nick on the presence list went offline.
+	EventOffline
+	// EventHistory delivers a message missed while disconnected, fetched by CatchUp. Channel is
+	// the channel and Time the server time of the message.
+	EventHistory
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventMessage:
+		return "message"
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventError:
+		return "error"
+	case EventAway:
+		return "away"
+	case EventHostChange:
+		return "host change"
+	case EventRealnameChange:
+		return "realname change"
+	case EventInvite:
+		return "invite"
+	case EventOnline:
+		return "online"
+	case EventOffline:
+		return "offline"
+	case EventHistory:
+		return "history"
+	}
+	return "unknown"
+}
+
+// Event is delivered to subscriptions.
+type Event struct {
+	Type    EventType         // Kind of event.
+	Message *irc.Message      // Message for EventMessage, EventConnected and EventHistory.
+	Tags    map[string]string // IRCv3 message tags of Message, if any.
+	Err     error             // Error for EventDisconnected and EventError.
+	User    User              // User for EventAway, EventHostChange, EventRealnameChange, EventInvite, EventOnline and EventOffline.
+	Channel string            // Channel for EventInvite and EventHistory.
+	Shared  []string          // Channels the sender was in, for QUIT and NICK EventMessages.
+	Target  string            // Invited nick for EventInvite.
+	Time    time.Time         // When the event occurred.
+
+	history bool // True for messages of a chat history batch, only delivered to batch requests.
+}
+
+// Subscription delivers events matching its filter on C until it is cancelled.
+type Subscription struct {
+	C <-chan Event // Events. Closed on Cancel.
+
+	c       chan Event
+	filter  func(Event) bool
+	history bool // Receives the messages of chat history batches.
+	bot     *Bot
+	once    sync.Once
+	dropped atomic.Uint64
+}
+
+// Subscribe returns a subscription for all events for which filter returns true. A nil filter
+// matches all events. Events are never blocking the bot: if the subscriber does not keep up
+// and the buffer is full, events are dropped. Call Cancel when done.
+func (b *Bot) Subscribe(filter func(Event) bool) *Subscription {
+	return b.subscribe(filter, false)
+}
+
+// subscribe is Subscribe, also receiving the messages of chat history batches if history is true.
+func (b *Bot) subscribe(filter func(Event) bool, history bool) *Subscription {
+	c := make(chan Event, EventBuffer)
+	s := &Subscription{
+		C:       c,
+		c:       c,
+		filter:  filter,
+		history: history,
+		bot:     b,
+	}
+	b.subMutex.Lock()
+	defer b.subMutex.Unlock()
+	b.subscriptions = append(b.subscriptions, s)
+	return s
+}
+
+// Events returns a channel receiving all events of the bot. All calls return the same channel.
+func (b *Bot) Events() <-chan Event {
+	b.subMutex.Lock()
+	s := b.events
+	b.subMutex.Unlock()
+	if s == nil {
+		s = b.Subscribe(nil)
+		b.subMutex.Lock()
+		if b.events == nil {
+			b.events = s
+		} else {
+			defer s.Cancel()
+			s = b.events
+		}
+		b.subMutex.Unlock()
+	}
+	return s.C
+}
+
+// Cancel ends the subscription and closes C.
+func (s *Subscription) Cancel() {
+	s.once.Do(func() {
+		b := s.bot
+		b.subMutex.Lock()
+		defer b.subMutex.Unlock()
+		for i, x := range b.subscriptions {
+			if x == s {
+				b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+				break
+			}
+		}
+		close(s.c)
+	})
+}
+
+// Dropped returns the number of events dropped because C was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// lifecycleHook is a function registered with onLifecycle.
+type lifecycleHook struct {
+	f func(Event)
+}
+
+// onLifecycle registers f to be called with EventConnected and EventDisconnected, directly by
+// emit before the subscribers get them. Unlike subscriptions, hooks never miss an event. Call
+// the returned function to remove f.
+func (b *Bot) onLifecycle(f func(Event)) (remove func()) {
+	h := &lifecycleHook{f}
+	b.subMutex.Lock()
+	b.lifecycle = append(b.lifecycle, h)
+	b.subMutex.Unlock()
+	return func() {
+		b.subMutex.Lock()
+		defer b.subMutex.Unlock()
+		hooks := make([]*lifecycleHook, 0, len(b.lifecycle))
+		for _, x := range b.lifecycle {
+			if x != h {
+				hooks = append(hooks, x)
+			}
+		}
+		b.lifecycle = hooks
+	}
+}
+
+// emit calls the lifecycle hooks for ev, then delivers it to all matching subscriptions without
+// blocking.
+func (b *Bot) emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if ev.Type == EventConnected || ev.Type == EventDisconnected {
+		b.subMutex.Lock()
+		hooks := b.lifecycle
+		b.subMutex.Unlock()
+		for _, h := range hooks {
+			h.f(ev)
+		}
+	}
+	b.subMutex.Lock()
+	defer b.subMutex.Unlock()
+	for _, s := range b.subscriptions {
+		if ev.history && !s.history || s.filter != nil && !s.filter(ev) {
+			continue
+		}
+		select {
+		case s.c <- ev:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// FilterCommand returns a filter for Subscribe that matches live message events with one of commands.
+func FilterCommand(commands ...string) func(Event) bool {
+	return func(ev Event) bool {
+		if ev.Type != EventMessage || ev.Message == nil {
+			return false
+		}
+		for _, c := range commands {
+			if ev.Message.Command == c {
+				return true
+			}
+		}
+		return false
+	}
+}
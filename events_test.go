@@ -0,0 +1,36 @@
+package flockerbot
+
+import (
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestSubscribe(t *testing.T) {
+	b := new(Bot)
+	all := b.Events()
+	if b.Events() != all {
+		t.Error("Events must return the same channel")
+	}
+	sub := b.Subscribe(FilterCommand("PRIVMSG"))
+	b.emit(Event{Type: EventMessage, Message: irc.ParseMessage(":a!b@c NOTICE x :y")})
+	b.emit(Event{Type: EventMessage, Message: irc.ParseMessage(":a!b@c PRIVMSG x :y")})
+	if ev := <-sub.C; ev.Message.Command != "PRIVMSG" || ev.Time.IsZero() {
+		t.Errorf("Unexpected event %v", ev)
+	}
+	if len(all) != 2 {
+		t.Errorf("Expected 2 events on Events(), got %d", len(all))
+	}
+	sub.Cancel()
+	sub.Cancel()
+	if _, ok := <-sub.C; ok {
+		t.Error("Channel not closed by Cancel")
+	}
+	b.emit(Event{Type: EventError})
+	for i := 0; i < EventBuffer; i++ {
+		b.emit(Event{Type: EventError})
+	}
+	if b.events.Dropped() != 3 {
+		t.Errorf("Expected 3 dropped events, got %d", b.events.Dropped())
+	}
+}
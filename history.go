@@ -0,0 +1,211 @@
+package flockerbot
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+var (
+	// ErrNoHistory signals that the server does not offer draft/chathistory
+	ErrNoHistory = errors.New("Bot: Chat history not supported")
+)
+
+// defaultHistoryLimit is the number of messages requested if no limit is given and the server
+// does not announce one.
+const defaultHistoryLimit = 100
+
+// HistoryMessage is a message from the chat history.
+type HistoryMessage struct {
+	Message *irc.Message      // The message, usually PRIVMSG or NOTICE.
+	Tags    map[string]string // Its tags.
+	MsgID   string            // Message ID, if any.
+	Time    time.Time         // Server time, zero if unknown.
+}
+
+// HistoryTarget is a conversation returned by HistoryTargets.
+type HistoryTarget struct {
+	Name   string    // Channel or nick.
+	Latest time.Time // Time of the latest message.
+}
+
+// HistoryMsgID returns a history reference to the message with ID id.
+func HistoryMsgID(id string) string {
+	return "msgid=" + id
+}
+
+// HistoryTime returns a history reference to time t.
+func HistoryTime(t time.Time) string {
+	return "timestamp=" + t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// HistoryLatest returns up to limit of the latest messages of target, after ref if it is not "*".
+// A limit of 0 uses the server's maximum.
+func (b *Bot) HistoryLatest(ctx context.Context, target, ref string, limit int) ([]HistoryMessage, error) {
+	return b.history(ctx, "LATEST", target, ref, "", limit)
+}
+
+// HistoryBefore returns up to limit messages of target before ref.
+func (b *Bot) HistoryBefore(ctx context.Context, target, ref string, limit int) ([]HistoryMessage, error) {
+	return b.history(ctx, "BEFORE", target, ref, "", limit)
+}
+
+// HistoryAfter returns up to limit messages of target after ref.
+func (b *Bot) HistoryAfter(ctx context.Context, target, ref string, limit int) ([]HistoryMessage, error) {
+	return b.history(ctx, "AFTER", target, ref, "", limit)
+}
+
+// HistoryAround returns up to limit messages of target around ref.
+func (b *Bot) HistoryAround(ctx context.Context, target, ref string, limit int) ([]HistoryMessage, error) {
+	return b.history(ctx, "AROUND", target, ref, "", limit)
+}
+
+// HistoryBetween returns up to limit messages of target between the references from and to.
+func (b *Bot) HistoryBetween(ctx context.Context, target, from, to string, limit int) ([]HistoryMessage, error) {
+	return b.history(ctx, "BETWEEN", target, from, to, limit)
+}
+
+// HistoryTargets returns up to limit conversations with messages between from and to.
+func (b *Bot) HistoryTargets(ctx context.Context, from, to time.Time, limit int) ([]HistoryTarget, error) {
+	msgs, err := b.chatHistory(ctx, "TARGETS "+HistoryTime(from)+" "+HistoryTime(to)+" "+strconv.Itoa(b.historyLimit(limit)))
+	if err != nil {
+		return nil, err
+	}
+	var targets []HistoryTarget
+	for _, m := range msgs {
+		// CHATHISTORY TARGETS target timestamp
+		p := params(m.Message)
+		if m.Message.Command != "CHATHISTORY" || len(p) < 3 {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339Nano, strings.TrimPrefix(p[2], "timestamp="))
+		targets = append(targets, HistoryTarget{Name: p[1], Latest: t})
+	}
+	return targets, nil
+}
+
+// history runs a CHATHISTORY subcommand for target.
+func (b *Bot) history(ctx context.Context, sub, target, ref, ref2 string, limit int) ([]HistoryMessage, error) {
+	args := sub + " " + target + " " + ref
+	if ref2 != "" {
+		args += " " + ref2
+	}
+	return b.chatHistory(ctx, args+" "+strconv.Itoa(b.historyLimit(limit)))
+}
+
+// historyLimit returns limit, or the server's maximum if it is 0.
+func (b *Bot) historyLimit(limit int) int {
+	if limit > 0 {
+		return limit
+	}
+	if n, _ := strconv.Atoi(b.ISupport().get("CHATHISTORY", "")); n > 0 {
+		return n
+	}
+	return defaultHistoryLimit
+}
+
+// chatHistory sends CHATHISTORY args and collects the messages of the batch answering it.
+func (b *Bot) chatHistory(ctx context.Context, args string) ([]HistoryMessage, error) {
+	if !b.HasCap("draft/chathistory") {
+		return nil, ErrNoHistory
+	}
+	events, err := b.requestBatch(ctx, "CHATHISTORY "+args, isHistoryBatch)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]HistoryMessage, 0, len(events))
+	for _, ev := range events {
+		msgs = append(msgs, HistoryMessage{Message: ev.Message, Tags: ev.Tags, MsgID: ev.Tags["msgid"], Time: serverTime(ev.Tags)})
+	}
+	return msgs, nil
+}
+
+// isHistoryBatch returns true for the batch types of CHATHISTORY replies.
+func isHistoryBatch(typ string) bool {
+	switch typ {
+	case "chathistory", "draft/chathistory-targets":
+		return true
+	}
+	return false
+}
+
+// inHistoryBatch tracks the open batches and returns true if msg belongs to a chat history
+// batch. Such messages are only delivered to subscribers, marked as History, not tracked or passed
+// to the Handler.
+func (b *Bot) inHistoryBatch(msg *irc.Message, tags map[string]string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	p := params(msg)
+	if msg.Command == "BATCH" && len(p) > 0 && len(p[0]) > 1 {
+		ref := p[0][1:]
+		switch p[0][0] {
+		case '+':
+			if len(p) > 1 {
+				b.batches[ref] = p[1]
+			}
+		case '-':
+			delete(b.batches, ref)
+		}
+	}
+	return tags["batch"] != "" && isHistoryBatch(b.batches[tags["batch"]])
+}
+
+// handleHistory records the latest channel messages and catches up on rejoined channels, for CatchUp.
+func (b *Bot) handleHistory(msg *irc.Message, tags map[string]string) {
+	if msg.Command == "JOIN" && msg.Prefix != nil && b.isMe(msg.Prefix.Name) && len(msg.Params) > 0 {
+		go b.catchUp(msg.Params[0])
+	}
+	b.seen(msg, tags)
+}
+
+// seen records the reference of the latest channel message for CatchUp.
+func (b *Bot) seen(msg *irc.Message, tags map[string]string) {
+	if (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") || len(msg.Params) == 0 {
+		return
+	}
+	if !b.ISupport().IsChannel(msg.Params[0]) {
+		return
+	}
+	ref := ""
+	if id := tags["msgid"]; id != "" {
+		ref = HistoryMsgID(id)
+	} else if t := serverTime(tags); !t.IsZero() {
+		ref = HistoryTime(t)
+	} else {
+		return
+	}
+	key := b.Fold(msg.Params[0])
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.lastSeen == nil {
+		b.lastSeen = make(map[string]string)
+	}
+	b.lastSeen[key] = ref
+}
+
+// catchUp fetches the messages of channel missed since the last one seen, and delivers them as
+// EventHistory. Called when we rejoin a channel with CatchUp set.
+func (b *Bot) catchUp(channel string) {
+	key := b.Fold(channel)
+	b.mutex.RLock()
+	ref := b.lastSeen[key]
+	b.mutex.RUnlock()
+	if ref == "" || !b.HasCap("draft/chathistory") {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	msgs, err := b.HistoryAfter(ctx, channel, ref, 0)
+	if err != nil {
+		b.logError("chat history catch-up failed", err, "channel", channel)
+		return
+	}
+	for _, m := range msgs {
+		b.seen(m.Message, m.Tags)
+		b.emit(Event{Type: EventHistory, Message: m.Message, Tags: m.Tags, Channel: channel, Time: m.Time})
+	}
+}
@@ -0,0 +1,113 @@
+package flockerbot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// feed passes lines through the batch tracking and dispatch like the read loop.
+func feed(b *Bot, lines ...string) {
+	for _, l := range lines {
+		tags, line := parseTags(l)
+		msg := irc.ParseMessage(line)
+		if b.inHistoryBatch(msg, tags) {
+			b.emit(Event{Type: EventMessage, Message: msg, Tags: tags, history: true})
+			continue
+		}
+		b.track(msg, tags)
+		b.handleHistory(msg, tags)
+		b.dispatchTags(msg, tags)
+	}
+}
+
+func TestChatHistory(t *testing.T) {
+	b := testBot("flocker")
+	if _, err := b.HistoryLatest(context.Background(), "#flocker", "*", 10); err != ErrNoHistory {
+		t.Errorf("Expected ErrNoHistory, got %v", err)
+	}
+	b.capsEnabled["draft/chathistory"] = true
+	feed(b, ":irc.example 005 flocker CHATHISTORY=50 :are supported by this server")
+	done := make(chan []HistoryMessage)
+	go func() {
+		msgs, err := b.HistoryBefore(context.Background(), "#flocker", HistoryTime(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)), 0)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- msgs
+	}()
+	if l := nextLine(t, b); l != "CHATHISTORY BEFORE #flocker timestamp=2024-01-01T12:00:00.000Z 50" {
+		t.Errorf("Unexpected request %q", l)
+	}
+	handled := make(chan *irc.Message, 10)
+	b.Handler = func(msg *irc.Message) { handled <- msg }
+	feed(b,
+		":irc.example BATCH +h1 chathistory #flocker",
+		"@batch=h1;msgid=a;time=2024-01-01T11:00:00.000Z :alice!a@h PRIVMSG #flocker :!op",
+		"@batch=h1;msgid=b;time=2024-01-01T11:01:00.000Z :bob!b@h PRIVMSG #flocker :hi",
+		":irc.example BATCH -h1",
+	)
+	msgs := <-done
+	if len(msgs) != 2 || msgs[0].MsgID != "a" || msgs[1].Message.Trailing != "hi" || msgs[1].Time.Minute() != 1 {
+		t.Errorf("Unexpected messages %v", msgs)
+	}
+	for i := 0; i < 2; i++ {
+		if m := <-handled; m.Command != "BATCH" {
+			t.Errorf("History message passed to the handler: %v", m)
+		}
+	}
+
+	go func() {
+		_, err := b.HistoryLatest(context.Background(), "#secret", "*", 10)
+		if _, ok := err.(*RejectedError); !ok {
+			t.Errorf("Expected rejection, got %v", err)
+		}
+		done <- nil
+	}()
+	nextLine(t, b)
+	feed(b, ":irc.example FAIL CHATHISTORY INVALID_TARGET LATEST #secret :No such channel")
+	<-done
+}
+
+func TestCatchUp(t *testing.T) {
+	b := testBot("flocker")
+	b.CatchUp = true
+	b.capsEnabled["draft/chathistory"] = true
+	sub := b.Subscribe(func(ev Event) bool { return ev.Type == EventHistory || ev.Tags["batch"] != "" })
+	defer sub.Cancel()
+	feed(b,
+		":flocker!f@h JOIN #flocker",
+		"@msgid=x1;time=2024-01-01T10:00:00.000Z :alice!a@h PRIVMSG #Flocker :before the split",
+	)
+	nextLine(t, b) // MODE
+	b.resetState()
+	b.capsEnabled["draft/chathistory"] = true
+	feed(b, ":flocker!f@h JOIN #flocker")
+	if l := nextLine(t, b); l != "MODE #flocker" {
+		t.Errorf("Unexpected line %q", l)
+	}
+	if l := nextLine(t, b); l != "CHATHISTORY AFTER #flocker msgid=x1 100" {
+		t.Errorf("Unexpected request %q", l)
+	}
+	feed(b,
+		":irc.example BATCH +h2 chathistory #flocker",
+		"@batch=h2;msgid=x2;time=2024-01-01T10:05:00.000Z :bob!b@h PRIVMSG #flocker :missed",
+		":irc.example BATCH -h2",
+	)
+	select {
+	case ev := <-sub.C:
+		if ev.Message.Trailing != "missed" || ev.Channel != "#flocker" || ev.Time.Minute() != 5 {
+			t.Errorf("Unexpected event %v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No history event")
+	}
+	// Each missed message is delivered once, not also as EventMessage.
+	select {
+	case ev := <-sub.C:
+		t.Errorf("History message delivered twice: %v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
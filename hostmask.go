@@ -0,0 +1,50 @@
+package flockerbot
+
+import (
+	"github.com/sorcix/irc"
+)
+
+// MatchMask returns true if hostmask (nick!user@host) matches the glob mask, in which * matches
+// any number of characters and ? exactly one. Both are folded with cm.
+func MatchMask(mask, hostmask string, cm CaseMapping) bool {
+	return matchGlob(cm.Fold(mask), cm.Fold(hostmask))
+}
+
+// MatchMask matches hostmask against mask with the case mapping of the server.
+func (b *Bot) MatchMask(mask, hostmask string) bool {
+	return MatchMask(mask, hostmask, b.ISupport().CaseMapping())
+}
+
+// Hostmask returns prefix as nick!user@host.
+func Hostmask(prefix *irc.Prefix) string {
+	if prefix == nil {
+		return ""
+	}
+	return prefix.Name + "!" + prefix.User + "@" + prefix.Host
+}
+
+// matchGlob matches s against pattern with * and ?. It backtracks only to the last *, so it
+// runs in linear time for typical masks.
+func matchGlob(pattern, s string) bool {
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star >= 0:
+			mark++
+			p, i = star+1, mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
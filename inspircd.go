@@ -0,0 +1,263 @@
+package flockerbot
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// InspIRCd implements the spanningtree protocol of InspIRCd. Protocol is 1205 for InspIRCd 3 and
+// 1206 for InspIRCd 4, the default.
+type InspIRCd struct {
+	Protocol int
+}
+
+func (i InspIRCd) version() int {
+	if i.Protocol == 0 {
+		return 1206
+	}
+	return i.Protocol
+}
+
+func (i InspIRCd) register(b *Bot) {
+	b.SendString("CAPAB START " + strconv.Itoa(i.version()))
+	b.SendString("CAPAB CAPABILITIES :CASEMAPPING=ascii")
+	b.SendString("CAPAB END")
+	if i.version() < 1206 {
+		b.SendString("SERVER " + b.User + " " + b.Password + " 0 " + b.SID + " :" + b.serverDesc())
+	} else {
+		b.SendString("SERVER " + b.User + " " + b.Password + " " + b.SID + " :" + b.serverDesc())
+	}
+}
+
+// burst sends our burst, enclosed in BURST and ENDBURST.
+func (InspIRCd) burst(b *Bot) {
+	b.SendAsServer("BURST " + strconv.FormatInt(now(), 10))
+	b.burstPseudoClients()
+	b.SendAsServer("ENDBURST")
+}
+
+func (i InspIRCd) introduce(b *Bot, pc *PseudoClient) {
+	ts := strconv.FormatInt(pc.timestamp(), 10)
+	user := pc.User
+	if i.version() >= 1206 {
+		// Real and displayed ident.
+		user += " " + pc.User
+	}
+	b.SendAsServer("UID " + pc.uid + " " + ts + " " + pc.Nick + " " + pc.Host + " " + pc.Host + " " + user + " 0.0.0.0 " + ts + " " + pc.Modes + " :" + pc.Realname)
+}
+
+func (InspIRCd) join(b *Bot, pc *PseudoClient, channel string, ts int64) {
+	b.SendAsServer("FJOIN " + channel + " " + strconv.FormatInt(ts, 10) + " + :," + pc.uid)
+}
+
+func (InspIRCd) mode(b *Bot, pc *PseudoClient, channel string, ts int64, modes string, args []string) {
+	pc.Send(strings.TrimSpace("FMODE " + channel + " " + strconv.FormatInt(ts, 10) + " " + modes + " " + strings.Join(args, " ")))
+}
+
+func (InspIRCd) ping(b *Bot) {
+	b.SendAsServer("PING " + b.uplinkSID())
+}
+
+func (InspIRCd) caseMapping() CaseMapping {
+	return CaseASCII
+}
+
+func (InspIRCd) chanModes() []string {
+	// Replaced by those announced with CAPAB CHANMODES.
+	return []string{"CHANMODES=IXbeg,k,FHJLfjl,ACKMNOPQRSTUcimnprstz", "PREFIX=(qaohv)~&@%+"}
+}
+
+func (i InspIRCd) handle(b *Bot, msg *irc.Message) (bool, error) {
+	ls := b.Link()
+	source := ""
+	if msg.Prefix != nil {
+		source = msg.Prefix.Name
+	}
+	p := params(msg)
+	arg := func(i int) string {
+		if i < len(p) {
+			return p[i]
+		}
+		return ""
+	}
+	if b.handleLinkCommon(msg, p) {
+		return true, nil
+	}
+	switch msg.Command {
+	case "CAPAB":
+		switch arg(0) {
+		case "START":
+			if v, _ := strconv.Atoi(arg(1)); v < 1205 {
+				return false, ErrLinkProtocol
+			}
+		case "CHANMODES":
+			ls.modes.parse(inspChanModes(arg(1)))
+		}
+	case "SERVER":
+		if source != "" {
+			// InspIRCd 4 introduces servers behind the uplink with SERVER: name sid :desc
+			ls.addServer(&LinkServer{SID: arg(1), Name: arg(0), Description: p[len(p)-1], Uplink: source})
+			break
+		}
+		// name password [hops] sid :desc
+		if b.AcceptPassword != "" && arg(1) != b.AcceptPassword {
+			return false, ErrLinkPassword
+		}
+		sid := arg(2)
+		if len(p) > 4 {
+			sid = arg(3)
+		}
+		b.setRemoteSID(sid)
+		ls.addServer(&LinkServer{SID: sid, Name: arg(0), Description: p[len(p)-1]})
+		i.burst(b)
+	case "SID":
+		// name hops sid :desc
+		ls.addServer(&LinkServer{SID: arg(2), Name: arg(0), Description: arg(3), Uplink: source})
+	case "BURST":
+	case "ENDBURST":
+		if source == b.uplinkSID() && !b.Connected() {
+			b.linkEstablished(msg)
+		}
+	case "UID":
+		// uuid nickts nick realhost host [realuser] user ip signon modes [mode args] :gecos
+		if len(p) < 10 {
+			break
+		}
+		ts, _ := strconv.ParseInt(arg(1), 10, 64)
+		u := &LinkUser{UID: arg(0), TS: ts, Nick: arg(2), RealHost: arg(3), Host: arg(4), Realname: p[len(p)-1], Server: source}
+		rest := p[5:]
+		if i.version() >= 1206 {
+			rest = rest[1:]
+		}
+		u.User, u.IP, u.Modes = rest[0], rest[1], rest[3]
+		ls.addUser(u)
+	case "FJOIN":
+		// channel ts modes [mode args] :[status],uuid[:membid] ...
+		if len(p) < 4 {
+			break
+		}
+		ts, _ := strconv.ParseInt(arg(1), 10, 64)
+		channel := arg(0)
+		ls.joinChannel(channel, ts, "", "")
+		ls.updateChannel(channel, func(c *LinkChannel) {
+			if ts <= c.TS {
+				applyModes(c, ls.modes, arg(2), p[3:len(p)-1])
+			}
+		})
+		for _, member := range strings.Fields(p[len(p)-1]) {
+			modes, uid, _ := strings.Cut(member, ",")
+			uid, _, _ = strings.Cut(uid, ":")
+			ls.joinChannel(channel, ts, uid, ls.statusPrefixes(modes))
+		}
+	case "IJOIN":
+		// channel membid [ts status]
+		ts, _ := strconv.ParseInt(arg(2), 10, 64)
+		ls.joinChannel(arg(0), ts, source, ls.statusPrefixes(arg(3)))
+		return true, nil
+	case "FMODE":
+		ts, _ := strconv.ParseInt(arg(1), 10, 64)
+		ls.updateChannel(arg(0), func(c *LinkChannel) {
+			if ts <= c.TS && len(p) > 2 {
+				applyModes(c, ls.modes, arg(2), p[3:])
+			}
+		})
+		return true, nil
+	case "MODE":
+		ls.updateUser(arg(0), func(u *LinkUser) {
+			u.Modes = mergeUserModes(u.Modes, arg(1))
+		})
+		return true, nil
+	case "FTOPIC":
+		// channel channelts topicts [setter] :topic
+		ls.updateChannel(arg(0), func(c *LinkChannel) {
+			c.Topic = p[len(p)-1]
+		})
+	case "TOPIC":
+		ls.updateChannel(arg(0), func(c *LinkChannel) {
+			c.Topic = arg(1)
+		})
+		return true, nil
+	case "METADATA":
+		// uuid key :value
+		if arg(1) == "accountname" {
+			ls.updateUser(arg(0), func(u *LinkUser) {
+				u.Account = arg(2)
+			})
+		}
+	case "FHOST":
+		ls.updateUser(source, func(u *LinkUser) {
+			u.Host = arg(0)
+		})
+		return true, nil
+	case "FIDENT":
+		ls.updateUser(source, func(u *LinkUser) {
+			u.User = arg(0)
+		})
+	case "FNAME":
+		ls.updateUser(source, func(u *LinkUser) {
+			u.Realname = arg(0)
+		})
+	case "PING":
+		// ":source PING target", answered with ":target PONG source"
+		b.SendAsServer("PONG " + source)
+	case "PONG":
+		if token := b.oldestPing(); token != "" {
+			b.handlePong(token)
+		}
+	default:
+		return true, nil
+	}
+	return false, nil
+}
+
+// inspChanModes converts the modes of CAPAB CHANMODES, like "list:ban=b param-set:limit=l
+// prefix:30000:op=@o simple:noextmsg=n", to CHANMODES and PREFIX tokens.
+func inspChanModes(modes string) []string {
+	var types [4]string
+	type prefix struct {
+		rank         int
+		mode, symbol byte
+	}
+	var prefixes []prefix
+	for _, m := range strings.Fields(modes) {
+		kind, rest, _ := strings.Cut(m, ":")
+		rank := ""
+		if kind == "prefix" {
+			rank, rest, _ = strings.Cut(rest, ":")
+		}
+		_, letters, _ := strings.Cut(rest, "=")
+		if letters == "" {
+			continue
+		}
+		switch kind {
+		case "list":
+			types[0] += letters
+		case "param":
+			types[1] += letters
+		case "param-set":
+			types[2] += letters
+		case "simple":
+			types[3] += letters
+		case "prefix":
+			// The prefix symbol followed by the mode letter, e.g. "@o".
+			if len(letters) == 2 {
+				r, _ := strconv.Atoi(rank)
+				prefixes = append(prefixes, prefix{r, letters[1], letters[0]})
+			}
+		}
+	}
+	sort.SliceStable(prefixes, func(i, j int) bool { return prefixes[i].rank > prefixes[j].rank })
+	tokens := []string{"CHANMODES=" + strings.Join(types[:], ",")}
+	if len(prefixes) > 0 {
+		status, symbols := "", ""
+		for _, p := range prefixes {
+			status += string(p.mode)
+			symbols += string(p.symbol)
+		}
+		tokens = append(tokens, "PREFIX=("+status+")"+symbols)
+	}
+	return tokens
+}
@@ -0,0 +1,93 @@
+package flockerbot
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestInspIRCdBurst(t *testing.T) {
+	for _, proto := range []int{1205, 1206} {
+		b := &Bot{IsServer: true, User: "flocker.example", SID: "42X", Password: "pw", AcceptPassword: "pw", LinkProtocol: InspIRCd{Protocol: proto}}
+		b.Setup()
+		b.socketChan = make(chan *channelString, 64)
+		b.linkRegister()
+		b.AddPseudoClient(&PseudoClient{Nick: "Helper"})
+		server := "SERVER irc.example pw 42A :Example server"
+		uid := ":42A UID 42AAAAAAA 1600000000 alice real.example cloak.example ~alice ~alice 10.0.0.1 1600000000 +ix :Alice"
+		uid2 := ":42A UID 42AAAAAAB 1600000000 bob bob.example bob.example ~bob ~bob 10.0.0.2 1600000000 +i :Bob"
+		if proto == 1205 {
+			server = "SERVER irc.example pw 0 42A :Example server"
+			uid = ":42A UID 42AAAAAAA 1600000000 alice real.example cloak.example ~alice 10.0.0.1 1600000000 +ix :Alice"
+			uid2 = ":42A UID 42AAAAAAB 1600000000 bob bob.example bob.example ~bob 10.0.0.2 1600000000 +i :Bob"
+		}
+		for _, l := range []string{
+			"CAPAB START " + strconv.Itoa(proto),
+			"CAPAB CHANMODES :list:ban=b param:key=k param-set:limit=l prefix:10000:voice=+v prefix:30000:op=@o prefix:40000:admin=&a prefix:50000:founder=~q prefix:100000:official=!Y simple:noextmsg=n simple:topiclock=t",
+			"CAPAB END",
+			server,
+			":42A BURST 1700000000",
+			uid,
+			uid2,
+			":42A METADATA 42AAAAAAA accountname :alice",
+			":42A FJOIN #flocker 1500000000 +ntk key :o,42AAAAAAA:1 ,42AAAAAAB:2",
+			":42A FTOPIC #flocker 1500000000 1500000001 alice :Welcome",
+			":42A ENDBURST",
+			":42AAAAAAA FMODE #flocker 1500000000 +v 42AAAAAAA",
+			":42AAAAAAA FMODE #flocker 1500000000 +qaoY 42AAAAAAB 42AAAAAAB 42AAAAAAB 42AAAAAAA",
+			":42A PING 42X",
+		} {
+			if err := b.handleLink(irc.ParseMessage(l)); err != nil {
+				t.Fatalf("%d handleLink(%s): %s", proto, l, err)
+			}
+		}
+		if !b.Connected() {
+			t.Errorf("%d: Link not established after ENDBURST", proto)
+		}
+		ls := b.Link()
+		if u, ok := ls.User("42AAAAAAA"); !ok || u.Account != "alice" || u.Host != "cloak.example" || u.User != "~alice" || u.Modes != "+ix" {
+			t.Errorf("%d: Unexpected user %v", proto, u)
+		}
+		c, ok := ls.Channel("#flocker")
+		if !ok || c.Modes != "+nt" || c.Topic != "Welcome" || c.Members["42AAAAAAA"] != "@+!" || c.Members["42AAAAAAB"] != "~&@" {
+			t.Errorf("%d: Unexpected channel %v", proto, c)
+		}
+		if modes, prefixes := ls.modes.Prefix(); modes != "Yqaov" || prefixes != "!~&@+" {
+			t.Errorf("%d: Unexpected prefixes from CAPAB: %s %s", proto, modes, prefixes)
+		}
+		lines := make([]string, 0)
+		for len(b.socketChan) > 0 {
+			lines = append(lines, (<-b.socketChan).Data)
+		}
+		if lines[0] != "CAPAB START "+strconv.Itoa(proto)+"\r\n" || lines[4][:11] != ":42X BURST " || lines[6] != ":42X ENDBURST\r\n" {
+			t.Errorf("%d: Unexpected handshake %q", proto, lines)
+		}
+		if lines[len(lines)-1] != ":42X PONG 42A\r\n" {
+			t.Errorf("%d: Unexpected pong %q", proto, lines[len(lines)-1])
+		}
+	}
+}
+
+func TestInspIRCdVersion(t *testing.T) {
+	b := &Bot{IsServer: true, User: "flocker.example", SID: "42X", LinkProtocol: InspIRCd{}}
+	b.Setup()
+	b.socketChan = make(chan *channelString, 8)
+	b.linkRegister()
+	if err := b.handleLink(irc.ParseMessage("CAPAB START 1202")); err != ErrLinkProtocol {
+		t.Errorf("Expected ErrLinkProtocol, got %v", err)
+	}
+}
+
+func TestInspIRCdFlood(t *testing.T) {
+	b := &Bot{IsServer: true, User: "flocker.example", SID: "42X", Password: "pw", LinkProtocol: InspIRCd{}}
+	addPseudoClients(t, b, 100)
+	testFlood(t, b, "42AAAAAAA", 500,
+		"CAPAB START 1206",
+		"CAPAB END",
+		"SERVER irc.example pw 42A :Example server",
+		":42A BURST 1700000000",
+		":42A UID 42AAAAAAA 1600000000 alice real.example cloak.example ~alice ~alice 10.0.0.1 1600000000 +ix :Alice",
+		":42A ENDBURST",
+	)
+}
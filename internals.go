@@ -1,10 +1,12 @@
 package flockerbot
 
 import (
+	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/JonathanLogan/flockerbot/fixbuffer"
+	"github.com/sorcix/irc"
 )
 
 // socketReader reads a string from a blocking io.Reader socket and sends it to channel c.
@@ -52,11 +54,7 @@ func (b *Bot) setNick() {
 
 // setUser sets the user
 func (b *Bot) setUser() {
-	if b.IsServer {
-		b.SendString("SERVER " + b.User + " 1")
-	} else {
-		b.SendString("USER " + b.User + " 0 * " + b.User)
-	}
+	b.SendString("USER " + b.User + " 0 * " + b.User)
 	b.mutex.RLock()
 	defer b.mutex.RUnlock()
 	b.userSet = true
@@ -76,7 +74,7 @@ func (b *Bot) ticker() {
 	}()
 SendLoop:
 	for {
-		time.Sleep(time.Second * 10)
+		time.Sleep(b.tickInterval())
 		select {
 		case b.socketChan <- nil:
 			continue SendLoop
@@ -89,3 +87,66 @@ SendLoop:
 func now() int64 {
 	return time.Now().UTC().Unix()
 }
+
+// params returns the parameters of msg including the trailing one.
+func params(msg *irc.Message) []string {
+	p := msg.Params
+	if msg.Trailing != "" || msg.EmptyTrailing {
+		p = append(p[:len(p):len(p)], msg.Trailing)
+	}
+	return p
+}
+
+// dispatch hands msg to event subscribers and the Handler.
+func (b *Bot) dispatch(msg *irc.Message) {
+	b.dispatchTags(msg, nil)
+}
+
+// dispatchTags hands msg to event subscribers, with its tags, and the Handler.
+func (b *Bot) dispatchTags(msg *irc.Message, tags map[string]string) {
+	b.dispatchEvent(Event{Type: EventMessage, Message: msg, Tags: tags})
+}
+
+// dispatchEvent hands the EventMessage ev to event subscribers and its message to the handlers.
+func (b *Bot) dispatchEvent(ev Event) {
+	b.emit(ev)
+	if b.Handler != nil || b.TagsHandler != nil {
+		go b.runHandler(ev.Message, ev.Tags)
+	}
+}
+
+// runHandler calls Handler and TagsHandler for msg. A panicking handler is logged instead of taking
+// down the bot.
+func (b *Bot) runHandler(msg *irc.Message, tags map[string]string) {
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			b.logError("handler panic", fmt.Errorf("%v", r), "command", msg.Command)
+			if b.Metrics != nil {
+				b.Metrics.HandlerPanic()
+			}
+		}
+		if b.Metrics != nil {
+			b.Metrics.HandlerLatency(time.Since(start))
+		}
+	}()
+	if b.Handler != nil {
+		b.Handler(msg)
+	}
+	if b.TagsHandler != nil {
+		b.TagsHandler(msg, tags)
+	}
+}
+
+// runConnectedHandler calls ConnectedHandler, logging a panic instead of taking down the bot.
+func (b *Bot) runConnectedHandler() {
+	defer func() {
+		if r := recover(); r != nil {
+			b.logError("connected handler panic", fmt.Errorf("%v", r))
+			if b.Metrics != nil {
+				b.Metrics.HandlerPanic()
+			}
+		}
+	}()
+	b.ConnectedHandler()
+}
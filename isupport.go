@@ -0,0 +1,124 @@
+package flockerbot
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ISupport holds the features the server announced with RPL_ISUPPORT (005). Accessors return the
+// RFC defaults for tokens the server did not send.
+type ISupport struct {
+	mutex  sync.RWMutex
+	tokens map[string]string
+}
+
+// newISupport returns an ISupport without tokens.
+func newISupport() *ISupport {
+	return &ISupport{tokens: make(map[string]string)}
+}
+
+// ISupport returns the features announced by the server on the current connection.
+func (b *Bot) ISupport() *ISupport {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.isupport
+}
+
+// parse adds the tokens of a 005 reply. params are the parameters after our nick.
+func (is *ISupport) parse(params []string) {
+	is.mutex.Lock()
+	defer is.mutex.Unlock()
+	for _, token := range params {
+		if strings.Contains(token, " ") {
+			// The trailing "are supported by this server".
+			continue
+		}
+		if name, ok := strings.CutPrefix(token, "-"); ok {
+			delete(is.tokens, name)
+			continue
+		}
+		name, value, _ := strings.Cut(token, "=")
+		is.tokens[name] = unescapeISupport(value)
+	}
+}
+
+// Get returns the value of token name and whether the server sent it.
+func (is *ISupport) Get(name string) (string, bool) {
+	is.mutex.RLock()
+	defer is.mutex.RUnlock()
+	value, ok := is.tokens[name]
+	return value, ok
+}
+
+// get returns the value of token name, or def if it was not sent or is empty.
+func (is *ISupport) get(name, def string) string {
+	if value, ok := is.Get(name); ok && value != "" {
+		return value
+	}
+	return def
+}
+
+// ChanModes returns the channel modes by type: list modes (A), modes that always take a
+// parameter (B), modes that take a parameter only when set (C) and flags (D).
+func (is *ISupport) ChanModes() (list, always, onSet, flags string) {
+	types := strings.Split(is.get("CHANMODES", "beI,k,l,imnpst"), ",")
+	for len(types) < 4 {
+		types = append(types, "")
+	}
+	return types[0], types[1], types[2], types[3]
+}
+
+// Prefix returns the channel status modes and their prefixes, highest first, e.g. "ov" and "@+".
+func (is *ISupport) Prefix() (modes, prefixes string) {
+	value := is.get("PREFIX", "(ov)@+")
+	modes, prefixes, ok := strings.Cut(strings.TrimPrefix(value, "("), ")")
+	if !ok || len(modes) != len(prefixes) {
+		return "ov", "@+"
+	}
+	return modes, prefixes
+}
+
+// Modes returns the maximum number of modes with a parameter per MODE command. 0 means no limit.
+func (is *ISupport) Modes() int {
+	value, ok := is.Get("MODES")
+	if !ok {
+		return 3
+	}
+	n, _ := strconv.Atoi(value)
+	return n
+}
+
+// ChanTypes returns the channel prefixes, e.g. "#&".
+func (is *ISupport) ChanTypes() string {
+	return is.get("CHANTYPES", "#&")
+}
+
+// IsChannel returns true if name is a channel name.
+func (is *ISupport) IsChannel(name string) bool {
+	return name != "" && strings.IndexByte(is.ChanTypes(), name[0]) >= 0
+}
+
+// Network returns the network name, if announced.
+func (is *ISupport) Network() string {
+	return is.get("NETWORK", "")
+}
+
+// unescapeISupport decodes the \xHH escapes of token values.
+func unescapeISupport(value string) string {
+	if !strings.Contains(value, `\x`) {
+		return value
+	}
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if c, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				sb.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(value[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,113 @@
+package flockerbot
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+var (
+	// ErrNoLabels signals that the server did not enable labeled-response
+	ErrNoLabels = errors.New("Bot: labeled-response not enabled")
+	// ErrNoEcho signals that the server did not enable echo-message
+	ErrNoEcho = errors.New("Bot: echo-message not enabled")
+)
+
+// RejectedError is returned by SendAndConfirm if the server answered with an error, e.g.
+// 404 ERR_CANNOTSENDTOCHAN or a FAIL standard reply.
+type RejectedError struct {
+	Code    string       // The numeric, or the code of a FAIL reply.
+	Reason  string       // Text of the reply.
+	Message *irc.Message // The reply.
+}
+
+func (e *RejectedError) Error() string { return "Bot: Rejected: " + e.Code + " " + e.Reason }
+
+// Confirmation is the server's answer to a message sent with SendAndConfirm.
+type Confirmation struct {
+	Message *irc.Message      // The echoed message. Nil if the server only acknowledged it.
+	Tags    map[string]string // Tags of the echoed message.
+	MsgID   string            // Message ID assigned by the server, if any.
+	Time    time.Time         // Server time of the message, zero if unknown.
+}
+
+// SendAndConfirm sends msg with a label and waits for the server's response to it, the message as
+// the server relayed it, with msgid and time. It requires the labeled-response capability and
+// echo-message, which must be requested in Caps. If the server rejects msg, a *RejectedError is
+// returned.
+func (b *Bot) SendAndConfirm(ctx context.Context, msg *irc.Message) (*Confirmation, error) {
+	if !b.HasCap("labeled-response") {
+		return nil, ErrNoLabels
+	}
+	if !b.HasCap("echo-message") {
+		return nil, ErrNoEcho
+	}
+	b.mutex.Lock()
+	b.labelCount++
+	label := "fb" + strconv.Itoa(b.labelCount)
+	b.mutex.Unlock()
+	batch := ""
+	sub := b.Subscribe(func(ev Event) bool {
+		return ev.Type == EventMessage && (ev.Tags["label"] == label || ev.Tags["batch"] != "" || ev.Message.Command == "BATCH")
+	})
+	defer sub.Cancel()
+	b.SendString(withTags(map[string]string{"label": label}, msg.String()))
+	var response []Event
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case ev, ok := <-sub.C:
+			if !ok {
+				return nil, ctx.Err()
+			}
+			m := ev.Message
+			switch {
+			case m.Command == "BATCH" && ev.Tags["label"] == label && len(m.Params) > 0:
+				// BATCH +ref labeled-response
+				batch = strings.TrimPrefix(m.Params[0], "+")
+			case batch != "" && ev.Tags["batch"] == batch:
+				response = append(response, ev)
+			case batch != "" && m.Command == "BATCH" && len(m.Params) > 0 && m.Params[0] == "-"+batch:
+				return confirmation(msg, response)
+			case ev.Tags["label"] == label:
+				return confirmation(msg, []Event{ev})
+			}
+		}
+	}
+}
+
+// confirmation evaluates the response to sent: an error reply, the echo or an ACK.
+func confirmation(sent *irc.Message, response []Event) (*Confirmation, error) {
+	for _, ev := range response {
+		if err := rejection(ev.Message); err != nil {
+			return nil, err
+		}
+	}
+	for _, ev := range response {
+		if ev.Message.Command == sent.Command {
+			return &Confirmation{Message: ev.Message, Tags: ev.Tags, MsgID: ev.Tags["msgid"], Time: serverTime(ev.Tags)}, nil
+		}
+	}
+	return &Confirmation{}, nil
+}
+
+// rejection returns the error for an error numeric or FAIL reply, or nil.
+func rejection(msg *irc.Message) error {
+	p := params(msg)
+	if len(p) == 0 {
+		return nil
+	}
+	if msg.Command == "FAIL" && len(p) > 1 {
+		// FAIL command code [context...] :description
+		return &RejectedError{Code: p[1], Reason: p[len(p)-1], Message: msg}
+	}
+	if n, err := strconv.Atoi(msg.Command); err == nil && len(msg.Command) == 3 && n >= 400 && n < 600 {
+		return &RejectedError{Code: msg.Command, Reason: p[len(p)-1], Message: msg}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package flockerbot
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+func TestSendAndConfirm(t *testing.T) {
+	b := testBot("flocker")
+	if _, err := b.SendAndConfirm(context.Background(), irc.ParseMessage("PRIVMSG #flocker :hi")); err != ErrNoLabels {
+		t.Errorf("Expected ErrNoLabels, got %v", err)
+	}
+	b.capsEnabled["labeled-response"] = true
+	if _, err := b.SendAndConfirm(context.Background(), irc.ParseMessage("PRIVMSG #flocker :hi")); err != ErrNoEcho {
+		t.Errorf("Expected ErrNoEcho, got %v", err)
+	}
+	b.capsEnabled["echo-message"] = true
+	td := []struct {
+		sent     string
+		response []string
+		msgid    string
+		code     string
+	}{
+		{"PRIVMSG #flocker :hi", []string{"@label=fb1;msgid=abc;time=2024-01-01T12:00:00.000Z :flocker!f@h PRIVMSG #flocker :hi"}, "abc", ""},
+		{"PRIVMSG #moderated :hi", []string{"@label=fb2 :irc.example 404 flocker #moderated :Cannot send to channel"}, "", "404"},
+		{"NOTICE #flocker :hi", []string{"@label=fb3 :irc.example ACK"}, "", ""},
+		{"PRIVMSG #flocker :multi", []string{
+			"@label=fb4 :irc.example BATCH +x labeled-response",
+			"@batch=x;msgid=m1 :flocker!f@h PRIVMSG #flocker :multi",
+			":irc.example BATCH -x",
+		}, "m1", ""},
+		{"TOPIC #flocker :new", []string{"@label=fb5 :irc.example FAIL TOPIC NEED_MORE_PRIVS #flocker :Not allowed"}, "", "NEED_MORE_PRIVS"},
+	}
+	for _, d := range td {
+		type result struct {
+			c   *Confirmation
+			err error
+		}
+		done := make(chan result)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			c, err := b.SendAndConfirm(ctx, irc.ParseMessage(d.sent))
+			done <- result{c, err}
+		}()
+		sent := nextLine(t, b)
+		tags, line := parseTags(sent)
+		if line != d.sent || tags["label"] == "" {
+			t.Errorf("Unexpected line %q", sent)
+		}
+		for _, l := range d.response {
+			tags, line := parseTags(l)
+			b.dispatchTags(irc.ParseMessage(line), tags)
+		}
+		r := <-done
+		var rejected *RejectedError
+		switch {
+		case d.code != "":
+			if !errors.As(r.err, &rejected) || rejected.Code != d.code {
+				t.Errorf("%s: expected rejection %s, got %v", d.sent, d.code, r.err)
+			}
+		case r.err != nil:
+			t.Errorf("%s: unexpected error %v", d.sent, r.err)
+		case r.c.MsgID != d.msgid:
+			t.Errorf("%s: got msgid %q, want %q", d.sent, r.c.MsgID, d.msgid)
+		}
+	}
+}
+
+func TestWithTags(t *testing.T) {
+	if l := withTags(map[string]string{"label": "a b;c", "+draft/reply": "x"}, "PRIVMSG #c :hi"); l != `@+draft/reply=x;label=a\sb\:c PRIVMSG #c :hi` {
+		t.Errorf("Unexpected line %q", l)
+	}
+	tags, _ := parseTags(withTags(map[string]string{"k": `\ ;`}, "PING x"))
+	if tags["k"] != `\ ;` {
+		t.Errorf("Escaping does not round-trip: %q", tags["k"])
+	}
+}
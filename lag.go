@@ -0,0 +1,144 @@
+package flockerbot
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrLag signals that the lag exceeded MaxLag
+	ErrLag = errors.New("Bot: Lag exceeded")
+)
+
+const (
+	lagSmoothing = 0.2 // weight of a new sample in the smoothed lag
+	maxPending   = 16  // maximum number of outstanding PINGs remembered
+)
+
+// pendingPing is a PING sent by the bot that is waiting for its PONG.
+type pendingPing struct {
+	token string
+	sent  time.Time
+}
+
+// Lag returns the current lag. That is the round-trip time of the last PING, or the age of the
+// oldest unanswered PING if that is larger.
+func (b *Bot) Lag() time.Duration {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.currentLag()
+}
+
+// SmoothedLag returns the exponentially weighted moving average of measured round-trip times.
+func (b *Bot) SmoothedLag() time.Duration {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.smoothedLag
+}
+
+// currentLag must be called with mutex held.
+func (b *Bot) currentLag() time.Duration {
+	lag := b.lag
+	if len(b.pendingPings) > 0 {
+		if age := time.Since(b.pendingPings[0].sent); age > lag {
+			lag = age
+		}
+	}
+	return lag
+}
+
+// resetLag forgets all outstanding PINGs and measurements. Called on connect.
+func (b *Bot) resetLag() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.pendingPings = nil
+	b.lastPing = time.Time{}
+	b.lag = 0
+	b.smoothedLag = 0
+}
+
+// pingDue returns true if a PING should be sent. Without PingInterval, a PING is sent after
+// 60 seconds of silence since lastTime.
+func (b *Bot) pingDue(lastTime int64) bool {
+	if b.PingInterval <= 0 {
+		return lastTime < now()-60
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return time.Since(b.lastPing) >= time.Second*time.Duration(b.PingInterval)
+}
+
+// lagExceeded returns true if MaxLag is set and the current lag is above it.
+func (b *Bot) lagExceeded() bool {
+	if b.MaxLag <= 0 {
+		return false
+	}
+	return b.Lag() > time.Second*time.Duration(b.MaxLag)
+}
+
+// sendPing sends a PING with a unique token and records the time it was sent.
+func (b *Bot) sendPing() {
+	sent := time.Now()
+	token := "flocker" + strconv.FormatInt(sent.UnixNano(), 36)
+	b.mutex.Lock()
+	b.pendingPings = append(b.pendingPings, pendingPing{token: token, sent: sent})
+	if len(b.pendingPings) > maxPending {
+		b.pendingPings = b.pendingPings[1:]
+	}
+	b.lastPing = sent
+	b.mutex.Unlock()
+	if b.IsServer {
+		// Servers do not echo our token, the protocol matches the PONG to the oldest PING.
+		b.linkProtocol().ping(b)
+		return
+	}
+	b.SendString("PING :" + token)
+}
+
+// oldestPing returns the token of the oldest unanswered PING, or "".
+func (b *Bot) oldestPing() string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if len(b.pendingPings) == 0 {
+		return ""
+	}
+	return b.pendingPings[0].token
+}
+
+// handlePong checks if token answers one of our PINGs and records the lag. Older PINGs are
+// dropped, since the server answers in order. Returns true if the PONG was ours.
+func (b *Bot) handlePong(token string) bool {
+	b.mutex.Lock()
+	var rtt time.Duration
+	found := false
+	for i, p := range b.pendingPings {
+		if p.token == token {
+			rtt = time.Since(p.sent)
+			b.pendingPings = b.pendingPings[i+1:]
+			found = true
+			break
+		}
+	}
+	if found {
+		b.lag = rtt
+		if b.smoothedLag == 0 {
+			b.smoothedLag = rtt
+		} else {
+			b.smoothedLag = time.Duration(lagSmoothing*float64(rtt) + (1-lagSmoothing)*float64(b.smoothedLag))
+		}
+	}
+	b.mutex.Unlock()
+	if found && b.Metrics != nil {
+		b.Metrics.PingLatency(rtt)
+	}
+	return found
+}
+
+// tickInterval returns how often the ticker wakes up the main loop.
+func (b *Bot) tickInterval() time.Duration {
+	if b.PingInterval > 0 && b.PingInterval < 10 {
+		return time.Second * time.Duration(b.PingInterval)
+	}
+	return time.Second * 10
+}
@@ -0,0 +1,42 @@
+package flockerbot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLag(t *testing.T) {
+	b := &Bot{MaxLag: 30}
+	b.Setup()
+	b.socketChan = make(chan *channelString, 10)
+	b.sendPing()
+	b.sendPing()
+	if len(b.pendingPings) != 2 {
+		t.Fatalf("Expected 2 pending pings, got %d", len(b.pendingPings))
+	}
+	b.pendingPings[0].sent = time.Now().Add(-2 * time.Second)
+	b.pendingPings[1].sent = time.Now().Add(-time.Second)
+	if b.handlePong("unknown") {
+		t.Error("Unknown token accepted")
+	}
+	if !b.handlePong(b.pendingPings[1].token) {
+		t.Fatal("Token not matched")
+	}
+	if len(b.pendingPings) != 0 {
+		t.Error("Older pings not dropped")
+	}
+	if lag := b.Lag(); lag < time.Second || lag > 2*time.Second {
+		t.Errorf("Unexpected lag %s", lag)
+	}
+	if b.SmoothedLag() != b.lag {
+		t.Error("First sample must initialize smoothed lag")
+	}
+	if b.lagExceeded() {
+		t.Error("Lag below MaxLag reported as exceeded")
+	}
+	b.sendPing()
+	b.pendingPings[0].sent = time.Now().Add(-time.Minute)
+	if !b.lagExceeded() {
+		t.Error("Unanswered ping older than MaxLag not detected")
+	}
+}
@@ -0,0 +1,534 @@
+package flockerbot
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+)
+
+var (
+	// ErrLinkConfig signals that IsServer is set but SID or server name are invalid
+	ErrLinkConfig = errors.New("Bot: Invalid server link configuration")
+	// ErrLinkPassword signals that the uplink sent the wrong password
+	ErrLinkPassword = errors.New("Bot: Server link password mismatch")
+	// ErrLinkProtocol signals that the uplink does not speak the expected protocol version
+	ErrLinkProtocol = errors.New("Bot: Server link protocol mismatch")
+)
+
+// LinkProtocol is a server-to-server protocol module. It translates between the wire protocol
+// and the shared LinkState and pseudo-client code. Implementations are TS6 (charybdis, solanum,
+// ratbox), InspIRCd (spanningtree) and UnrealIRCd.
+type LinkProtocol interface {
+	// register sends the handshake after connecting.
+	register(b *Bot)
+	// handle processes a message from the uplink and returns whether it is passed to the handlers.
+	handle(b *Bot, msg *irc.Message) (dispatch bool, err error)
+	// introduce sends the introduction of a pseudo-client.
+	introduce(b *Bot, pc *PseudoClient)
+	// join joins a pseudo-client to channel, which has timestamp ts.
+	join(b *Bot, pc *PseudoClient, channel string, ts int64)
+	// mode sets channel modes as pseudo-client. Args are UIDs for status modes.
+	mode(b *Bot, pc *PseudoClient, channel string, ts int64, modes string, args []string)
+	// ping sends a PING to the uplink.
+	ping(b *Bot)
+	// caseMapping returns the case mapping of nicks and channels on the network.
+	caseMapping() CaseMapping
+	// chanModes returns the CHANMODES and PREFIX tokens of the network, as in RPL_ISUPPORT, for
+	// uplinks that do not announce them.
+	chanModes() []string
+}
+
+// LinkServer is a server on the network, as seen over a server link.
+type LinkServer struct {
+	SID         string // Server ID.
+	Name        string // Server name.
+	Description string // Server description.
+	Uplink      string // SID of the server it is linked to. Empty for our uplink.
+}
+
+// LinkUser is a user on the network, as seen over a server link.
+type LinkUser struct {
+	UID      string // Unique ID.
+	Nick     string // Current nick.
+	User     string // Ident.
+	Host     string // Visible host.
+	RealHost string // Real host, if known.
+	IP       string // IP address, or "0".
+	Realname string // Realname (gecos).
+	Account  string // Services account, empty if not logged in.
+	Server   string // SID of the server the user is on.
+	Modes    string // User modes, e.g. "+iw".
+	TS       int64  // Nick timestamp.
+}
+
+// LinkChannel is a channel on the network, as seen over a server link.
+type LinkChannel struct {
+	Name    string            // Channel name.
+	TS      int64             // Channel timestamp.
+	Modes   string            // Simple channel modes, e.g. "+nt".
+	Topic   string            // Current topic.
+	Members map[string]string // UID to status prefixes, e.g. "@".
+}
+
+// LinkState is the network state learned over a server link: servers, users and channels.
+// Returned values are copies and safe to keep.
+type LinkState struct {
+	mutex    sync.RWMutex
+	casemap  CaseMapping
+	servers  map[string]*LinkServer  // by SID
+	users    map[string]*LinkUser    // by UID
+	nicks    map[string]string       // folded nick to UID
+	channels map[string]*LinkChannel // by folded name
+	modes    *ISupport               // CHANMODES and PREFIX of the network
+}
+
+// newLinkState returns an empty LinkState comparing names with casemap, with the channel modes
+// of the RPL_ISUPPORT style tokens chanModes.
+func newLinkState(casemap CaseMapping, chanModes []string) *LinkState {
+	ls := &LinkState{
+		casemap:  casemap,
+		servers:  make(map[string]*LinkServer),
+		users:    make(map[string]*LinkUser),
+		nicks:    make(map[string]string),
+		channels: make(map[string]*LinkChannel),
+		modes:    newISupport(),
+	}
+	ls.modes.parse(chanModes)
+	return ls
+}
+
+// Link returns the network state of a server link, or nil if not in server mode.
+func (b *Bot) Link() *LinkState {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.link
+}
+
+// Server returns the server with sid.
+func (ls *LinkState) Server(sid string) (LinkServer, bool) {
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+	if s, ok := ls.servers[sid]; ok {
+		return *s, true
+	}
+	return LinkServer{}, false
+}
+
+// Servers returns all known servers.
+func (ls *LinkState) Servers() []LinkServer {
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+	servers := make([]LinkServer, 0, len(ls.servers))
+	for _, s := range ls.servers {
+		servers = append(servers, *s)
+	}
+	return servers
+}
+
+// User returns the user with uid.
+func (ls *LinkState) User(uid string) (LinkUser, bool) {
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+	if u, ok := ls.users[uid]; ok {
+		return *u, true
+	}
+	return LinkUser{}, false
+}
+
+// UserByNick returns the user with nick.
+func (ls *LinkState) UserByNick(nick string) (LinkUser, bool) {
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+	if u, ok := ls.users[ls.nicks[ls.casemap.Fold(nick)]]; ok {
+		return *u, true
+	}
+	return LinkUser{}, false
+}
+
+// Channel returns the channel name.
+func (ls *LinkState) Channel(name string) (LinkChannel, bool) {
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+	c, ok := ls.channels[ls.casemap.Fold(name)]
+	if !ok {
+		return LinkChannel{}, false
+	}
+	cp := *c
+	cp.Members = make(map[string]string, len(c.Members))
+	for uid, status := range c.Members {
+		cp.Members[uid] = status
+	}
+	return cp, true
+}
+
+// addServer records a server.
+func (ls *LinkState) addServer(s *LinkServer) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.servers[s.SID] = s
+}
+
+// removeServer removes the server sid, all servers behind it and their users.
+func (ls *LinkState) removeServer(sid string) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	gone := map[string]bool{sid: true}
+	for changed := true; changed; {
+		changed = false
+		for _, s := range ls.servers {
+			if gone[s.Uplink] && !gone[s.SID] {
+				gone[s.SID] = true
+				changed = true
+			}
+		}
+	}
+	for s := range gone {
+		delete(ls.servers, s)
+	}
+	for uid, u := range ls.users {
+		if gone[u.Server] {
+			ls.removeUserLocked(uid)
+		}
+	}
+}
+
+// addUser records a user.
+func (ls *LinkState) addUser(u *LinkUser) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	if old, ok := ls.users[u.UID]; ok {
+		delete(ls.nicks, ls.casemap.Fold(old.Nick))
+	}
+	ls.users[u.UID] = u
+	ls.nicks[ls.casemap.Fold(u.Nick)] = u.UID
+}
+
+// updateUser calls f with the user uid, if it exists.
+func (ls *LinkState) updateUser(uid string, f func(u *LinkUser)) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	if u, ok := ls.users[uid]; ok {
+		delete(ls.nicks, ls.casemap.Fold(u.Nick))
+		f(u)
+		ls.nicks[ls.casemap.Fold(u.Nick)] = uid
+	}
+}
+
+// removeUser removes the user uid from the network and all channels.
+func (ls *LinkState) removeUser(uid string) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.removeUserLocked(uid)
+}
+
+func (ls *LinkState) removeUserLocked(uid string) {
+	if u, ok := ls.users[uid]; ok {
+		delete(ls.nicks, ls.casemap.Fold(u.Nick))
+		delete(ls.users, uid)
+	}
+	for key, c := range ls.channels {
+		delete(c.Members, uid)
+		if len(c.Members) == 0 {
+			delete(ls.channels, key)
+		}
+	}
+}
+
+// joinChannel adds uid with status to channel name, creating it with ts if needed. If ts is older
+// than the channel's, the channel is reset to ts and existing statuses and modes are cleared; if it
+// is newer, the status is dropped.
+func (ls *LinkState) joinChannel(name string, ts int64, uid, status string) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	c := ls.channelLocked(name, ts)
+	switch {
+	case ts > 0 && ts < c.TS:
+		c.TS = ts
+		c.Modes = ""
+		for m := range c.Members {
+			c.Members[m] = ""
+		}
+	case ts > c.TS:
+		status = ""
+	}
+	if uid != "" {
+		c.Members[uid] = status
+	}
+}
+
+// channelLocked returns channel name, creating it with ts. Must be called with mutex held.
+func (ls *LinkState) channelLocked(name string, ts int64) *LinkChannel {
+	key := ls.casemap.Fold(name)
+	c, ok := ls.channels[key]
+	if !ok {
+		c = &LinkChannel{Name: name, TS: ts, Members: make(map[string]string)}
+		ls.channels[key] = c
+	}
+	return c
+}
+
+// partChannel removes uid from channel name.
+func (ls *LinkState) partChannel(name, uid string) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	key := ls.casemap.Fold(name)
+	if c, ok := ls.channels[key]; ok {
+		delete(c.Members, uid)
+		if len(c.Members) == 0 {
+			delete(ls.channels, key)
+		}
+	}
+}
+
+// partAll removes uid from all channels.
+func (ls *LinkState) partAll(uid string) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	for key, c := range ls.channels {
+		delete(c.Members, uid)
+		if len(c.Members) == 0 {
+			delete(ls.channels, key)
+		}
+	}
+}
+
+// updateChannel calls f with channel name, if it exists.
+func (ls *LinkState) updateChannel(name string, f func(c *LinkChannel)) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	if c, ok := ls.channels[ls.casemap.Fold(name)]; ok {
+		f(c)
+	}
+}
+
+// statusPrefixes returns the status prefixes of the status mode letters modes, e.g. "@" for "o".
+func (ls *LinkState) statusPrefixes(modes string) string {
+	status, prefixes := ls.modes.Prefix()
+	s := ""
+	for i := 0; i < len(modes); i++ {
+		if j := strings.IndexByte(status, modes[i]); j >= 0 {
+			s += prefixes[j : j+1]
+		}
+	}
+	return s
+}
+
+// applyModes applies a mode change like "+nt-s" to c, with the mode types of the network in
+// modes. Modes with parameters are not tracked, except the member statuses, for which args holds
+// the UIDs.
+func applyModes(c *LinkChannel, modes *ISupport, change string, args []string) {
+	status, prefixes := modes.Prefix()
+	for _, mc := range modes.ParseModes(change, args) {
+		switch mc.Type {
+		case ModeStatus:
+			member, ok := c.Members[mc.Param]
+			if !ok {
+				continue
+			}
+			i := strings.IndexByte(status, mc.Mode)
+			prefix := prefixes[i : i+1]
+			member = strings.ReplaceAll(member, prefix, "")
+			if mc.Add {
+				member += prefix
+			}
+			c.Members[mc.Param] = member
+		case ModeFlag:
+			c.Modes = strings.ReplaceAll(strings.TrimPrefix(c.Modes, "+"), string(mc.Mode), "")
+			if mc.Add {
+				c.Modes += string(mc.Mode)
+			}
+		}
+	}
+	c.Modes = strings.TrimPrefix(c.Modes, "+")
+	if c.Modes != "" {
+		c.Modes = "+" + c.Modes
+	}
+}
+
+// linkProtocol returns the configured protocol, TS6 by default.
+func (b *Bot) linkProtocol() LinkProtocol {
+	if b.LinkProtocol == nil {
+		return TS6{}
+	}
+	return b.LinkProtocol
+}
+
+// linkFold folds name with the case mapping of the link protocol.
+func (b *Bot) linkFold(name string) string {
+	return b.linkProtocol().caseMapping().Fold(name)
+}
+
+// validSID returns true if sid is a valid server ID: a digit followed by two digits or uppercase letters.
+func validSID(sid string) bool {
+	if len(sid) != 3 || sid[0] < '0' || sid[0] > '9' {
+		return false
+	}
+	for _, c := range sid[1:] {
+		if !(c >= '0' && c <= '9') && !(c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// serverDesc returns the server description.
+func (b *Bot) serverDesc() string {
+	if b.ServerDesc == "" {
+		return "flockerbot"
+	}
+	return b.ServerDesc
+}
+
+// linkRegister resets the network state and starts the handshake. User is the server name,
+// Password the link password.
+func (b *Bot) linkRegister() {
+	b.mutex.Lock()
+	b.link = newLinkState(b.linkProtocol().caseMapping(), b.linkProtocol().chanModes())
+	b.remoteSID = ""
+	b.linkBurstDone = false
+	b.mutex.Unlock()
+	b.linkProtocol().register(b)
+}
+
+// SendAsServer sends line with our SID as source. Only useful in server mode.
+func (b *Bot) SendAsServer(line string) {
+	b.SendString(":" + b.SID + " " + line)
+}
+
+// setRemoteSID records the SID of our uplink.
+func (b *Bot) setRemoteSID(sid string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.remoteSID = sid
+}
+
+// uplinkSID returns the SID of our uplink.
+func (b *Bot) uplinkSID() string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.remoteSID
+}
+
+// handleLink processes a message received over the server link, updates the network state and
+// dispatches it to the handlers. Returns an error if the link must be closed.
+func (b *Bot) handleLink(msg *irc.Message) error {
+	// Translate before the state changes, so that a QUIT still knows the user.
+	translated := b.linkTranslate(msg)
+	dispatch, err := b.linkProtocol().handle(b, msg)
+	if err != nil {
+		return err
+	}
+	if dispatch {
+		b.dispatch(translated)
+		b.routePseudo(msg, translated)
+	}
+	return nil
+}
+
+// handleLinkCommon handles the commands that are the same in all protocols. Returns false if
+// msg was not one of them.
+func (b *Bot) handleLinkCommon(msg *irc.Message, p []string) bool {
+	ls := b.Link()
+	source := ""
+	if msg.Prefix != nil {
+		source = msg.Prefix.Name
+	}
+	arg := func(i int) string {
+		if i < len(p) {
+			return p[i]
+		}
+		return ""
+	}
+	switch msg.Command {
+	case "NICK":
+		// :UID NICK newnick ts
+		ts, _ := strconv.ParseInt(arg(1), 10, 64)
+		ls.updateUser(source, func(u *LinkUser) {
+			u.Nick = arg(0)
+			u.TS = ts
+		})
+	case "QUIT":
+		ls.removeUser(source)
+	case "KILL":
+		ls.removeUser(arg(0))
+	case "SQUIT":
+		ls.removeServer(arg(0))
+	case "PART":
+		for _, channel := range strings.Split(arg(0), ",") {
+			ls.partChannel(channel, source)
+		}
+	case "KICK":
+		ls.partChannel(arg(0), arg(1))
+	case "PRIVMSG", "NOTICE", "INVITE", "AWAY", "WALLOPS":
+	default:
+		return false
+	}
+	return true
+}
+
+// linkEstablished marks the link as up after the uplink finished its burst and calls the
+// connected handlers.
+func (b *Bot) linkEstablished(msg *irc.Message) {
+	b.mutex.Lock()
+	b.linkBurstDone = true
+	b.mutex.Unlock()
+	b.setConnected(true)
+	b.logInfo("server link established", "uplink", b.uplinkSID())
+	b.emit(Event{Type: EventConnected, Message: msg})
+	if b.ConnectedHandler != nil {
+		go b.runConnectedHandler()
+	}
+}
+
+// linkTranslate returns a copy of msg with a UID or SID source replaced by nick!user@host,
+// respectively the server name, so handlers can treat it like a client message. The UID target
+// of PRIVMSG, NOTICE, INVITE, KILL and KICK is replaced by the nick.
+func (b *Bot) linkTranslate(msg *irc.Message) *irc.Message {
+	if msg.Prefix == nil {
+		return msg
+	}
+	ls := b.Link()
+	cp := *msg
+	if u, ok := ls.User(msg.Prefix.Name); ok {
+		cp.Prefix = &irc.Prefix{Name: u.Nick, User: u.User, Host: u.Host}
+	} else if s, ok := ls.Server(msg.Prefix.Name); ok {
+		cp.Prefix = &irc.Prefix{Name: s.Name}
+	}
+	target := -1
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE", "INVITE", "KILL":
+		target = 0
+	case "KICK":
+		target = 1
+	}
+	if target >= 0 && target < len(msg.Params) {
+		if u, ok := ls.User(msg.Params[target]); ok {
+			cp.Params = append([]string(nil), msg.Params...)
+			cp.Params[target] = u.Nick
+		}
+	}
+	return &cp
+}
+
+// mergeUserModes applies a user mode change like "+i-w" to modes.
+func mergeUserModes(modes, change string) string {
+	modes = strings.TrimPrefix(modes, "+")
+	add := true
+	for _, m := range change {
+		switch m {
+		case '+':
+			add = true
+		case '-':
+			add = false
+		default:
+			modes = strings.ReplaceAll(modes, string(m), "")
+			if add {
+				modes += string(m)
+			}
+		}
+	}
+	return "+" + modes
+}
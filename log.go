@@ -0,0 +1,144 @@
+package flockerbot
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+const redacted = "<redacted>"
+
+// logInfo logs a connection lifecycle event, if a Logger is set.
+func (b *Bot) logInfo(msg string, args ...any) {
+	if b.Logger != nil {
+		b.Logger.Info(msg, args...)
+	}
+}
+
+// logError logs an error, if a Logger is set.
+func (b *Bot) logError(msg string, err error, args ...any) {
+	if b.Logger != nil {
+		b.Logger.Error(msg, append([]any{"error", err}, args...)...)
+	}
+}
+
+// logLine logs a raw protocol line at debug level. Credentials are redacted.
+func (b *Bot) logLine(dir, line string) {
+	if b.Logger == nil || !b.Logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	b.Logger.Debug("irc", "dir", dir, "line", redactLine(strings.TrimRight(line, "\r\n")))
+}
+
+// redactProxy removes the password from a proxy URL for logging.
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return redacted
+	}
+	return u.Redacted()
+}
+
+// redactLine replaces credentials in PASS, OPER, AUTHENTICATE and NickServ IDENTIFY lines. Only
+// the secret is replaced, the line is otherwise logged as it is, including message tags.
+func redactLine(line string) string {
+	command, params := lineParams(line)
+	param := func(i int) string {
+		if i < len(params) {
+			return line[params[i].start:params[i].end]
+		}
+		return ""
+	}
+	replace := func(s span, with string) string {
+		return line[:s.start] + with + line[s.end:]
+	}
+	switch strings.ToUpper(command) {
+	case "PASS":
+		// TS6 style server passwords are followed by "TS 6 :SID", which is of no secret.
+		if len(params) > 0 {
+			return replace(params[0], redacted)
+		}
+	case "OPER":
+		if len(params) > 1 {
+			return replace(span{params[1].start, len(line)}, redacted)
+		}
+	case "AUTHENTICATE":
+		if len(params) > 0 {
+			if arg := param(len(params) - 1); arg != "+" && arg != "*" && !isMechanism(arg) {
+				return replace(params[len(params)-1], redacted)
+			}
+		}
+	case "PRIVMSG":
+		target, _, _ := strings.Cut(param(0), "@")
+		if len(params) > 1 && strings.EqualFold(target, "NickServ") {
+			return replace(params[1], redactIdentify(param(1)))
+		}
+	case "NICKSERV", "NS":
+		if len(params) > 0 {
+			s := span{params[0].start, len(line)}
+			return replace(s, redactIdentify(line[s.start:]))
+		}
+	}
+	return line
+}
+
+// span is the position of a parameter in a line.
+type span struct {
+	start, end int
+}
+
+// lineParams returns the command of line and the positions of its parameters, skipping tags and
+// prefix. The trailing parameter spans to the end of the line, without its colon.
+func lineParams(line string) (string, []span) {
+	pos := 0
+	// next returns the position of the next word and the end of it.
+	next := func() (int, int) {
+		for pos < len(line) && line[pos] == ' ' {
+			pos++
+		}
+		start := pos
+		for pos < len(line) && line[pos] != ' ' {
+			pos++
+		}
+		return start, pos
+	}
+	start, end := next()
+	if start < len(line) && line[start] == '@' {
+		start, end = next()
+	}
+	if start < len(line) && line[start] == ':' {
+		start, end = next()
+	}
+	command := line[start:end]
+	var params []span
+	for {
+		start, end = next()
+		if start == len(line) {
+			return command, params
+		}
+		if line[start] == ':' {
+			return command, append(params, span{start + 1, len(line)})
+		}
+		params = append(params, span{start, end})
+	}
+}
+
+// redactIdentify redacts everything after an IDENTIFY verb in a NickServ command.
+func redactIdentify(text string) string {
+	verb, _, _ := strings.Cut(text, " ")
+	switch strings.ToUpper(verb) {
+	case "IDENTIFY", "ID", "REGISTER", "GHOST", "RECOVER", "REGAIN", "GROUP":
+		return verb + " " + redacted
+	}
+	return text
+}
+
+// isMechanism returns true if s looks like a SASL mechanism name instead of a payload.
+func isMechanism(s string) bool {
+	switch s {
+	case "PLAIN", "EXTERNAL", "SCRAM-SHA-1", "SCRAM-SHA-256", "SCRAM-SHA-512", "ECDSA-NIST256P-CHALLENGE":
+		return true
+	}
+	return false
+}
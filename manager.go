@@ -0,0 +1,220 @@
+package flockerbot
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrDuplicateNetwork signals that a network name is already used in the Manager
+	ErrDuplicateNetwork = errors.New("Manager: Duplicate network")
+	// ErrUnknownNetwork signals that a network name is not known to the Manager
+	ErrUnknownNetwork = errors.New("Manager: Unknown network")
+)
+
+// NetworkEvent is an Event tagged with the network it occurred on.
+type NetworkEvent struct {
+	Event
+	Network string // Name of the network in the Manager.
+	Bot     *Bot   // Bot of the network, to reply on.
+}
+
+// NetworkStatus is the state of one network of a Manager.
+type NetworkStatus struct {
+	Network   string        // Name of the network.
+	Running   bool          // True if the manager keeps the bot connected.
+	Connected bool          // True if registration completed.
+	Nick      string        // Current nick.
+	Lag       time.Duration // Current lag.
+	Err       error         // Last error.
+}
+
+// Manager runs one logical bot on several networks. Events of all networks are passed to the
+// shared handlers, tagged with the network name.
+type Manager struct {
+	mutex    *sync.RWMutex
+	networks map[string]*network
+	handlers []func(ev NetworkEvent)
+}
+
+// network is a bot managed by a Manager.
+type network struct {
+	name    string
+	bot     *Bot
+	sub     *Subscription
+	running bool
+	cancel  context.CancelFunc // stops StayConnectedContext
+	done    chan struct{}      // closed when StayConnected returned
+	routed  chan struct{}      // closed when event routing stopped
+	err     error              // error returned by StayConnected
+}
+
+// NewManager returns an empty Manager.
+func NewManager() *Manager {
+	return &Manager{
+		mutex:    new(sync.RWMutex),
+		networks: make(map[string]*network),
+	}
+}
+
+// Handle adds a handler for events of all networks. Handlers are called from one goroutine per
+// network, so events of a single network arrive in order.
+func (m *Manager) Handle(handler func(ev NetworkEvent)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.handlers = append(m.handlers, handler)
+}
+
+// Add adds the bot b as network name. Events of b are routed to the handlers from now on, the bot
+// is connected by Start.
+func (m *Manager) Add(name string, b *Bot) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.networks[name]; ok {
+		return ErrDuplicateNetwork
+	}
+	b.Setup()
+	n := &network{
+		name:   name,
+		bot:    b,
+		sub:    b.Subscribe(nil),
+		routed: make(chan struct{}),
+	}
+	m.networks[name] = n
+	go m.route(n)
+	return nil
+}
+
+// Remove stops and removes network name.
+func (m *Manager) Remove(name string) error {
+	m.mutex.Lock()
+	n, ok := m.networks[name]
+	delete(m.networks, name)
+	m.mutex.Unlock()
+	if !ok {
+		return ErrUnknownNetwork
+	}
+	m.stop(n)
+	n.sub.Cancel()
+	<-n.routed
+	return nil
+}
+
+// Bot returns the bot of network name, or nil.
+func (m *Manager) Bot(name string) *Bot {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if n, ok := m.networks[name]; ok {
+		return n.bot
+	}
+	return nil
+}
+
+// Networks returns the sorted names of all networks.
+func (m *Manager) Networks() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	names := make([]string, 0, len(m.networks))
+	for name := range m.networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Start connects all networks that are not running yet and keeps them connected.
+func (m *Manager) Start() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, n := range m.networks {
+		if n.running {
+			continue
+		}
+		n.running = true
+		n.err = nil
+		n.done = make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		n.cancel = cancel
+		n.bot.SetAutoReconnect(true)
+		go func(n *network) {
+			err := n.bot.StayConnectedContext(ctx)
+			m.mutex.Lock()
+			n.err = err
+			n.running = false
+			m.mutex.Unlock()
+			close(n.done)
+		}(n)
+	}
+}
+
+// Stop disconnects all networks and waits until they are down.
+func (m *Manager) Stop() {
+	m.mutex.RLock()
+	networks := make([]*network, 0, len(m.networks))
+	for _, n := range m.networks {
+		networks = append(networks, n)
+	}
+	m.mutex.RUnlock()
+	var wg sync.WaitGroup
+	for _, n := range networks {
+		wg.Add(1)
+		go func(n *network) {
+			defer wg.Done()
+			m.stop(n)
+		}(n)
+	}
+	wg.Wait()
+}
+
+// stop disconnects n and waits for it. Cancelling the context also stops a reconnect that is
+// dialing or waiting, which Disconnect alone would miss.
+func (m *Manager) stop(n *network) {
+	m.mutex.RLock()
+	done, cancel := n.done, n.cancel
+	m.mutex.RUnlock()
+	if done == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// Status returns the state of all networks, sorted by name.
+func (m *Manager) Status() []NetworkStatus {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	status := make([]NetworkStatus, 0, len(m.networks))
+	for _, n := range m.networks {
+		err := n.err
+		if err == nil {
+			err = n.bot.Error()
+		}
+		status = append(status, NetworkStatus{
+			Network:   n.name,
+			Running:   n.running,
+			Connected: n.bot.Connected(),
+			Nick:      n.bot.CurrentNick(),
+			Lag:       n.bot.Lag(),
+			Err:       err,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Network < status[j].Network })
+	return status
+}
+
+// route passes the events of n to the handlers until the subscription is cancelled.
+func (m *Manager) route(n *network) {
+	defer close(n.routed)
+	for ev := range n.sub.C {
+		m.mutex.RLock()
+		handlers := m.handlers
+		m.mutex.RUnlock()
+		nev := NetworkEvent{Event: ev, Network: n.name, Bot: n.bot}
+		for _, h := range handlers {
+			h(nev)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package flockerbot
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+func TestManagerRouting(t *testing.T) {
+	m := NewManager()
+	got := make(chan NetworkEvent, 2)
+	m.Handle(func(ev NetworkEvent) {
+		got <- ev
+	})
+	libera, oftc := new(Bot), new(Bot)
+	if err := m.Add("libera", libera); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add("libera", oftc); err != ErrDuplicateNetwork {
+		t.Errorf("Expected ErrDuplicateNetwork, got %v", err)
+	}
+	m.Add("oftc", oftc)
+	oftc.emit(Event{Type: EventMessage, Message: irc.ParseMessage(":a!b@c PRIVMSG #x :hi")})
+	if ev := <-got; ev.Network != "oftc" || ev.Bot != oftc || ev.Message.Trailing != "hi" {
+		t.Errorf("Unexpected event %v", ev)
+	}
+	if names := m.Networks(); len(names) != 2 || names[0] != "libera" {
+		t.Errorf("Unexpected networks %v", names)
+	}
+	if status := m.Status(); status[1].Network != "oftc" || status[1].Running {
+		t.Errorf("Unexpected status %v", status)
+	}
+	if err := m.Remove("oftc"); err != nil {
+		t.Fatal(err)
+	}
+	if m.Bot("oftc") != nil || m.Remove("oftc") != ErrUnknownNetwork {
+		t.Error("Network not removed")
+	}
+}
+
+func TestManagerStopWhileDialing(t *testing.T) {
+	// A proxy that never answers keeps the bot dialing, where Disconnect cannot reach it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	m := NewManager()
+	m.Add("libera", &Bot{ConnectAddress: "irc.example:6667", Nick: "flocker", User: "flocker", Proxy: "http://" + ln.Addr().String()})
+	m.Start()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Bot did not dial")
+	}
+	if status := m.Status(); !status[0].Running {
+		t.Errorf("Unexpected status %v", status)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return while dialing")
+	}
+	if status := m.Status(); status[0].Running || status[0].Err != nil {
+		t.Errorf("Unexpected status after Stop %v", status)
+	}
+}
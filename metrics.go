@@ -0,0 +1,87 @@
+package flockerbot
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Metrics receives counters and observations from the bot. Implementations must be safe for
+// concurrent use. The metrics subpackage contains an implementation with Prometheus exposition.
+type Metrics interface {
+	LineIn(command string, bytes int)  // A line was received.
+	LineOut(command string, bytes int) // A line was sent.
+	Reconnect(cause string)            // The bot reconnects because of cause.
+	PingLatency(d time.Duration)       // Round-trip time of a PING sent by the bot.
+	SendQueue(depth int)               // Lines sent but not yet written to the connection.
+	HandlerLatency(d time.Duration)    // Time a handler call took.
+	HandlerPanic()                     // A handler panicked.
+}
+
+// metricLineOut counts the outgoing line data.
+func (b *Bot) metricLineOut(data string) {
+	if b.Metrics == nil {
+		return
+	}
+	_, line := cutTags(data)
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	command, _, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	b.Metrics.LineOut(strings.ToUpper(command), len(data))
+}
+
+// metricLineIn counts incoming line data.
+func (b *Bot) metricLineIn(command, data string) {
+	if b.Metrics != nil {
+		b.Metrics.LineIn(command, len(data))
+	}
+}
+
+// metricSendQueue reports the lines waiting to be written, both in socketChan and in sendQueue.
+// The caller holds sendMutex.
+func (b *Bot) metricSendQueue() {
+	if b.Metrics != nil {
+		b.Metrics.SendQueue(b.sendPending)
+	}
+}
+
+// reconnectCause classifies the error that ended a connection.
+func reconnectCause(err error) string {
+	var (
+		netErr       net.Error
+		dial         *DialError
+		tlsErr       *TLSError
+		registration *RegistrationError
+		banned       *BannedError
+		killed       *KilledError
+		server       *ServerError
+	)
+	switch {
+	case err == nil:
+		return "none"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrLag):
+		return "lag"
+	case errors.As(err, &dial):
+		return "dial"
+	case errors.As(err, &tlsErr):
+		return "tls"
+	case errors.As(err, &registration):
+		return "registration"
+	case errors.As(err, &banned):
+		return "banned"
+	case errors.As(err, &killed):
+		return "killed"
+	case errors.As(err, &server):
+		return "server_error"
+	case errors.Is(err, io.EOF):
+		return "eof"
+	case errors.As(err, &netErr):
+		return "network"
+	}
+	return "error"
+}
@@ -0,0 +1,227 @@
+// Package metrics implements a metrics collector for flockerbot that exposes its data in the
+// Prometheus text exposition format. One Registry can be shared by many bots, each bot gets its
+// own view via Registry.Bot, which satisfies the flockerbot.Metrics interface.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+var (
+	// LatencyBuckets are the histogram buckets (in seconds) used for ping and handler latency.
+	LatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+)
+
+// family is a metric name with all its labeled series.
+type family struct {
+	name   string
+	help   string
+	typ    string
+	series map[string]*series // keyed by rendered label set
+}
+
+// series is one labeled time series.
+type series struct {
+	labels  string
+	value   float64
+	buckets []uint64 // histogram only, not cumulative
+	sum     float64
+	count   uint64
+}
+
+// Registry collects metrics of one or more bots.
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*family
+	order    []string
+}
+
+// New returns a Registry with all flockerbot metrics defined.
+func New() *Registry {
+	r := &Registry{
+		families: make(map[string]*family),
+	}
+	r.define("flockerbot_lines_in_total", typeCounter, "Lines received, by command.")
+	r.define("flockerbot_bytes_in_total", typeCounter, "Bytes received, by command.")
+	r.define("flockerbot_lines_out_total", typeCounter, "Lines sent, by command.")
+	r.define("flockerbot_bytes_out_total", typeCounter, "Bytes sent, by command.")
+	r.define("flockerbot_reconnects_total", typeCounter, "Reconnects, by cause.")
+	r.define("flockerbot_ping_latency_seconds", typeHistogram, "Round-trip time of PINGs sent by the bot.")
+	r.define("flockerbot_send_queue_depth", typeGauge, "Messages waiting in the send queue.")
+	r.define("flockerbot_handler_duration_seconds", typeHistogram, "Time spent in message handlers.")
+	r.define("flockerbot_handler_panics_total", typeCounter, "Handler invocations that panicked.")
+	return r
+}
+
+func (r *Registry) define(name, typ, help string) {
+	r.families[name] = &family{name: name, help: help, typ: typ, series: make(map[string]*series)}
+	r.order = append(r.order, name)
+}
+
+// get returns the series of name with labels, creating it if necessary. Must be called with mutex held.
+func (r *Registry) get(name string, labels ...string) *series {
+	f := r.families[name]
+	key := renderLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key}
+		if f.typ == typeHistogram {
+			s.buckets = make([]uint64, len(LatencyBuckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (r *Registry) add(name string, v float64, labels ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.get(name, labels...).value += v
+}
+
+func (r *Registry) set(name string, v float64, labels ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.get(name, labels...).value = v
+}
+
+func (r *Registry) observe(name string, d time.Duration, labels ...string) {
+	v := d.Seconds()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := r.get(name, labels...)
+	for i, le := range LatencyBuckets {
+		if v <= le {
+			s.buckets[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// WriteTo writes all metrics in Prometheus text exposition format to w.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var sb strings.Builder
+	for _, name := range r.order {
+		f := r.families[name]
+		if len(f.series) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.series[k]
+			if f.typ != typeHistogram {
+				fmt.Fprintf(&sb, "%s{%s} %s\n", f.name, s.labels, formatFloat(s.value))
+				continue
+			}
+			var cum uint64
+			for i, le := range LatencyBuckets {
+				cum += s.buckets[i]
+				fmt.Fprintf(&sb, "%s_bucket{%s,le=\"%s\"} %d\n", f.name, s.labels, formatFloat(le), cum)
+			}
+			fmt.Fprintf(&sb, "%s_bucket{%s,le=\"+Inf\"} %d\n", f.name, s.labels, s.count)
+			fmt.Fprintf(&sb, "%s_sum{%s} %s\n", f.name, s.labels, formatFloat(s.sum))
+			fmt.Fprintf(&sb, "%s_count{%s} %d\n", f.name, s.labels, s.count)
+		}
+	}
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics for scraping.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Bot returns the metrics view for the bot called name. It implements flockerbot.Metrics.
+func (r *Registry) Bot(name string) *BotMetrics {
+	return &BotMetrics{r: r, bot: name}
+}
+
+// BotMetrics records the metrics of a single bot, labeled with its name.
+type BotMetrics struct {
+	r   *Registry
+	bot string
+}
+
+// LineIn counts a received line.
+func (m *BotMetrics) LineIn(command string, bytes int) {
+	m.r.add("flockerbot_lines_in_total", 1, "bot", m.bot, "command", command)
+	m.r.add("flockerbot_bytes_in_total", float64(bytes), "bot", m.bot, "command", command)
+}
+
+// LineOut counts a sent line.
+func (m *BotMetrics) LineOut(command string, bytes int) {
+	m.r.add("flockerbot_lines_out_total", 1, "bot", m.bot, "command", command)
+	m.r.add("flockerbot_bytes_out_total", float64(bytes), "bot", m.bot, "command", command)
+}
+
+// Reconnect counts a reconnect caused by cause.
+func (m *BotMetrics) Reconnect(cause string) {
+	m.r.add("flockerbot_reconnects_total", 1, "bot", m.bot, "cause", cause)
+}
+
+// PingLatency records the round-trip time of a PING.
+func (m *BotMetrics) PingLatency(d time.Duration) {
+	m.r.observe("flockerbot_ping_latency_seconds", d, "bot", m.bot)
+}
+
+// SendQueue records the current depth of the send queue.
+func (m *BotMetrics) SendQueue(depth int) {
+	m.r.set("flockerbot_send_queue_depth", float64(depth), "bot", m.bot)
+}
+
+// HandlerLatency records the time a handler call took.
+func (m *BotMetrics) HandlerLatency(d time.Duration) {
+	m.r.observe("flockerbot_handler_duration_seconds", d, "bot", m.bot)
+}
+
+// HandlerPanic counts a panicking handler.
+func (m *BotMetrics) HandlerPanic() {
+	m.r.add("flockerbot_handler_panics_total", 1, "bot", m.bot)
+}
+
+// renderLabels renders name/value pairs as a Prometheus label set.
+func renderLabels(labels []string) string {
+	var sb strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(labels[i])
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(labels[i+1]))
+		sb.WriteByte('"')
+	}
+	return sb.String()
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
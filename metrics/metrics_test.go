@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JonathanLogan/flockerbot"
+)
+
+var _ flockerbot.Metrics = (*BotMetrics)(nil)
+
+func TestExposition(t *testing.T) {
+	r := New()
+	m := r.Bot(`lib"era`)
+	m.LineIn("PRIVMSG", 40)
+	m.LineIn("PRIVMSG", 2)
+	m.Reconnect("timeout")
+	m.PingLatency(30 * time.Millisecond)
+	m.PingLatency(2 * time.Minute)
+	buf := new(bytes.Buffer)
+	r.WriteTo(buf)
+	out := buf.String()
+	for _, l := range []string{
+		"# TYPE flockerbot_lines_in_total counter",
+		`flockerbot_lines_in_total{bot="lib\"era",command="PRIVMSG"} 2`,
+		`flockerbot_bytes_in_total{bot="lib\"era",command="PRIVMSG"} 42`,
+		`flockerbot_reconnects_total{bot="lib\"era",cause="timeout"} 1`,
+		`flockerbot_ping_latency_seconds_bucket{bot="lib\"era",le="0.025"} 0`,
+		`flockerbot_ping_latency_seconds_bucket{bot="lib\"era",le="0.05"} 1`,
+		`flockerbot_ping_latency_seconds_bucket{bot="lib\"era",le="+Inf"} 2`,
+		`flockerbot_ping_latency_seconds_count{bot="lib\"era"} 2`,
+	} {
+		if !strings.Contains(out, l+"\n") {
+			t.Errorf("Missing line %s in:\n%s", l, out)
+		}
+	}
+	if strings.Contains(out, "flockerbot_handler_panics_total") {
+		t.Error("Empty families must not be exposed")
+	}
+}
@@ -0,0 +1,225 @@
+package flockerbot
+
+import (
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// maxModeLine is the length of a MODE line after which SetModes starts a new one.
+const maxModeLine = 400
+
+// ModeType is the kind of a channel mode, as announced in CHANMODES and PREFIX.
+type ModeType int
+
+const (
+	// ModeFlag is a mode without parameter, e.g. +n (type D).
+	ModeFlag ModeType = iota
+	// ModeList is a list mode, e.g. +b (type A). It always has a parameter.
+	ModeList
+	// ModeParam is a setting that always has a parameter, e.g. +k (type B).
+	ModeParam
+	// ModeSetParam is a setting that has a parameter only when set, e.g. +l (type C).
+	ModeSetParam
+	// ModeStatus is a member status, e.g. +o. The parameter is the nick.
+	ModeStatus
+)
+
+// ModeChange is a single mode change of a MODE message.
+type ModeChange struct {
+	Add   bool     // True for +, false for -.
+	Mode  byte     // Mode letter.
+	Type  ModeType // Kind of mode.
+	Param string   // Parameter, if the mode takes one.
+}
+
+// String returns the change as it is sent, e.g. "+o alice".
+func (mc ModeChange) String() string {
+	s := "-"
+	if mc.Add {
+		s = "+"
+	}
+	s += string(mc.Mode)
+	if mc.Param != "" {
+		s += " " + mc.Param
+	}
+	return s
+}
+
+// modeType returns the type of channel mode m.
+func (is *ISupport) modeType(m byte) ModeType {
+	status, _ := is.Prefix()
+	if strings.IndexByte(status, m) >= 0 {
+		return ModeStatus
+	}
+	list, always, onSet, _ := is.ChanModes()
+	switch {
+	case strings.IndexByte(list, m) >= 0:
+		return ModeList
+	case strings.IndexByte(always, m) >= 0:
+		return ModeParam
+	case strings.IndexByte(onSet, m) >= 0:
+		return ModeSetParam
+	}
+	return ModeFlag
+}
+
+// ParseModes parses a channel mode string like "+ov-b" with its parameters. Unknown modes are
+// treated as flags. A list mode without parameter, as in "MODE #chan +b", is returned with an
+// empty Param.
+func (is *ISupport) ParseModes(modes string, params []string) []ModeChange {
+	var changes []ModeChange
+	add := true
+	for i := 0; i < len(modes); i++ {
+		m := modes[i]
+		switch m {
+		case '+':
+			add = true
+			continue
+		case '-':
+			add = false
+			continue
+		}
+		mc := ModeChange{Add: add, Mode: m, Type: is.modeType(m)}
+		if mc.takesParam() && len(params) > 0 {
+			mc.Param = params[0]
+			params = params[1:]
+		}
+		changes = append(changes, mc)
+	}
+	return changes
+}
+
+// takesParam returns true if the change has a parameter.
+func (mc ModeChange) takesParam() bool {
+	switch mc.Type {
+	case ModeList, ModeParam, ModeStatus:
+		return true
+	case ModeSetParam:
+		return mc.Add
+	}
+	return false
+}
+
+// ParseModes returns the mode changes of a MODE message or RPL_CHANNELMODEIS (324), using the
+// modes announced by the server. User mode changes are returned as flags.
+func (b *Bot) ParseModes(msg *irc.Message) []ModeChange {
+	p := params(msg)
+	if msg.Command == "324" && len(p) > 0 {
+		p = p[1:]
+	}
+	if len(p) < 2 {
+		return nil
+	}
+	is := b.ISupport()
+	if !is.IsChannel(p[0]) {
+		return parseUserModes(p[1])
+	}
+	return is.ParseModes(p[1], p[2:])
+}
+
+// parseUserModes returns a user mode change as flags.
+func parseUserModes(modes string) []ModeChange {
+	var changes []ModeChange
+	add := true
+	for i := 0; i < len(modes); i++ {
+		switch modes[i] {
+		case '+':
+			add = true
+		case '-':
+			add = false
+		default:
+			changes = append(changes, ModeChange{Add: add, Mode: modes[i]})
+		}
+	}
+	return changes
+}
+
+// formatModes returns changes as a MODE line for target.
+func formatModes(target string, changes []ModeChange) string {
+	var modes strings.Builder
+	var args []string
+	sign := byte(0)
+	for _, mc := range changes {
+		s := byte('-')
+		if mc.Add {
+			s = '+'
+		}
+		if s != sign {
+			modes.WriteByte(s)
+			sign = s
+		}
+		modes.WriteByte(mc.Mode)
+		if mc.Param != "" {
+			args = append(args, mc.Param)
+		}
+	}
+	line := "MODE " + target + " " + modes.String()
+	if len(args) > 0 {
+		line += " " + strings.Join(args, " ")
+	}
+	return line
+}
+
+// SetModes sends changes to channel, packing as many changes per line as the server's MODES
+// limit allows.
+func (b *Bot) SetModes(channel string, changes ...ModeChange) {
+	limit := b.ISupport().Modes()
+	var batch []ModeChange
+	withParam := 0
+	for _, mc := range changes {
+		hasParam := mc.Param != ""
+		if len(batch) > 0 && ((hasParam && limit > 0 && withParam == limit) ||
+			len(formatModes(channel, append(batch[:len(batch):len(batch)], mc))) > maxModeLine) {
+			b.SendString(formatModes(channel, batch))
+			batch, withParam = nil, 0
+		}
+		batch = append(batch, mc)
+		if hasParam {
+			withParam++
+		}
+	}
+	if len(batch) > 0 {
+		b.SendString(formatModes(channel, batch))
+	}
+}
+
+// setMode sets or unsets mode for each param on channel.
+func (b *Bot) setMode(channel string, add bool, mode byte, params []string) {
+	changes := make([]ModeChange, len(params))
+	is := b.ISupport()
+	for i, p := range params {
+		changes[i] = ModeChange{Add: add, Mode: mode, Type: is.modeType(mode), Param: p}
+	}
+	b.SetModes(channel, changes...)
+}
+
+// Op gives channel operator status to nicks.
+func (b *Bot) Op(channel string, nicks ...string) {
+	b.setMode(channel, true, 'o', nicks)
+}
+
+// Deop takes channel operator status from nicks.
+func (b *Bot) Deop(channel string, nicks ...string) {
+	b.setMode(channel, false, 'o', nicks)
+}
+
+// Voice gives voice to nicks.
+func (b *Bot) Voice(channel string, nicks ...string) {
+	b.setMode(channel, true, 'v', nicks)
+}
+
+// Devoice takes voice from nicks.
+func (b *Bot) Devoice(channel string, nicks ...string) {
+	b.setMode(channel, false, 'v', nicks)
+}
+
+// Ban bans masks from channel.
+func (b *Bot) Ban(channel string, masks ...string) {
+	b.setMode(channel, true, 'b', masks)
+}
+
+// Unban removes bans on masks from channel.
+func (b *Bot) Unban(channel string, masks ...string) {
+	b.setMode(channel, false, 'b', masks)
+}
@@ -0,0 +1,51 @@
+package flockerbot
+
+import (
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestParseModes(t *testing.T) {
+	b := testBot("flocker")
+	b.track(irc.ParseMessage(":irc.example 005 flocker CHANMODES=beIq,k,lf,imnpst PREFIX=(qaohv)~&@%+ MODES=4 NETWORK=Example\\x20Net :are supported by this server"), nil)
+	is := b.ISupport()
+	if is.Modes() != 4 || is.Network() != "Example Net" {
+		t.Errorf("Unexpected ISUPPORT %d %q", is.Modes(), is.Network())
+	}
+	changes := b.ParseModes(irc.ParseMessage(":alice!a@h MODE #flocker +ovl-bk+n alice bob 10 *!*@x key"))
+	want := []ModeChange{
+		{Add: true, Mode: 'o', Type: ModeStatus, Param: "alice"},
+		{Add: true, Mode: 'v', Type: ModeStatus, Param: "bob"},
+		{Add: true, Mode: 'l', Type: ModeSetParam, Param: "10"},
+		{Add: false, Mode: 'b', Type: ModeList, Param: "*!*@x"},
+		{Add: false, Mode: 'k', Type: ModeParam, Param: "key"},
+		{Add: true, Mode: 'n', Type: ModeFlag},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Got %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("Change %d: got %v, want %v", i, changes[i], want[i])
+		}
+	}
+	if changes := b.ParseModes(irc.ParseMessage(":flocker MODE flocker :+iw-x")); len(changes) != 3 || changes[2].Add {
+		t.Errorf("Unexpected user modes %v", changes)
+	}
+}
+
+func TestSetModes(t *testing.T) {
+	b := testBot("flocker")
+	b.Op("#flocker", "a", "b", "c", "d")
+	if l := nextLine(t, b); l != "MODE #flocker +ooo a b c" {
+		t.Errorf("Unexpected line %q", l)
+	}
+	if l := nextLine(t, b); l != "MODE #flocker +o d" {
+		t.Errorf("Unexpected line %q", l)
+	}
+	b.SetModes("#flocker", ModeChange{Add: true, Mode: 'm'}, ModeChange{Add: false, Mode: 'v', Param: "a"}, ModeChange{Add: true, Mode: 'b', Param: "*!*@x"})
+	if l := nextLine(t, b); l != "MODE #flocker +m-v+b a *!*@x" {
+		t.Errorf("Unexpected line %q", l)
+	}
+}
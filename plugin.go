@@ -0,0 +1,527 @@
+package flockerbot
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrDuplicatePlugin signals that a plugin of the same name is already registered
+	ErrDuplicatePlugin = errors.New("Bot: Duplicate plugin")
+	// ErrUnknownPlugin signals that no plugin of that name is registered
+	ErrUnknownPlugin = errors.New("Bot: Unknown plugin")
+	// ErrDuplicateCommand signals that a plugin command is already registered with the router
+	ErrDuplicateCommand = errors.New("Bot: Duplicate command")
+	// ErrPluginConfig signals an unknown option or an invalid value in a plugin configuration
+	ErrPluginConfig = errors.New("Bot: Invalid plugin configuration")
+)
+
+// Plugin is a feature that can be added to a bot with Plugins. Init registers the plugin's
+// commands and event handlers, Start and Stop are called when the bot connects and disconnects.
+// The calls of all plugins are made in order on a goroutine of their own. Stop must not send: on
+// a disconnect, the connection is gone by then.
+type Plugin interface {
+	Name() string                  // Unique name, also the storage namespace.
+	Init(pc *PluginContext) error  // Called once on registration.
+	Start(pc *PluginContext) error // Called when the bot is registered on the server.
+	Stop(pc *PluginContext) error  // Called when the connection is lost and on Unregister. Must not send.
+}
+
+// Configurable is implemented by plugins with options. The configuration passed to Register is
+// checked against the schema before Init.
+type Configurable interface {
+	Schema() []ConfigField
+}
+
+// ConfigType is the type of a plugin option.
+type ConfigType int
+
+const (
+	// ConfigString is any text.
+	ConfigString ConfigType = iota
+	// ConfigInt is an integer.
+	ConfigInt
+	// ConfigBool is a boolean as understood by strconv.ParseBool.
+	ConfigBool
+	// ConfigDuration is a duration as understood by time.ParseDuration.
+	ConfigDuration
+	// ConfigList is a comma separated list.
+	ConfigList
+)
+
+// ConfigField describes a plugin option.
+type ConfigField struct {
+	Name    string     // Option name.
+	Type    ConfigType // Value type.
+	Default string     // Value if not configured.
+	Help    string     // Description.
+}
+
+// check returns an error if value is not valid for the field.
+func (f ConfigField) check(value string) error {
+	var err error
+	switch f.Type {
+	case ConfigInt:
+		_, err = strconv.Atoi(value)
+	case ConfigBool:
+		_, err = strconv.ParseBool(value)
+	case ConfigDuration:
+		_, err = time.ParseDuration(value)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrPluginConfig, f.Name, err)
+	}
+	return nil
+}
+
+// PluginContext is a plugin's access to the bot. It is passed to all lifecycle methods.
+type PluginContext struct {
+	Bot *Bot // The bot the plugin runs on.
+
+	plugins  *Plugins
+	plugin   Plugin
+	name     string
+	config   map[string]string
+	schema   map[string]ConfigField
+	commands []string
+	handlers []pluginHandler
+	running  bool
+}
+
+// pluginHandler is an event handler registered with PluginContext.On.
+type pluginHandler struct {
+	filter  func(Event) bool
+	handler func(Event)
+}
+
+// Name returns the plugin name.
+func (pc *PluginContext) Name() string {
+	return pc.name
+}
+
+// Command registers cmd with the router. The handler is only run in channels in which the plugin
+// is enabled; private messages are always handled.
+func (pc *PluginContext) Command(cmd Command) error {
+	r := pc.plugins.Router
+	key := strings.ToLower(cmd.Name)
+	r.mutex.RLock()
+	_, exists := r.commands[key]
+	r.mutex.RUnlock()
+	if exists {
+		return ErrDuplicateCommand
+	}
+	handler := cmd.Handler
+	cmd.Handler = func(c *CommandContext) {
+		if pc.Enabled(c.Target) {
+			handler(c)
+		}
+	}
+	r.Add(cmd)
+	pc.plugins.mutex.Lock()
+	pc.commands = append(pc.commands, key)
+	pc.plugins.mutex.Unlock()
+	return nil
+}
+
+// On registers handler for the events matching filter, nil for all. Events of a channel in
+// which the plugin is disabled are skipped. Handlers of all plugins run in one goroutine, in
+// the order of the events.
+func (pc *PluginContext) On(filter func(Event) bool, handler func(ev Event)) {
+	pc.plugins.mutex.Lock()
+	defer pc.plugins.mutex.Unlock()
+	pc.handlers = append(pc.handlers, pluginHandler{filter: filter, handler: handler})
+}
+
+// Bucket returns the storage namespace of the plugin, or a sub-namespace of it if namespace is
+// not empty.
+func (pc *PluginContext) Bucket(namespace string) *Bucket {
+	if namespace == "" {
+		return pc.Bot.Bucket(pc.name)
+	}
+	return pc.Bot.Bucket(pc.name + "/" + namespace)
+}
+
+// Config returns the value of option name, or its default.
+func (pc *PluginContext) Config(name string) string {
+	if value, ok := pc.config[name]; ok {
+		return value
+	}
+	return pc.schema[name].Default
+}
+
+// ConfigInt returns option name as integer, 0 if it is not valid.
+func (pc *PluginContext) ConfigInt(name string) int {
+	n, _ := strconv.Atoi(pc.Config(name))
+	return n
+}
+
+// ConfigBool returns option name as boolean.
+func (pc *PluginContext) ConfigBool(name string) bool {
+	v, _ := strconv.ParseBool(pc.Config(name))
+	return v
+}
+
+// ConfigDuration returns option name as duration.
+func (pc *PluginContext) ConfigDuration(name string) time.Duration {
+	d, _ := time.ParseDuration(pc.Config(name))
+	return d
+}
+
+// ConfigList returns option name split at commas, without empty elements.
+func (pc *PluginContext) ConfigList(name string) []string {
+	var list []string
+	for _, e := range strings.Split(pc.Config(name), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// Enabled returns true if the plugin is enabled in channel. Targets that are no channels are
+// always enabled.
+func (pc *PluginContext) Enabled(channel string) bool {
+	return pc.plugins.Enabled(pc.name, channel)
+}
+
+// Plugins runs plugins on a bot. Plugins are started when the bot registers on the server and
+// stopped when it disconnects. Each plugin can be disabled per channel at runtime; if the bot has
+// a Store, these settings are kept in its "plugins" namespace.
+type Plugins struct {
+	Bot    *Bot    // The bot.
+	Router *Router // Router for plugin commands. Set it as the bot's TagsHandler, see Router.TagsHandler.
+
+	mutex    sync.RWMutex
+	plugins  map[string]*PluginContext
+	order    []string                   // names in registration order
+	disabled map[string]map[string]bool // plugin name to folded channels
+	sub      *Subscription
+	unhook   func() // Removes the lifecycle hook.
+	done     chan struct{}
+
+	lifeMutex  sync.Mutex
+	lifeQueue  []EventType   // EventConnected and EventDisconnected not handled yet.
+	lifeWake   chan struct{} // Signals runLifecycle that lifeQueue is not empty.
+	lifeDone   chan struct{} // Closed when runLifecycle returns.
+	lifeClosed bool          // True after Close.
+}
+
+// NewPlugins returns an empty plugin set for b, with commands registered on r.
+func NewPlugins(b *Bot, r *Router) *Plugins {
+	ps := &Plugins{
+		Bot:      b,
+		Router:   r,
+		plugins:  make(map[string]*PluginContext),
+		disabled: make(map[string]map[string]bool),
+		sub:      b.Subscribe(nil),
+		done:     make(chan struct{}),
+		lifeWake: make(chan struct{}, 1),
+		lifeDone: make(chan struct{}),
+	}
+	// The lifecycle does not go through the subscription, which drops events when full.
+	ps.unhook = b.onLifecycle(ps.lifecycle)
+	go ps.route()
+	go ps.runLifecycle()
+	return ps
+}
+
+// Register checks config against the plugin's schema and initializes p. If the bot is
+// connected, p is started right away.
+func (ps *Plugins) Register(p Plugin, config map[string]string) error {
+	name := p.Name()
+	pc := &PluginContext{Bot: ps.Bot, plugins: ps, plugin: p, name: name, config: config, schema: make(map[string]ConfigField)}
+	if c, ok := p.(Configurable); ok {
+		for _, f := range c.Schema() {
+			pc.schema[f.Name] = f
+		}
+	}
+	for key, value := range config {
+		f, ok := pc.schema[key]
+		if !ok {
+			return fmt.Errorf("%w: %s: unknown option %s", ErrPluginConfig, name, key)
+		}
+		if err := f.check(value); err != nil {
+			return err
+		}
+	}
+	ps.mutex.Lock()
+	if _, ok := ps.plugins[name]; ok {
+		ps.mutex.Unlock()
+		return ErrDuplicatePlugin
+	}
+	ps.plugins[name] = pc
+	ps.order = append(ps.order, name)
+	ps.mutex.Unlock()
+	ps.loadDisabled(name)
+	if err := p.Init(pc); err != nil {
+		ps.remove(pc)
+		return err
+	}
+	if ps.Bot.Connected() {
+		ps.start(pc)
+	}
+	return nil
+}
+
+// Unregister stops plugin name and removes its commands and handlers.
+func (ps *Plugins) Unregister(name string) error {
+	ps.mutex.RLock()
+	pc, ok := ps.plugins[name]
+	ps.mutex.RUnlock()
+	if !ok {
+		return ErrUnknownPlugin
+	}
+	ps.stop(pc)
+	ps.remove(pc)
+	return nil
+}
+
+// remove forgets pc and its commands.
+func (ps *Plugins) remove(pc *PluginContext) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	for _, c := range pc.commands {
+		ps.Router.Remove(c)
+	}
+	delete(ps.plugins, pc.name)
+	for i, n := range ps.order {
+		if n == pc.name {
+			ps.order = append(ps.order[:i], ps.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Names returns the names of the registered plugins, in registration order.
+func (ps *Plugins) Names() []string {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	return append([]string(nil), ps.order...)
+}
+
+// Schema returns the options of plugin name.
+func (ps *Plugins) Schema(name string) ([]ConfigField, error) {
+	ps.mutex.RLock()
+	pc, ok := ps.plugins[name]
+	ps.mutex.RUnlock()
+	if !ok {
+		return nil, ErrUnknownPlugin
+	}
+	fields := make([]ConfigField, 0, len(pc.schema))
+	for _, f := range pc.schema {
+		fields = append(fields, f)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields, nil
+}
+
+// Enable enables plugin name in channel.
+func (ps *Plugins) Enable(name, channel string) error {
+	return ps.setDisabled(name, channel, false)
+}
+
+// Disable disables plugin name in channel. Its commands and event handlers ignore the channel.
+func (ps *Plugins) Disable(name, channel string) error {
+	return ps.setDisabled(name, channel, true)
+}
+
+// Enabled returns true if plugin name is registered and not disabled in channel. Targets that
+// are no channels are always enabled.
+func (ps *Plugins) Enabled(name, channel string) bool {
+	key := ""
+	if ps.Bot.ISupport().IsChannel(channel) {
+		key = ps.Bot.Fold(channel)
+	}
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	if _, ok := ps.plugins[name]; !ok {
+		return false
+	}
+	return key == "" || !ps.disabled[name][key]
+}
+
+// setDisabled records and stores the state of plugin name in channel.
+func (ps *Plugins) setDisabled(name, channel string, disabled bool) error {
+	key := ps.Bot.Fold(channel)
+	ps.mutex.Lock()
+	if _, ok := ps.plugins[name]; !ok {
+		ps.mutex.Unlock()
+		return ErrUnknownPlugin
+	}
+	if ps.disabled[name] == nil {
+		ps.disabled[name] = make(map[string]bool)
+	}
+	if disabled {
+		ps.disabled[name][key] = true
+	} else {
+		delete(ps.disabled[name], key)
+	}
+	channels := make([]string, 0, len(ps.disabled[name]))
+	for c := range ps.disabled[name] {
+		channels = append(channels, c)
+	}
+	ps.mutex.Unlock()
+	if ps.Bot.Store == nil {
+		return nil
+	}
+	sort.Strings(channels)
+	return ps.Bot.Bucket("plugins").PutJSON("disabled/"+name, channels)
+}
+
+// loadDisabled reads the channels plugin name is disabled in from the Store.
+func (ps *Plugins) loadDisabled(name string) {
+	if ps.Bot.Store == nil {
+		return
+	}
+	var channels []string
+	if ok, err := ps.Bot.Bucket("plugins").GetJSON("disabled/"+name, &channels); !ok || err != nil {
+		return
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.disabled[name] = make(map[string]bool)
+	for _, c := range channels {
+		ps.disabled[name][c] = true
+	}
+}
+
+// Close stops all plugins and the event routing. The plugins stay registered.
+func (ps *Plugins) Close() {
+	ps.unhook()
+	ps.lifeMutex.Lock()
+	ps.lifeClosed = true
+	close(ps.lifeWake)
+	ps.lifeMutex.Unlock()
+	<-ps.lifeDone
+	ps.sub.Cancel()
+	<-ps.done
+	for _, pc := range ps.contexts() {
+		ps.stop(pc)
+	}
+}
+
+// contexts returns the plugin contexts in registration order.
+func (ps *Plugins) contexts() []*PluginContext {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	contexts := make([]*PluginContext, 0, len(ps.order))
+	for _, name := range ps.order {
+		contexts = append(contexts, ps.plugins[name])
+	}
+	return contexts
+}
+
+// start starts pc unless it is running.
+func (ps *Plugins) start(pc *PluginContext) {
+	ps.mutex.Lock()
+	if pc.running {
+		ps.mutex.Unlock()
+		return
+	}
+	pc.running = true
+	ps.mutex.Unlock()
+	if err := pc.plugin.Start(pc); err != nil {
+		ps.Bot.logError("plugin start failed", err, "plugin", pc.name)
+	}
+}
+
+// stop stops pc if it is running.
+func (ps *Plugins) stop(pc *PluginContext) {
+	ps.mutex.Lock()
+	if !pc.running {
+		ps.mutex.Unlock()
+		return
+	}
+	pc.running = false
+	ps.mutex.Unlock()
+	if err := pc.plugin.Stop(pc); err != nil {
+		ps.Bot.logError("plugin stop failed", err, "plugin", pc.name)
+	}
+}
+
+// lifecycle queues ev for runLifecycle. It is called by the bot's read loop, which it must not
+// block.
+func (ps *Plugins) lifecycle(ev Event) {
+	ps.lifeMutex.Lock()
+	defer ps.lifeMutex.Unlock()
+	if ps.lifeClosed {
+		return
+	}
+	ps.lifeQueue = append(ps.lifeQueue, ev.Type)
+	select {
+	case ps.lifeWake <- struct{}{}:
+	default:
+	}
+}
+
+// runLifecycle starts the plugins on EventConnected and stops them on EventDisconnected, in the
+// order of the events.
+func (ps *Plugins) runLifecycle() {
+	defer close(ps.lifeDone)
+	for range ps.lifeWake {
+		for {
+			ps.lifeMutex.Lock()
+			if len(ps.lifeQueue) == 0 {
+				ps.lifeMutex.Unlock()
+				break
+			}
+			typ := ps.lifeQueue[0]
+			ps.lifeQueue = ps.lifeQueue[1:]
+			ps.lifeMutex.Unlock()
+			for _, pc := range ps.contexts() {
+				if typ == EventConnected {
+					ps.start(pc)
+				} else {
+					ps.stop(pc)
+				}
+			}
+		}
+	}
+}
+
+// route runs the event handlers of the plugins.
+func (ps *Plugins) route() {
+	defer close(ps.done)
+	for ev := range ps.sub.C {
+		channel := eventChannel(ps.Bot, ev)
+		for _, pc := range ps.contexts() {
+			if channel != "" && !pc.Enabled(channel) {
+				continue
+			}
+			ps.mutex.RLock()
+			handlers := pc.handlers
+			ps.mutex.RUnlock()
+			for _, h := range handlers {
+				if h.filter == nil || h.filter(ev) {
+					ps.runHandler(pc, h, ev)
+				}
+			}
+		}
+	}
+}
+
+// runHandler calls h, logging a panic instead of taking down the routing.
+func (ps *Plugins) runHandler(pc *PluginContext, h pluginHandler, ev Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			ps.Bot.logError("plugin handler panic", fmt.Errorf("%v", r), "plugin", pc.name)
+		}
+	}()
+	h.handler(ev)
+}
+
+// eventChannel returns the channel ev happened in, or "" if it is not about a channel.
+func eventChannel(b *Bot, ev Event) string {
+	if ev.Channel != "" {
+		return ev.Channel
+	}
+	if ev.Message != nil && len(ev.Message.Params) > 0 && b.ISupport().IsChannel(ev.Message.Params[0]) {
+		return ev.Message.Params[0]
+	}
+	return ""
+}
@@ -0,0 +1,214 @@
+package flockerbot
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// echoPlugin repeats its command's arguments and counts the joins it sees.
+type echoPlugin struct {
+	lifecycle chan string
+	joins     chan string
+}
+
+func (p *echoPlugin) Name() string { return "echo" }
+
+func (p *echoPlugin) Schema() []ConfigField {
+	return []ConfigField{
+		{Name: "prefix", Default: "> ", Help: "Prefix of replies."},
+		{Name: "max", Type: ConfigInt, Default: "3", Help: "Maximum number of words."},
+	}
+}
+
+func (p *echoPlugin) Init(pc *PluginContext) error {
+	pc.On(FilterCommand("JOIN"), func(ev Event) {
+		p.joins <- ev.Message.Params[0]
+	})
+	return pc.Command(Command{Name: "echo", Public: true, Handler: func(c *CommandContext) {
+		if len(c.Args) > pc.ConfigInt("max") {
+			c.Args = c.Args[:pc.ConfigInt("max")]
+		}
+		c.Reply(pc.Config("prefix") + c.Args[0])
+	}})
+}
+
+func (p *echoPlugin) Start(pc *PluginContext) error {
+	p.lifecycle <- "start"
+	return pc.Bucket("").Put("started", []byte("yes"))
+}
+
+func (p *echoPlugin) Stop(pc *PluginContext) error {
+	p.lifecycle <- "stop"
+	return nil
+}
+
+func TestPlugins(t *testing.T) {
+	b := testBot("flocker")
+	b.Store = NewMemoryStore()
+	ps := NewPlugins(b, NewRouter("!"))
+	defer ps.Close()
+	p := &echoPlugin{lifecycle: make(chan string, 4), joins: make(chan string, 4)}
+	if err := ps.Register(p, map[string]string{"max": "many"}); !errors.Is(err, ErrPluginConfig) {
+		t.Errorf("Expected config error, got %v", err)
+	}
+	if err := ps.Register(p, map[string]string{"prefix": "echo: "}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Register(p, nil); err != ErrDuplicatePlugin {
+		t.Errorf("Expected ErrDuplicatePlugin, got %v", err)
+	}
+	// testBot is connected, so the plugin starts right away.
+	if s := <-p.lifecycle; s != "start" {
+		t.Errorf("Unexpected lifecycle call %s", s)
+	}
+	if v, _, _ := b.Bucket("echo").Get("started"); string(v) != "yes" {
+		t.Error("Plugin storage not namespaced")
+	}
+
+	ps.Router.Dispatch(b, irc.ParseMessage(":alice!a@h PRIVMSG #flocker :!echo hi"))
+	if l := nextLine(t, b); l != "PRIVMSG #flocker :echo: hi" {
+		t.Errorf("Unexpected reply %q", l)
+	}
+	if err := ps.Disable("echo", "#Flocker"); err != nil {
+		t.Fatal(err)
+	}
+	ps.Router.Dispatch(b, irc.ParseMessage(":alice!a@h PRIVMSG #flocker :!echo hi"))
+	ps.Router.Dispatch(b, irc.ParseMessage(":alice!a@h PRIVMSG flocker :!echo private"))
+	if l := nextLine(t, b); l != "PRIVMSG alice :echo: private" {
+		t.Errorf("Disabled channel not skipped: %q", l)
+	}
+	b.dispatch(irc.ParseMessage(":alice!a@h JOIN #flocker"))
+	b.emit(Event{Type: EventMessage, Message: irc.ParseMessage(":alice!a@h JOIN #history"), history: true})
+	b.dispatch(irc.ParseMessage(":alice!a@h JOIN #other"))
+	if c := <-p.joins; c != "#other" {
+		t.Errorf("Event of disabled channel handled: %s", c)
+	}
+
+	// The setting survives a restart of the bot.
+	ps2 := NewPlugins(b, NewRouter("!"))
+	defer ps2.Close()
+	if err := ps2.Register(&echoPlugin{lifecycle: make(chan string, 4), joins: make(chan string, 4)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ps2.Enabled("echo", "#flocker") || !ps2.Enabled("echo", "#other") {
+		t.Error("Disabled channels not restored")
+	}
+
+	b.emit(Event{Type: EventDisconnected})
+	if s := <-p.lifecycle; s != "stop" {
+		t.Errorf("Unexpected lifecycle call %s", s)
+	}
+	b.emit(Event{Type: EventConnected})
+	if s := <-p.lifecycle; s != "start" {
+		t.Errorf("Unexpected lifecycle call %s", s)
+	}
+	if err := ps.Unregister("echo"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-p.lifecycle:
+		if s != "stop" {
+			t.Errorf("Unexpected lifecycle call %s", s)
+		}
+	case <-time.After(time.Second):
+		t.Error("Not stopped on Unregister")
+	}
+	if len(ps.Router.Commands()) != 0 {
+		t.Error("Commands not removed")
+	}
+}
+
+// blockingPlugin blocks its event handler until release is closed, and Start until hold is
+// closed if it is set.
+type blockingPlugin struct {
+	lifecycle chan string
+	release   chan struct{}
+	hold      chan struct{}
+}
+
+func (p *blockingPlugin) Name() string { return "blocking" }
+
+func (p *blockingPlugin) Init(pc *PluginContext) error {
+	pc.On(nil, func(ev Event) {
+		<-p.release
+	})
+	return nil
+}
+
+func (p *blockingPlugin) Start(pc *PluginContext) error {
+	if p.hold != nil {
+		<-p.hold
+	}
+	p.lifecycle <- "start"
+	return nil
+}
+
+func (p *blockingPlugin) Stop(pc *PluginContext) error {
+	p.lifecycle <- "stop"
+	return nil
+}
+
+func TestPluginLifecycleNotDropped(t *testing.T) {
+	b := testBot("flocker")
+	ps := NewPlugins(b, NewRouter("!"))
+	defer ps.Close()
+	p := &blockingPlugin{lifecycle: make(chan string, 4), release: make(chan struct{})}
+	if err := ps.Register(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-p.lifecycle
+	// Overflow the subscription while the handler is stuck.
+	for i := 0; i <= EventBuffer+1; i++ {
+		b.dispatch(irc.ParseMessage(":alice!a@h PRIVMSG #flocker :spam"))
+	}
+	b.emit(Event{Type: EventDisconnected})
+	b.emit(Event{Type: EventConnected})
+	close(p.release)
+	for _, want := range []string{"stop", "start"} {
+		select {
+		case s := <-p.lifecycle:
+			if s != want {
+				t.Errorf("Got lifecycle call %s, want %s", s, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Lifecycle call %s lost", want)
+		}
+	}
+}
+
+func TestPluginStartDoesNotBlockBot(t *testing.T) {
+	b := testBot("flocker")
+	b.setConnected(false)
+	ps := NewPlugins(b, NewRouter("!"))
+	defer ps.Close()
+	p := &blockingPlugin{lifecycle: make(chan string, 4), release: make(chan struct{}), hold: make(chan struct{})}
+	close(p.release)
+	if err := ps.Register(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		b.emit(Event{Type: EventConnected})
+		b.emit(Event{Type: EventDisconnected})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("A blocking Start stalled the bot")
+	}
+	close(p.hold)
+	for _, want := range []string{"start", "stop"} {
+		select {
+		case s := <-p.lifecycle:
+			if s != want {
+				t.Errorf("Got lifecycle call %s, want %s", s, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Lifecycle call %s lost", want)
+		}
+	}
+}
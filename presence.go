@@ -0,0 +1,302 @@
+package flockerbot
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// maxPresenceLine is the length of MONITOR, WATCH and ISON lines after which a new one is started.
+const maxPresenceLine = 400
+
+// defaultISONInterval is the ISON polling interval if ISONInterval is not set.
+const defaultISONInterval = 60 * time.Second
+
+// presenceMethod is how the online status of nicks is learned.
+type presenceMethod int
+
+const (
+	presenceISON presenceMethod = iota
+	presenceMonitor
+	presenceWatch
+)
+
+// presence is the list of nicks to watch. It survives reconnects; the online status does not.
+type presence struct {
+	mutex    sync.Mutex
+	nicks    map[string]string // folded to nick as given
+	armed    map[string]bool   // folded nicks handed to MONITOR or WATCH
+	online   map[string]bool   // folded nicks known to be online
+	method   presenceMethod
+	limit    int        // server limit for MONITOR or WATCH, 0 for none
+	ready    bool       // true once armed on the current connection
+	polls    [][]string // ISON requests waiting for their reply, oldest first
+	lastISON time.Time
+}
+
+// presenceList returns the presence list, creating it.
+func (b *Bot) presenceList() *presence {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.presence == nil {
+		b.presence = &presence{nicks: make(map[string]string), armed: make(map[string]bool), online: make(map[string]bool)}
+	}
+	return b.presence
+}
+
+// Monitor adds nicks to the presence list. EventOnline and EventOffline are emitted when they
+// come online or go offline. MONITOR is used if the server supports it, otherwise WATCH, and ISON
+// polling every ISONInterval as last resort or for nicks beyond the server's limit. The list
+// is kept across reconnects.
+func (b *Bot) Monitor(nicks ...string) {
+	pr := b.presenceList()
+	pr.mutex.Lock()
+	var added []string
+	for _, nick := range nicks {
+		key := b.Fold(nick)
+		if _, ok := pr.nicks[key]; !ok {
+			pr.nicks[key] = nick
+			added = append(added, nick)
+		}
+	}
+	ready := pr.ready
+	pr.mutex.Unlock()
+	if ready {
+		b.armPresence(added)
+	}
+}
+
+// Unmonitor removes nicks from the presence list.
+func (b *Bot) Unmonitor(nicks ...string) {
+	pr := b.presenceList()
+	pr.mutex.Lock()
+	var removed []string
+	for _, nick := range nicks {
+		key := b.Fold(nick)
+		delete(pr.nicks, key)
+		delete(pr.online, key)
+		if pr.armed[key] {
+			delete(pr.armed, key)
+			removed = append(removed, nick)
+		}
+	}
+	method := pr.method
+	pr.mutex.Unlock()
+	switch method {
+	case presenceMonitor:
+		b.sendPresence("MONITOR - ", ",", "", removed)
+	case presenceWatch:
+		b.sendPresence("WATCH", " ", "-", removed)
+	}
+}
+
+// Monitored returns the nicks on the presence list.
+func (b *Bot) Monitored() []string {
+	pr := b.presenceList()
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	return pr.sorted()
+}
+
+// sorted returns the nicks on the list in order. The caller holds the mutex.
+func (pr *presence) sorted() []string {
+	nicks := make([]string, 0, len(pr.nicks))
+	for _, nick := range pr.nicks {
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// Online returns true if nick on the presence list is known to be online.
+func (b *Bot) Online(nick string) bool {
+	pr := b.presenceList()
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	return pr.online[b.Fold(nick)]
+}
+
+// startPresence selects the method for the new connection and arms the whole list. Called when
+// the ISUPPORT tokens are complete, at the end of the MOTD.
+func (b *Bot) startPresence() {
+	pr := b.presenceList()
+	is := b.ISupport()
+	pr.mutex.Lock()
+	pr.armed = make(map[string]bool)
+	pr.online = make(map[string]bool)
+	pr.polls = nil
+	pr.lastISON = time.Time{}
+	pr.method, pr.limit = presenceISON, 0
+	if value, ok := is.Get("MONITOR"); ok {
+		pr.method = presenceMonitor
+		pr.limit, _ = strconv.Atoi(value)
+	} else if value, ok := is.Get("WATCH"); ok {
+		pr.method = presenceWatch
+		pr.limit, _ = strconv.Atoi(value)
+	}
+	pr.ready = true
+	nicks := pr.sorted()
+	pr.mutex.Unlock()
+	b.armPresence(nicks)
+}
+
+// armPresence hands nicks to MONITOR or WATCH, up to the server's limit. Other nicks are polled.
+func (b *Bot) armPresence(nicks []string) {
+	pr := b.presenceList()
+	pr.mutex.Lock()
+	method := pr.method
+	var arm []string
+	if method != presenceISON {
+		for _, nick := range nicks {
+			if pr.limit > 0 && len(pr.armed) >= pr.limit {
+				break
+			}
+			pr.armed[b.Fold(nick)] = true
+			arm = append(arm, nick)
+		}
+	}
+	pr.mutex.Unlock()
+	switch method {
+	case presenceMonitor:
+		b.sendPresence("MONITOR + ", ",", "", arm)
+	case presenceWatch:
+		b.sendPresence("WATCH", " ", "+", arm)
+	}
+}
+
+// sendPresence sends command with nicks, each prefixed with sign and joined by sep, split into
+// lines of acceptable length.
+func (b *Bot) sendPresence(command, sep, sign string, nicks []string) {
+	line := ""
+	for _, nick := range nicks {
+		if line != "" && len(command)+len(line)+len(sep)+len(sign)+len(nick) > maxPresenceLine {
+			b.SendString(command + line)
+			line = ""
+		}
+		if line != "" || sep == " " {
+			line += sep
+		}
+		line += sign + nick
+	}
+	if line != "" {
+		b.SendString(command + line)
+	}
+}
+
+// pollPresence sends ISON for the nicks not covered by MONITOR or WATCH, if due.
+func (b *Bot) pollPresence() {
+	pr := b.presenceList()
+	interval := defaultISONInterval
+	if b.ISONInterval > 0 {
+		interval = time.Duration(b.ISONInterval) * time.Second
+	}
+	pr.mutex.Lock()
+	if !pr.ready || time.Since(pr.lastISON) < interval {
+		pr.mutex.Unlock()
+		return
+	}
+	pr.lastISON = time.Now()
+	var lines []string
+	var batch []string
+	for _, nick := range pr.sorted() {
+		if pr.armed[b.Fold(nick)] {
+			continue
+		}
+		if len(batch) > 0 && len(strings.Join(batch, " "))+len(nick) > maxPresenceLine {
+			pr.polls = append(pr.polls, batch)
+			lines = append(lines, "ISON "+strings.Join(batch, " "))
+			batch = nil
+		}
+		batch = append(batch, nick)
+	}
+	if len(batch) > 0 {
+		pr.polls = append(pr.polls, batch)
+		lines = append(lines, "ISON "+strings.Join(batch, " "))
+	}
+	pr.mutex.Unlock()
+	for _, line := range lines {
+		b.SendString(line)
+	}
+}
+
+// handlePresence processes replies to MONITOR, WATCH and ISON.
+func (b *Bot) handlePresence(msg *irc.Message) {
+	p := params(msg)
+	arg := func(i int) string {
+		if i < len(p) {
+			return p[i]
+		}
+		return ""
+	}
+	switch msg.Command {
+	case "376", "422": // End of MOTD, no MOTD
+		b.startPresence()
+	case "730": // RPL_MONONLINE: me :nick!user@host,...
+		for _, target := range strings.Split(arg(1), ",") {
+			b.setOnline(irc.ParsePrefix(target), true)
+		}
+	case "731": // RPL_MONOFFLINE: me :nick,...
+		for _, target := range strings.Split(arg(1), ",") {
+			b.setOnline(irc.ParsePrefix(target), false)
+		}
+	case "734": // ERR_MONLISTFULL: me limit nicks :Monitor list is full
+		pr := b.presenceList()
+		pr.mutex.Lock()
+		for _, nick := range strings.Split(arg(2), ",") {
+			delete(pr.armed, b.Fold(nick))
+		}
+		pr.mutex.Unlock()
+	case "600", "604": // RPL_LOGON, RPL_NOWON: me nick user host ts :text
+		b.setOnline(&irc.Prefix{Name: arg(1), User: arg(2), Host: arg(3)}, true)
+	case "601", "605": // RPL_LOGOFF, RPL_NOWOFF
+		b.setOnline(&irc.Prefix{Name: arg(1)}, false)
+	case "303": // RPL_ISON: me :nicks
+		pr := b.presenceList()
+		pr.mutex.Lock()
+		if len(pr.polls) == 0 {
+			pr.mutex.Unlock()
+			return
+		}
+		polled := pr.polls[0]
+		pr.polls = pr.polls[1:]
+		pr.mutex.Unlock()
+		on := make(map[string]bool)
+		for _, nick := range strings.Fields(arg(1)) {
+			on[b.Fold(nick)] = true
+		}
+		for _, nick := range polled {
+			b.setOnline(&irc.Prefix{Name: nick}, on[b.Fold(nick)])
+		}
+	}
+}
+
+// setOnline records the status of a nick on the list and emits an event if it changed. An
+// unknown status counts as offline.
+func (b *Bot) setOnline(prefix *irc.Prefix, online bool) {
+	if prefix.Name == "" {
+		return
+	}
+	pr := b.presenceList()
+	key := b.Fold(prefix.Name)
+	pr.mutex.Lock()
+	_, listed := pr.nicks[key]
+	changed := listed && pr.online[key] != online
+	if online {
+		pr.online[key] = true
+	} else {
+		delete(pr.online, key)
+	}
+	pr.mutex.Unlock()
+	if !changed {
+		return
+	}
+	ev := Event{Type: EventOffline, User: User{Nick: prefix.Name, User: prefix.User, Host: prefix.Host}}
+	if online {
+		ev.Type = EventOnline
+	}
+	b.emit(ev)
+}
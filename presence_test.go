@@ -0,0 +1,90 @@
+package flockerbot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+func TestPresenceMonitor(t *testing.T) {
+	b := testBot("flocker")
+	sub := b.Subscribe(func(ev Event) bool { return ev.Type == EventOnline || ev.Type == EventOffline })
+	defer sub.Cancel()
+	b.Monitor("alice", "Bob", "carol")
+	b.track(irc.ParseMessage(":irc.example 005 flocker MONITOR=2 :are supported by this server"), nil)
+	b.handlePresence(irc.ParseMessage(":irc.example 376 flocker :End of /MOTD command."))
+	if l := nextLine(t, b); l != "MONITOR + Bob,alice" {
+		t.Errorf("Unexpected line %q", l)
+	}
+	b.pollPresence()
+	if l := nextLine(t, b); l != "ISON carol" {
+		t.Errorf("Expected ISON beyond the limit, got %q", l)
+	}
+	for _, l := range []string{
+		":irc.example 730 flocker :alice!a@alice.example,bob!b@bob.example",
+		":irc.example 303 flocker :Carol",
+		":irc.example 731 flocker :bob",
+	} {
+		b.handlePresence(irc.ParseMessage(l))
+	}
+	want := []string{"online alice", "online bob", "online carol", "offline bob"}
+	for i, w := range want {
+		ev := <-sub.C
+		if got := ev.Type.String() + " " + ev.User.Nick; got != w {
+			t.Errorf("Event %d: got %q, want %q", i, got, w)
+		}
+		if i == 0 && ev.User.Host != "alice.example" {
+			t.Errorf("Host not set: %v", ev.User)
+		}
+	}
+	if !b.Online("ALICE") || b.Online("bob") || !b.Online("carol") {
+		t.Error("Unexpected online status")
+	}
+	b.Unmonitor("alice")
+	if l := nextLine(t, b); l != "MONITOR - alice" {
+		t.Errorf("Unexpected line %q", l)
+	}
+
+	// The list is armed again after a reconnect.
+	b.resetState()
+	if b.Online("carol") {
+		t.Error("Online status kept after reconnect")
+	}
+	b.track(irc.ParseMessage(":irc.example 005 flocker WATCH=128 :are supported by this server"), nil)
+	b.handlePresence(irc.ParseMessage(":irc.example 422 flocker :MOTD File is missing"))
+	if l := nextLine(t, b); l != "WATCH +Bob +carol" {
+		t.Errorf("Unexpected line %q", l)
+	}
+	b.handlePresence(irc.ParseMessage(":irc.example 604 flocker carol c carol.example 1700000000 :is online"))
+	if ev := <-sub.C; ev.Type != EventOnline || ev.User.Nick != "carol" || ev.User.User != "c" {
+		t.Errorf("Unexpected event %v", ev)
+	}
+}
+
+func TestPresenceFullSocketChan(t *testing.T) {
+	// The end of the MOTD and the ticker are handled by the main loop, which must not wait for
+	// room in socketChan.
+	b := testBot("flocker")
+	b.Monitor("alice", "bob", "carol")
+	b.track(irc.ParseMessage(":irc.example 005 flocker MONITOR=2 :are supported by this server"), nil)
+	b.socketChan = make(chan *channelString, 1)
+	b.socketChan <- &channelString{Dir: socketRead, Data: "busy"}
+	done := make(chan struct{})
+	go func() {
+		b.handlePresence(irc.ParseMessage(":irc.example 376 flocker :End of /MOTD command."))
+		b.pollPresence()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Presence requests blocked on a full socketChan")
+	}
+	<-b.socketChan
+	for _, want := range []string{"MONITOR + alice,bob", "ISON carol"} {
+		if l := nextLine(t, b); l != want {
+			t.Errorf("Got %q, want %q", l, want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package flockerbot
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrProxyScheme signals an unsupported proxy URL scheme
+	ErrProxyScheme = errors.New("Bot: Unsupported proxy scheme")
+	// ErrProxyAuth signals that the proxy rejected our credentials or offered no usable method
+	ErrProxyAuth = errors.New("Bot: Proxy authentication failed")
+	// ErrProxyProtocol signals a malformed reply from the proxy
+	ErrProxyProtocol = errors.New("Bot: Proxy protocol error")
+	// ErrProxyRefused signals that the proxy refused to connect to the target
+	ErrProxyRefused = errors.New("Bot: Proxy refused connection")
+)
+
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+	socks5CmdConnect   = 0x01
+	socks5AddrIPv4     = 0x01
+	socks5AddrDomain   = 0x03
+	socks5AddrIPv6     = 0x04
+)
+
+// dial opens the TCP connection to ConnectAddress, either directly or through the configured proxy.
+// It is aborted when ctx is done.
+func (b *Bot) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   time.Second * time.Duration(b.Timeout),
+		KeepAlive: time.Second * 15,
+	}
+	if b.Proxy == "" {
+		return dialer.DialContext(ctx, "tcp", b.ConnectAddress)
+	}
+	proxy, err := url.Parse(b.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	var negotiate func(conn net.Conn) error
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		remoteDNS := proxy.Scheme == "socks5h"
+		negotiate = func(conn net.Conn) error {
+			return socks5Connect(conn, b.ConnectAddress, proxy.User, remoteDNS)
+		}
+	case "http":
+		negotiate = func(conn net.Conn) error {
+			return httpConnect(conn, b.ConnectAddress, proxy.User)
+		}
+	default:
+		return nil, ErrProxyScheme
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if b.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(time.Second * time.Duration(b.Timeout)))
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if err := negotiate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Connect asks the SOCKS5 proxy on conn to connect to addr. With remoteDNS the hostname is
+// passed to the proxy, otherwise it is resolved locally. Onion addresses are always resolved remotely.
+func socks5Connect(conn net.Conn, addr string, user *url.Userinfo, remoteDNS bool) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+	greeting := []byte{socks5Version, 1, socks5AuthNone}
+	if user != nil {
+		greeting = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return ErrProxyProtocol
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if user == nil {
+			return ErrProxyAuth
+		}
+		if err := socks5Authenticate(conn, user); err != nil {
+			return err
+		}
+	default:
+		return ErrProxyAuth
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	ip := net.ParseIP(host)
+	if ip == nil && !remoteDNS && !strings.HasSuffix(strings.ToLower(host), ".onion") {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return err
+		}
+		ip = ips[0]
+		for _, i := range ips {
+			if i.To4() != nil {
+				ip = i
+				break
+			}
+		}
+	}
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return ErrProxyProtocol
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	case ip.To4() != nil:
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip.To4()...)
+	default:
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[0] != socks5Version {
+		return ErrProxyProtocol
+	}
+	if head[1] != 0x00 {
+		return ErrProxyRefused
+	}
+	var skip int
+	switch head[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return ErrProxyProtocol
+	}
+	// Bound address and port are of no interest to us.
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// socks5Authenticate performs username/password authentication (RFC 1929).
+func socks5Authenticate(conn net.Conn, user *url.Userinfo) error {
+	name := user.Username()
+	pass, _ := user.Password()
+	if len(name) > 255 || len(pass) > 255 {
+		return ErrProxyAuth
+	}
+	req := []byte{0x01, byte(len(name))}
+	req = append(req, name...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return ErrProxyAuth
+	}
+	return nil
+}
+
+// httpConnect asks the HTTP proxy on conn to open a tunnel to addr.
+func httpConnect(conn net.Conn, addr string, user *url.Userinfo) error {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if user != nil {
+		pass, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return err
+	}
+	status, err := readHTTPHeader(conn)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return ErrProxyProtocol
+	}
+	switch fields[1] {
+	case "200":
+		return nil
+	case "407":
+		return ErrProxyAuth
+	default:
+		return ErrProxyRefused
+	}
+}
+
+// readHTTPHeader reads the response header byte by byte, so that no data of the tunneled
+// connection gets consumed, and returns the status line.
+func readHTTPHeader(conn net.Conn) (string, error) {
+	var header []byte
+	c := make([]byte, 1)
+	for !strings.HasSuffix(string(header), "\r\n\r\n") {
+		if len(header) > 8192 {
+			return "", ErrProxyProtocol
+		}
+		if _, err := io.ReadFull(conn, c); err != nil {
+			return "", err
+		}
+		header = append(header, c[0])
+	}
+	status, _, _ := strings.Cut(string(header), "\r\n")
+	return status, nil
+}
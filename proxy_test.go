@@ -0,0 +1,101 @@
+package flockerbot
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSOCKS5Connect(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 4)
+		io.ReadFull(server, buf)
+		if !bytes.Equal(buf, []byte{5, 2, 0, 2}) {
+			done <- ErrProxyProtocol
+			return
+		}
+		server.Write([]byte{5, 2})
+		auth := make([]byte, 2+4+1+6)
+		io.ReadFull(server, auth)
+		if string(auth[2:6]) != "user" || string(auth[7:]) != "secret" {
+			done <- ErrProxyAuth
+			server.Write([]byte{1, 1})
+			return
+		}
+		server.Write([]byte{1, 0})
+		req := make([]byte, 5)
+		io.ReadFull(server, req)
+		if req[3] != socks5AddrDomain {
+			done <- ErrProxyProtocol
+			return
+		}
+		host := make([]byte, int(req[4])+2)
+		io.ReadFull(server, host)
+		if string(host[:len(host)-2]) != "example.onion" || host[len(host)-2] != 0x1a || host[len(host)-1] != 0x0b {
+			done <- ErrProxyProtocol
+			return
+		}
+		server.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		done <- nil
+	}()
+	err := socks5Connect(client, "example.onion:6667", url.UserPassword("user", "secret"), false)
+	if err != nil {
+		t.Fatalf("socks5Connect: %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Server: %s", err)
+	}
+}
+
+func TestSOCKS5Refused(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		io.ReadFull(server, make([]byte, 3))
+		server.Write([]byte{5, 0})
+		io.ReadFull(server, make([]byte, 10))
+		server.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+	}()
+	if err := socks5Connect(client, "127.0.0.1:6667", nil, true); err != ErrProxyRefused {
+		t.Errorf("Expected ErrProxyRefused, got %v", err)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	req := make(chan string, 1)
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		var lines []string
+		for {
+			l, _ := r.ReadString('\n')
+			if l == "\r\n" || l == "" {
+				break
+			}
+			lines = append(lines, strings.TrimSpace(l))
+		}
+		req <- strings.Join(lines, "|")
+		io.WriteString(server, "HTTP/1.1 200 Connection established\r\n\r\n:irc.example NOTICE * :hello\r\n")
+	}()
+	if err := httpConnect(client, "irc.example:6697", url.UserPassword("a", "b")); err != nil {
+		t.Fatalf("httpConnect: %s", err)
+	}
+	if got := <-req; got != "CONNECT irc.example:6697 HTTP/1.1|Host: irc.example:6697|Proxy-Authorization: Basic YTpi" {
+		t.Errorf("Unexpected request: %s", got)
+	}
+	line, _ := bufio.NewReader(client).ReadString('\n')
+	if line != ":irc.example NOTICE * :hello\r\n" {
+		t.Errorf("Tunneled data lost: %q", line)
+	}
+}
@@ -0,0 +1,325 @@
+package flockerbot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+)
+
+var (
+	// ErrNotServer signals that pseudo-clients require server mode
+	ErrNotServer = errors.New("Bot: Pseudo-clients require IsServer")
+	// ErrPseudoClient signals an invalid or unknown pseudo-client
+	ErrPseudoClient = errors.New("Bot: Invalid pseudo-client")
+)
+
+const uidChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// PseudoClient is a client introduced by the bot in server mode. It has its own nick and handler,
+// and can join channels and send messages without a connection of its own. Populate the exported
+// fields and pass it to Bot.AddPseudoClient.
+type PseudoClient struct {
+	Nick     string // Nickname.
+	User     string // Ident. Defaults to the nick.
+	Host     string // Host. Defaults to the server name.
+	Realname string // Realname. Defaults to the nick.
+	Modes    string // User modes. Defaults to "+i".
+
+	// Handler is called for private messages and notices to the client, for messages in channels it
+	// is in, and for INVITE and KICK concerning it. The source is translated to nick!user@host and
+	// a UID target to the nick, as for Bot.Handler.
+	Handler func(msg *irc.Message)
+
+	bot      *Bot
+	uid      string
+	ts       int64 // nick TS, renewed when reintroduced
+	mutex    sync.Mutex
+	channels map[string]string // folded name to name
+}
+
+// AddPseudoClient registers pc and introduces it to the network. If the link is not up yet, it is
+// introduced with our burst.
+func (b *Bot) AddPseudoClient(pc *PseudoClient) error {
+	if !b.IsServer {
+		return ErrNotServer
+	}
+	if pc.Nick == "" || pc.bot != nil {
+		return ErrPseudoClient
+	}
+	if pc.User == "" {
+		pc.User = pc.Nick
+	}
+	if pc.Host == "" {
+		pc.Host = b.User
+	}
+	if pc.Realname == "" {
+		pc.Realname = pc.Nick
+	}
+	if pc.Modes == "" {
+		pc.Modes = "+i"
+	}
+	b.mutex.Lock()
+	if b.pseudoClients == nil {
+		b.pseudoClients = make(map[string]*PseudoClient)
+	}
+	pc.bot = b
+	pc.uid = b.SID + uidSuffix(b.uidCounter)
+	pc.ts = now()
+	pc.channels = make(map[string]string)
+	b.uidCounter++
+	b.pseudoClients[pc.uid] = pc
+	linked := b.linkBurstDone && b.connected
+	b.mutex.Unlock()
+	if linked {
+		pc.introduce()
+	}
+	return nil
+}
+
+// RemovePseudoClient quits pc with reason and removes it.
+func (b *Bot) RemovePseudoClient(pc *PseudoClient, reason string) error {
+	b.mutex.Lock()
+	if pc.bot != b || b.pseudoClients[pc.uid] != pc {
+		b.mutex.Unlock()
+		return ErrPseudoClient
+	}
+	delete(b.pseudoClients, pc.uid)
+	linked := b.linkBurstDone && b.connected
+	b.mutex.Unlock()
+	if linked {
+		pc.Send("QUIT :" + reason)
+	}
+	if ls := b.Link(); ls != nil {
+		ls.removeUser(pc.uid)
+	}
+	return nil
+}
+
+// PseudoClients returns all registered pseudo-clients.
+func (b *Bot) PseudoClients() []*PseudoClient {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	clients := make([]*PseudoClient, 0, len(b.pseudoClients))
+	for _, pc := range b.pseudoClients {
+		clients = append(clients, pc)
+	}
+	return clients
+}
+
+// pseudoClient returns the pseudo-client with uid, or nil.
+func (b *Bot) pseudoClient(uid string) *PseudoClient {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.pseudoClients[uid]
+}
+
+// UID returns the unique ID of the client.
+func (pc *PseudoClient) UID() string {
+	return pc.uid
+}
+
+// timestamp returns the nick TS of the client.
+func (pc *PseudoClient) timestamp() int64 {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	return pc.ts
+}
+
+// Channels returns the channels the client is in.
+func (pc *PseudoClient) Channels() []string {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	channels := make([]string, 0, len(pc.channels))
+	for _, c := range pc.channels {
+		channels = append(channels, c)
+	}
+	return channels
+}
+
+// Send sends line with the client as source.
+func (pc *PseudoClient) Send(line string) {
+	pc.bot.SendString(":" + pc.uid + " " + line)
+}
+
+// Privmsg sends text to target, a channel or nick.
+func (pc *PseudoClient) Privmsg(target, text string) {
+	pc.Send("PRIVMSG " + pc.bot.linkTarget(target) + " :" + text)
+}
+
+// Notice sends text as notice to target, a channel or nick.
+func (pc *PseudoClient) Notice(target, text string) {
+	pc.Send("NOTICE " + pc.bot.linkTarget(target) + " :" + text)
+}
+
+// Join joins channel. The channel is created if it does not exist.
+func (pc *PseudoClient) Join(channel string) {
+	pc.mutex.Lock()
+	pc.channels[pc.bot.linkFold(channel)] = channel
+	pc.mutex.Unlock()
+	if pc.bot.linked() {
+		pc.sendJoin(channel)
+	}
+}
+
+// Part leaves channel with reason.
+func (pc *PseudoClient) Part(channel, reason string) {
+	pc.mutex.Lock()
+	delete(pc.channels, pc.bot.linkFold(channel))
+	pc.mutex.Unlock()
+	if ls := pc.bot.Link(); ls != nil {
+		ls.partChannel(channel, pc.uid)
+	}
+	if pc.bot.linked() {
+		pc.Send("PART " + channel + " :" + reason)
+	}
+}
+
+// Mode sets channel modes, e.g. Mode("#chan", "+o", "nick"). Nick arguments of status modes are
+// translated to UIDs.
+func (pc *PseudoClient) Mode(channel, modes string, args ...string) {
+	ls := pc.bot.Link()
+	if ls == nil {
+		return
+	}
+	c, _ := ls.Channel(channel)
+	targets := make([]string, len(args))
+	for i, a := range args {
+		targets[i] = pc.bot.linkTarget(a)
+	}
+	ls.updateChannel(channel, func(c *LinkChannel) {
+		applyModes(c, ls.modes, modes, targets)
+	})
+	pc.bot.linkProtocol().mode(pc.bot, pc, channel, c.TS, modes, targets)
+}
+
+// introduce sends the UID of the client and joins its channels.
+func (pc *PseudoClient) introduce() {
+	b := pc.bot
+	b.linkProtocol().introduce(b, pc)
+	if ls := b.Link(); ls != nil {
+		ls.addUser(&LinkUser{UID: pc.uid, Nick: pc.Nick, User: pc.User, Host: pc.Host, IP: "0", Realname: pc.Realname, Server: b.SID, Modes: pc.Modes, TS: pc.timestamp()})
+	}
+	for _, c := range pc.Channels() {
+		pc.sendJoin(c)
+	}
+}
+
+// sendJoin joins the client to channel with the channel's TS, or a new one.
+func (pc *PseudoClient) sendJoin(channel string) {
+	ls := pc.bot.Link()
+	ts := now()
+	if c, ok := ls.Channel(channel); ok {
+		ts = c.TS
+	}
+	ls.joinChannel(channel, ts, pc.uid, "")
+	pc.bot.linkProtocol().join(pc.bot, pc, channel, ts)
+}
+
+// linked returns true if the link is up and bursts are done.
+func (b *Bot) linked() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.linkBurstDone && b.connected
+}
+
+// linkTarget translates a nick to its UID. Channels and unknown nicks are returned unchanged.
+func (b *Bot) linkTarget(target string) string {
+	if strings.HasPrefix(target, "#") || strings.HasPrefix(target, "&") {
+		return target
+	}
+	if ls := b.Link(); ls != nil {
+		if u, ok := ls.UserByNick(target); ok {
+			return u.UID
+		}
+	}
+	return target
+}
+
+// burstPseudoClients introduces all pseudo-clients as part of our burst.
+func (b *Bot) burstPseudoClients() {
+	for _, pc := range b.PseudoClients() {
+		pc.introduce()
+	}
+}
+
+// routePseudo passes msg to the handlers of the pseudo-clients it concerns. translated is msg with
+// the source translated to nick!user@host.
+func (b *Bot) routePseudo(msg, translated *irc.Message) {
+	if len(msg.Params) == 0 || msg.Prefix == nil {
+		return
+	}
+	deliver := func(pc *PseudoClient, m *irc.Message) {
+		if pc.Handler != nil {
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						b.logError("pseudo-client handler panic", fmt.Errorf("%v", r), "nick", pc.Nick)
+						if b.Metrics != nil {
+							b.Metrics.HandlerPanic()
+						}
+					}
+				}()
+				pc.Handler(m)
+			}()
+		}
+	}
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE":
+		target := msg.Params[0]
+		if pc := b.pseudoClient(target); pc != nil {
+			m := *translated
+			m.Params = append([]string{pc.Nick}, msg.Params[1:]...)
+			deliver(pc, &m)
+			return
+		}
+		channel := b.linkFold(target)
+		for _, pc := range b.PseudoClients() {
+			pc.mutex.Lock()
+			_, in := pc.channels[channel]
+			pc.mutex.Unlock()
+			if in && pc.uid != msg.Prefix.Name {
+				deliver(pc, translated)
+			}
+		}
+	case "INVITE":
+		if pc := b.pseudoClient(msg.Params[0]); pc != nil {
+			m := *translated
+			m.Params = append([]string{pc.Nick}, msg.Params[1:]...)
+			deliver(pc, &m)
+		}
+	case "KICK":
+		if len(msg.Params) > 1 {
+			if pc := b.pseudoClient(msg.Params[1]); pc != nil {
+				pc.mutex.Lock()
+				delete(pc.channels, b.linkFold(msg.Params[0]))
+				pc.mutex.Unlock()
+				m := *translated
+				m.Params = []string{msg.Params[0], pc.Nick}
+				deliver(pc, &m)
+			}
+		}
+	case "KILL":
+		// Pseudo-clients are reintroduced when killed, like services do.
+		if pc := b.pseudoClient(msg.Params[0]); pc != nil {
+			b.logInfo("pseudo-client killed, reintroducing", "nick", pc.Nick)
+			pc.mutex.Lock()
+			pc.ts = now()
+			pc.mutex.Unlock()
+			pc.introduce()
+		}
+	}
+}
+
+// uidSuffix returns the six character UID suffix for n: a letter followed by five letters or digits.
+func uidSuffix(n int) string {
+	suffix := make([]byte, 6)
+	for i := 5; i > 0; i-- {
+		suffix[i] = uidChars[n%36]
+		n /= 36
+	}
+	suffix[0] = uidChars[n%26]
+	return string(suffix)
+}
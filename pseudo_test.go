@@ -0,0 +1,76 @@
+package flockerbot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+func TestPseudoClient(t *testing.T) {
+	b := &Bot{IsServer: true, User: "flocker.example", SID: "42X"}
+	b.Setup()
+	b.socketChan = make(chan *channelString, 64)
+	helper := &PseudoClient{Nick: "Helper"}
+	got := make(chan *irc.Message, 4)
+	helper.Handler = func(msg *irc.Message) {
+		got <- msg
+	}
+	if err := b.AddPseudoClient(helper); err != nil {
+		t.Fatal(err)
+	}
+	if helper.UID() != "42XAAAAAA" || uidSuffix(37) != "AAAABB" {
+		t.Errorf("Unexpected UID %s", helper.UID())
+	}
+	helper.Join("#flocker")
+	b.linkRegister()
+	for _, l := range []string{
+		"PASS pw TS 6 :42A",
+		"SERVER irc.example 1 :Example server",
+		"SVINFO 6 6 0 :1700000000",
+		":42A UID alice 1 1600000000 +i ~alice host.example 10.0.0.1 42AAAAAAA :Alice",
+		":42A SJOIN 1500000000 #other + :42AAAAAAA",
+		":42A PING :42A",
+		":42AAAAAAA PRIVMSG 42XAAAAAA :hi helper",
+		":42AAAAAAA PRIVMSG #other :not for helper",
+		":42AAAAAAA KILL 42XAAAAAA :collision",
+	} {
+		if err := b.handleLink(irc.ParseMessage(l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case msg := <-got:
+		if msg.Prefix.Name != "alice" || msg.Params[0] != "Helper" || msg.Trailing != "hi helper" {
+			t.Errorf("Unexpected message %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Message not routed to pseudo-client")
+	}
+	helper.Privmsg("alice", "hello")
+	var lines []string
+	for len(b.socketChan) > 0 {
+		lines = append(lines, strings.TrimSpace((<-b.socketChan).Data))
+	}
+	all := strings.Join(lines, "\n")
+	for _, want := range []string{
+		":42X UID Helper 1 ",
+		" +i Helper flocker.example 0 42XAAAAAA :Helper\n:42X SJOIN ",
+		" #flocker + :42XAAAAAA\n:42X PING flocker.example :42A",
+		":42XAAAAAA PRIVMSG 42AAAAAAA :hello",
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("Missing %q in:\n%s", want, all)
+		}
+	}
+	if len(got) != 0 {
+		t.Error("Channel message routed to client not in channel")
+	}
+	if strings.Count(all, ":42X UID Helper 1 ") != 2 {
+		t.Errorf("Pseudo-client not reintroduced after KILL:\n%s", all)
+	}
+	if c, _ := b.Link().Channel("#flocker"); c.Members[helper.UID()] != "" || len(c.Members) != 1 {
+		t.Errorf("Pseudo-client not in channel state: %v", c)
+	}
+}
@@ -0,0 +1,160 @@
+package flockerbot
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+)
+
+// Command is a bot command registered with a Router.
+type Command struct {
+	Name    string                  // Name, matched case-insensitively.
+	Help    string                  // Short description for help output.
+	Public  bool                    // If true, everyone may run it regardless of the ACL.
+	Handler func(c *CommandContext) // Called when the command is run.
+}
+
+// CommandContext is passed to command handlers.
+type CommandContext struct {
+	Bot      *Bot         // The bot that received the command.
+	Message  *irc.Message // The PRIVMSG.
+	Identity Identity     // Who sent it.
+	Command  string       // The command name as typed, without prefix.
+	Args     []string     // Space separated arguments.
+	Target   string       // Where to reply: the channel, or the nick for private messages.
+}
+
+// Reply sends text to the channel or user the command came from.
+func (c *CommandContext) Reply(text string) {
+	c.Bot.SendString("PRIVMSG " + c.Target + " :" + text)
+}
+
+// Router parses commands from PRIVMSGs and runs their handlers. Commands are recognized with
+// Prefix (e.g. "!op alice"), addressed to the bot in a channel ("flocker: op alice") and as
+// private messages without prefix. If ACL is set, non-public commands require a role allowing them.
+type Router struct {
+	Prefix string                  // Command prefix, e.g. "!".
+	ACL    *ACL                    // Optional access control.
+	Denied func(c *CommandContext) // Called when the ACL denies a command. If nil, a notice is sent.
+
+	mutex    sync.RWMutex
+	commands map[string]*Command
+}
+
+// NewRouter returns a router for commands starting with prefix.
+func NewRouter(prefix string) *Router {
+	return &Router{Prefix: prefix, commands: make(map[string]*Command)}
+}
+
+// Add registers cmd, replacing a command of the same name.
+func (r *Router) Add(cmd Command) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.commands[strings.ToLower(cmd.Name)] = &cmd
+}
+
+// Handle registers handler for command name.
+func (r *Router) Handle(name string, handler func(c *CommandContext)) {
+	r.Add(Command{Name: name, Handler: handler})
+}
+
+// Remove unregisters command name.
+func (r *Router) Remove(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.commands, strings.ToLower(name))
+}
+
+// Commands returns the registered commands.
+func (r *Router) Commands() []Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	commands := make([]Command, 0, len(r.commands))
+	for _, c := range r.commands {
+		commands = append(commands, *c)
+	}
+	return commands
+}
+
+// Handler returns a function for Bot.Handler that dispatches commands received by b. Prefer
+// TagsHandler, which identifies senders by their account tag.
+func (r *Router) Handler(b *Bot) func(msg *irc.Message) {
+	return func(msg *irc.Message) {
+		r.Dispatch(b, msg)
+	}
+}
+
+// TagsHandler returns a function for Bot.TagsHandler that dispatches commands received by b.
+func (r *Router) TagsHandler(b *Bot) func(msg *irc.Message, tags map[string]string) {
+	return func(msg *irc.Message, tags map[string]string) {
+		r.DispatchTags(b, msg, tags)
+	}
+}
+
+// Dispatch runs the command in msg, if any. Returns true if msg was a known command, whether or
+// not it was allowed.
+func (r *Router) Dispatch(b *Bot, msg *irc.Message) bool {
+	return r.DispatchTags(b, msg, nil)
+}
+
+// DispatchTags is Dispatch for a message with tags. The account tag, if any, identifies the sender.
+func (r *Router) DispatchTags(b *Bot, msg *irc.Message, tags map[string]string) bool {
+	c := r.parse(b, msg, tags)
+	if c == nil {
+		return false
+	}
+	r.mutex.RLock()
+	cmd, ok := r.commands[strings.ToLower(c.Command)]
+	r.mutex.RUnlock()
+	if !ok {
+		return false
+	}
+	if !cmd.Public && r.ACL != nil && !r.ACL.Allowed(c.Identity, cmd.Name, b.ISupport().CaseMapping()) {
+		b.logInfo("command denied", "command", cmd.Name, "from", c.Identity.Hostmask())
+		if r.Denied != nil {
+			r.Denied(c)
+		} else {
+			b.SendString("NOTICE " + c.Identity.Nick + " :Permission denied.")
+		}
+		return true
+	}
+	cmd.Handler(c)
+	return true
+}
+
+// parse returns the command context for msg, or nil if it is not a command.
+func (r *Router) parse(b *Bot, msg *irc.Message, tags map[string]string) *CommandContext {
+	if msg.Command != "PRIVMSG" || msg.Prefix == nil || len(msg.Params) == 0 || b.isMe(msg.Prefix.Name) {
+		// Our own messages come back with echo-message.
+		return nil
+	}
+	text := strings.TrimSpace(msg.Trailing)
+	target := b.ReplyTo(msg)
+	private := b.isMe(msg.Params[0])
+	switch {
+	case r.Prefix != "" && strings.HasPrefix(text, r.Prefix):
+		text = text[len(r.Prefix):]
+	case private:
+	default:
+		// "nick: command" or "nick, command"
+		nick, rest, ok := strings.Cut(text, " ")
+		nick = strings.TrimRight(nick, ":,")
+		if !ok || !b.isMe(nick) {
+			return nil
+		}
+		text = strings.TrimSpace(rest)
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil
+	}
+	return &CommandContext{
+		Bot:      b,
+		Message:  msg,
+		Identity: b.identity(msg, tags),
+		Command:  fields[0],
+		Args:     fields[1:],
+		Target:   target,
+	}
+}
@@ -0,0 +1,74 @@
+package flockerbot
+
+import (
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestRouter(t *testing.T) {
+	b := testBot("flocker")
+	r := NewRouter("!")
+	r.ACL = NewACL()
+	r.ACL.AddRole("admin", "op")
+	r.ACL.Grant(Rule{Mask: "*!*@staff.example", Role: "admin"})
+	var got []string
+	r.Handle("op", func(c *CommandContext) {
+		got = append(got, c.Target+" "+c.Identity.Nick+" "+c.Args[0])
+		c.Reply("done")
+	})
+	r.Add(Command{Name: "ping", Public: true, Handler: func(c *CommandContext) {
+		c.Reply("pong")
+	}})
+	for _, l := range []string{
+		":root!r@staff.example PRIVMSG #flocker :!op alice",
+		":root!r@staff.example PRIVMSG #flocker :FLOCKER: OP bob",
+		":root!r@staff.example PRIVMSG Flocker :op carol",
+		":mallory!m@evil.example PRIVMSG #flocker :!op mallory",
+		":mallory!m@evil.example PRIVMSG #flocker :!ping",
+	} {
+		if !r.Dispatch(b, irc.ParseMessage(l)) {
+			t.Errorf("Not dispatched: %s", l)
+		}
+	}
+	if r.Dispatch(b, irc.ParseMessage(":root!r@staff.example PRIVMSG #flocker :hello there")) {
+		t.Error("Plain message dispatched")
+	}
+	if len(got) != 3 || got[0] != "#flocker root alice" || got[2] != "root root carol" {
+		t.Errorf("Unexpected calls %v", got)
+	}
+	want := []string{
+		"PRIVMSG #flocker :done", "PRIVMSG #flocker :done", "PRIVMSG root :done",
+		"NOTICE mallory :Permission denied.", "PRIVMSG #flocker :pong",
+	}
+	for _, w := range want {
+		if l := nextLine(t, b); l != w {
+			t.Errorf("Got %q, want %q", l, w)
+		}
+	}
+}
+
+func TestRouterAccountTag(t *testing.T) {
+	b := testBot("flocker")
+	r := NewRouter("!")
+	r.ACL = NewACL()
+	r.ACL.AddRole("admin", "op")
+	r.ACL.Grant(Rule{Account: "root", Role: "admin"})
+	var got []string
+	r.Handle("op", func(c *CommandContext) {
+		got = append(got, c.Identity.Account)
+	})
+	b.track(irc.ParseMessage(":flocker!f@h JOIN #flocker"), nil)
+	b.track(irc.ParseMessage(":root!r@h JOIN #flocker"), nil)
+	b.setAccount("root", "root")
+	msg := irc.ParseMessage(":root!r@h PRIVMSG #flocker :!op alice")
+	// Without account-tag, the tracked account is used.
+	r.Dispatch(b, msg)
+	// With it, the tag decides: a message without it is from a logged out user.
+	b.capsEnabled["account-tag"] = true
+	r.DispatchTags(b, msg, map[string]string{"account": "root"})
+	r.DispatchTags(b, msg, nil)
+	if len(got) != 2 || got[0] != "root" || got[1] != "root" {
+		t.Errorf("Unexpected calls %v", got)
+	}
+}
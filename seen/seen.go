@@ -0,0 +1,286 @@
+// Package seen implements a flockerbot plugin answering "!seen nick" with when and where a user
+// was last active. It records the last message, join, part, quit and nick change of each user in
+// the bot's Store, keyed by the casemapped nick.
+//
+// Options:
+//
+//	exclude-channels  comma separated channels in which nothing is recorded
+//	exclude-users     comma separated nicks or hostmasks that are never recorded
+//	show-text         whether to repeat the last message and part/quit reason (default true)
+package seen
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JonathanLogan/flockerbot"
+	"github.com/sorcix/irc"
+)
+
+// Actions of a record.
+const (
+	ActionMessage = "message"
+	ActionJoin    = "join"
+	ActionPart    = "part"
+	ActionQuit    = "quit"
+	ActionNick    = "nick"
+)
+
+// Record is the last activity of a user.
+type Record struct {
+	Nick    string    `json:"nick"`              // Nick as seen.
+	Action  string    `json:"action"`            // One of the Action constants.
+	Channel string    `json:"channel,omitempty"` // Channel, empty for quits and nick changes.
+	Text    string    `json:"text,omitempty"`    // Message, part or quit reason, or the new nick of a nick change.
+	Time    time.Time `json:"time"`              // When it happened.
+}
+
+// Plugin is the seen plugin. Create it with New.
+type Plugin struct {
+	now func() time.Time
+	pc  *flockerbot.PluginContext
+}
+
+// New returns the seen plugin.
+func New() *Plugin {
+	return &Plugin{now: time.Now}
+}
+
+// Name implements flockerbot.Plugin.
+func (p *Plugin) Name() string { return "seen" }
+
+// Schema implements flockerbot.Configurable.
+func (p *Plugin) Schema() []flockerbot.ConfigField {
+	return []flockerbot.ConfigField{
+		{Name: "exclude-channels", Type: flockerbot.ConfigList, Help: "Channels in which nothing is recorded."},
+		{Name: "exclude-users", Type: flockerbot.ConfigList, Help: "Nicks or hostmasks that are never recorded."},
+		{Name: "show-text", Type: flockerbot.ConfigBool, Default: "true", Help: "Repeat the last message and part or quit reasons."},
+	}
+}
+
+// Init implements flockerbot.Plugin. The bot needs a Store.
+func (p *Plugin) Init(pc *flockerbot.PluginContext) error {
+	if pc.Bot.Store == nil {
+		return flockerbot.ErrNoStore
+	}
+	p.pc = pc
+	commands := flockerbot.FilterCommand("PRIVMSG", "JOIN", "PART", "QUIT", "NICK")
+	pc.On(func(ev flockerbot.Event) bool {
+		if ev.Type == flockerbot.EventHistory {
+			// Messages missed while disconnected count as well.
+			ev.Type = flockerbot.EventMessage
+		}
+		return commands(ev)
+	}, func(ev flockerbot.Event) {
+		p.record(pc, ev.Message, ev.Tags, ev.Shared)
+	})
+	return pc.Command(flockerbot.Command{
+		Name:   "seen",
+		Help:   "seen <nick>: When was nick last active?",
+		Public: true,
+		Handler: func(c *flockerbot.CommandContext) {
+			if len(c.Args) == 0 {
+				c.Reply("Usage: seen <nick>")
+				return
+			}
+			c.Reply(p.answer(pc, c, c.Args[0]))
+		},
+	})
+}
+
+// Start implements flockerbot.Plugin.
+func (p *Plugin) Start(pc *flockerbot.PluginContext) error { return nil }
+
+// Stop implements flockerbot.Plugin.
+func (p *Plugin) Stop(pc *flockerbot.PluginContext) error { return nil }
+
+// Lookup returns the record of nick. The plugin must be registered.
+func (p *Plugin) Lookup(nick string) (Record, bool) {
+	var r Record
+	ok, err := p.pc.Bucket("").GetJSON(p.pc.Bot.Fold(nick), &r)
+	return r, ok && err == nil
+}
+
+// record stores the activity in msg, unless privacy options exclude it or a later activity is
+// already recorded. The time is the server time tag, if any, as history and playback are delivered
+// late. shared are the channels the user was in, for QUIT and NICK.
+func (p *Plugin) record(pc *flockerbot.PluginContext, msg *irc.Message, tags map[string]string, shared []string) {
+	if msg.Prefix == nil || msg.Prefix.IsServer() || p.excludedUser(pc, msg.Prefix) {
+		return
+	}
+	b := pc.Bot
+	r := Record{Nick: msg.Prefix.Name, Time: p.now()}
+	if t, err := time.Parse(time.RFC3339Nano, tags["time"]); err == nil {
+		r.Time = t
+	}
+	arg := func(i int) string {
+		if i < len(msg.Params) {
+			return msg.Params[i]
+		}
+		if i == len(msg.Params) {
+			return msg.Trailing
+		}
+		return ""
+	}
+	switch msg.Command {
+	case "PRIVMSG":
+		if !b.ISupport().IsChannel(arg(0)) || (strings.HasPrefix(msg.Trailing, "\x01") && !strings.HasPrefix(msg.Trailing, "\x01ACTION ")) {
+			return // private messages and CTCPs
+		}
+		r.Action, r.Channel, r.Text = ActionMessage, arg(0), msg.Trailing
+		if action, ok := strings.CutPrefix(msg.Trailing, "\x01ACTION "); ok {
+			r.Text = "* " + r.Nick + " " + strings.TrimSuffix(action, "\x01")
+		}
+	case "JOIN":
+		r.Action, r.Channel = ActionJoin, arg(0)
+	case "PART":
+		r.Action, r.Channel = ActionPart, ""
+		if len(msg.Params) > 0 {
+			r.Text = msg.Trailing
+		}
+		// PART may name several channels; record the first one not excluded.
+		for _, c := range strings.Split(arg(0), ",") {
+			if !p.excludedChannel(pc, c) {
+				r.Channel = c
+				break
+			}
+		}
+		if r.Channel == "" {
+			return
+		}
+	case "QUIT":
+		r.Action, r.Text = ActionQuit, msg.Trailing
+	case "NICK":
+		r.Action, r.Text = ActionNick, arg(0)
+	}
+	if r.Channel != "" && p.excludedChannel(pc, r.Channel) {
+		return
+	}
+	if r.Channel == "" && len(shared) > 0 && p.hidden(pc, shared) {
+		// Only seen in channels in which nothing is recorded.
+		return
+	}
+	bucket := pc.Bucket("")
+	last, ok := p.Lookup(r.Nick)
+	if r.Channel == "" && !ok {
+		// Quits and nick changes are only recorded for users seen elsewhere, as they do not tell
+		// in which channels they were.
+		return
+	}
+	if ok && last.Time.After(r.Time) {
+		return
+	}
+	bucket.PutJSON(b.Fold(r.Nick), r)
+	if r.Action != ActionNick || p.excludedUser(pc, &irc.Prefix{Name: r.Text, User: msg.Prefix.User, Host: msg.Prefix.Host}) {
+		return
+	}
+	if last, ok := p.Lookup(r.Text); ok && last.Time.After(r.Time) {
+		return
+	}
+	// The new nick was last seen in the same change.
+	bucket.PutJSON(b.Fold(r.Text), r)
+}
+
+// excludedUser returns true if prefix matches exclude-users.
+func (p *Plugin) excludedUser(pc *flockerbot.PluginContext, prefix *irc.Prefix) bool {
+	hostmask := flockerbot.Hostmask(prefix)
+	for _, e := range pc.ConfigList("exclude-users") {
+		if strings.ContainsAny(e, "!@*?") {
+			if pc.Bot.MatchMask(e, hostmask) {
+				return true
+			}
+		} else if pc.Bot.EqualFold(e, prefix.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedChannel returns true if channel is in exclude-channels.
+func (p *Plugin) excludedChannel(pc *flockerbot.PluginContext, channel string) bool {
+	for _, e := range pc.ConfigList("exclude-channels") {
+		if pc.Bot.EqualFold(e, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// hidden returns true if every channel of channels is excluded or has the plugin disabled.
+func (p *Plugin) hidden(pc *flockerbot.PluginContext, channels []string) bool {
+	for _, c := range channels {
+		if !p.excludedChannel(pc, c) && pc.Enabled(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// answer returns the reply to a seen query for nick.
+func (p *Plugin) answer(pc *flockerbot.PluginContext, c *flockerbot.CommandContext, nick string) string {
+	b := pc.Bot
+	if b.EqualFold(nick, c.Identity.Nick) {
+		return "That's you."
+	}
+	if b.EqualFold(nick, b.CurrentNick()) {
+		return "I'm right here."
+	}
+	if ch, ok := b.Channel(c.Target); ok {
+		for member := range ch.Members {
+			if b.EqualFold(member, nick) {
+				return member + " is right here."
+			}
+		}
+	}
+	r, ok := p.Lookup(nick)
+	if !ok {
+		return "I haven't seen " + nick + "."
+	}
+	showText := pc.ConfigBool("show-text")
+	who := r.Nick
+	if r.Action == ActionNick && !b.EqualFold(r.Nick, nick) {
+		who = r.Text
+	}
+	s := who + " was last seen " + ago(p.now().Sub(r.Time)) + " ago, "
+	switch r.Action {
+	case ActionMessage:
+		s += "in " + r.Channel
+		if showText {
+			s += ", saying: " + r.Text
+		}
+	case ActionJoin:
+		s += "joining " + r.Channel
+	case ActionPart:
+		s += "leaving " + r.Channel
+		if showText && r.Text != "" {
+			s += " (" + r.Text + ")"
+		}
+	case ActionQuit:
+		s += "quitting"
+		if showText && r.Text != "" {
+			s += " (" + r.Text + ")"
+		}
+	case ActionNick:
+		if who == r.Nick {
+			s += "changing nick to " + r.Text
+		} else {
+			s += "changing nick from " + r.Nick
+		}
+	}
+	if _, online := b.LookupUser(nick); online {
+		s += ", and is online now"
+	}
+	return s + "."
+}
+
+// ago formats d for humans: seconds below an hour, minutes below two days, days above.
+func ago(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return strconv.Itoa(int(d/(24*time.Hour))) + " days"
+	case d >= time.Hour:
+		return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+	}
+	return d.Round(time.Second).String()
+}
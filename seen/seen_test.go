@@ -0,0 +1,177 @@
+package seen
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JonathanLogan/flockerbot"
+	"github.com/sorcix/irc"
+)
+
+func TestSeen(t *testing.T) {
+	b := &flockerbot.Bot{Nick: "flocker"}
+	b.Setup()
+	b.Store = flockerbot.NewMemoryStore()
+	ps := flockerbot.NewPlugins(b, flockerbot.NewRouter("!"))
+	defer ps.Close()
+	p := New()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	err := ps.Register(p, map[string]string{"exclude-channels": "#secret", "exclude-users": "carol, *!*@bots.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []string{
+		":alice!a@h JOIN #flocker",
+		":alice!a@h PRIVMSG #flocker :hello",
+		":alice!a@h PRIVMSG #secret :not for the log",
+		":bob!b@h PRIVMSG #flocker :\x01ACTION waves\x01",
+		":bob!b@h PART #secret,#flocker :bye",
+		":carol!c@h PRIVMSG #flocker :hi",
+		":relay!r@bots.example PRIVMSG #flocker :hi",
+		":dave!d@h QUIT :gone",
+		":erin!e@h PRIVMSG #flocker :hi",
+		":erin!e@h NICK :Erin_away",
+		":frank!f@h PRIVMSG #flocker :\x01VERSION\x01",
+	} {
+		p.record(p.pc, irc.ParseMessage(l), nil, nil)
+	}
+	now = now.Add(90 * time.Minute)
+	c := &flockerbot.CommandContext{Bot: b, Identity: flockerbot.Identity{Nick: "zoe"}, Target: "#flocker"}
+	td := map[string]string{
+		"ALICE":     "alice was last seen 1h30m ago, in #flocker, saying: hello.",
+		"bob":       "bob was last seen 1h30m ago, leaving #flocker (bye).",
+		"carol":     "I haven't seen carol.",
+		"relay":     "I haven't seen relay.",
+		"dave":      "I haven't seen dave.",
+		"erin":      "erin was last seen 1h30m ago, changing nick to Erin_away.",
+		"erin_AWAY": "Erin_away was last seen 1h30m ago, changing nick from erin.",
+		"frank":     "I haven't seen frank.",
+		"Zoe":       "That's you.",
+	}
+	for nick, want := range td {
+		if got := p.answer(p.pc, c, nick); got != want {
+			t.Errorf("seen %s: got %q, want %q", nick, got, want)
+		}
+	}
+	r, _ := p.Lookup("bob")
+	now = now.Add(72 * time.Hour)
+	if got := p.answer(p.pc, c, "bob"); got != "bob was last seen 3 days ago, leaving #flocker (bye)." {
+		t.Errorf("Unexpected answer %q", got)
+	}
+	if r.Channel != "#flocker" {
+		t.Errorf("Excluded channel recorded: %v", r)
+	}
+}
+
+func TestSeenHideText(t *testing.T) {
+	b := &flockerbot.Bot{Nick: "flocker"}
+	b.Setup()
+	b.Store = flockerbot.NewMemoryStore()
+	ps := flockerbot.NewPlugins(b, flockerbot.NewRouter("!"))
+	defer ps.Close()
+	p := New()
+	if err := ps.Register(p, map[string]string{"show-text": "false"}); err != nil {
+		t.Fatal(err)
+	}
+	p.record(p.pc, irc.ParseMessage(":alice!a@h PRIVMSG #flocker :secret plans"), nil, nil)
+	c := &flockerbot.CommandContext{Bot: b, Identity: flockerbot.Identity{Nick: "zoe"}, Target: "zoe"}
+	if got := p.answer(p.pc, c, "alice"); got != "alice was last seen 0s ago, in #flocker." {
+		t.Errorf("Unexpected answer %q", got)
+	}
+}
+
+func TestSeenThroughBot(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, l := range []string{
+			":irc.example 001 flocker :Welcome",
+			"@time=2024-01-01T10:00:00.000Z :alice!a@h PRIVMSG #flocker :live",
+			"@time=2024-01-01T09:00:00.000Z :alice!a@h PRIVMSG #flocker :playback",
+			":bob!b@h PRIVMSG #Off :disabled here",
+			":carol!c@h PRIVMSG #flocker :done",
+		} {
+			conn.Write([]byte(l + "\r\n"))
+		}
+		// Drain until the bot disconnects.
+		r := bufio.NewReader(conn)
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+		}
+	}()
+	b := &flockerbot.Bot{ConnectAddress: ln.Addr().String(), Nick: "flocker", User: "flocker", Timeout: 5}
+	b.Setup()
+	b.Store = flockerbot.NewMemoryStore()
+	ps := flockerbot.NewPlugins(b, flockerbot.NewRouter("!"))
+	defer ps.Close()
+	p := New()
+	if err := ps.Register(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Disable("seen", "#off"); err != nil {
+		t.Fatal(err)
+	}
+	go b.Connect()
+	defer b.Disconnect()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := p.Lookup("carol"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Messages not recorded")
+		}
+	}
+	if r, _ := p.Lookup("alice"); r.Text != "live" || !r.Time.Equal(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Server time not used or older message recorded: %v", r)
+	}
+	if r, ok := p.Lookup("bob"); ok {
+		t.Errorf("Message of disabled channel recorded: %v", r)
+	}
+}
+
+func TestSeenExcludedShared(t *testing.T) {
+	b := &flockerbot.Bot{Nick: "flocker"}
+	b.Setup()
+	b.Store = flockerbot.NewMemoryStore()
+	ps := flockerbot.NewPlugins(b, flockerbot.NewRouter("!"))
+	defer ps.Close()
+	p := New()
+	if err := ps.Register(p, map[string]string{"exclude-channels": "#secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Disable("seen", "#off"); err != nil {
+		t.Fatal(err)
+	}
+	p.record(p.pc, irc.ParseMessage(":alice!a@h PRIVMSG #flocker :hello"), nil, nil)
+	p.record(p.pc, irc.ParseMessage(":alice!a@h QUIT :gone"), nil, []string{"#SECRET", "#off"})
+	if r, _ := p.Lookup("alice"); r.Action != ActionMessage {
+		t.Errorf("Quit seen only in excluded channels recorded: %v", r)
+	}
+	p.record(p.pc, irc.ParseMessage(":alice!a@h NICK alice_"), nil, []string{"#secret", "#flocker"})
+	if r, _ := p.Lookup("alice"); r.Action != ActionNick {
+		t.Errorf("Nick change in a public channel not recorded: %v", r)
+	}
+}
+
+func TestSeenNeedsStore(t *testing.T) {
+	b := &flockerbot.Bot{Nick: "flocker"}
+	b.Setup()
+	ps := flockerbot.NewPlugins(b, flockerbot.NewRouter("!"))
+	defer ps.Close()
+	if err := ps.Register(New(), nil); err != flockerbot.ErrNoStore {
+		t.Errorf("Expected ErrNoStore, got %v", err)
+	}
+}
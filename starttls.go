@@ -0,0 +1,140 @@
+package flockerbot
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+var (
+	// ErrStartTLS signals that STARTTLS was required but could not be negotiated
+	ErrStartTLS = errors.New("Bot: STARTTLS failed")
+)
+
+// tlsConfig returns the TLS configuration for ConnectAddress. The certificate is verified against
+// the host name of ConnectAddress unless verify is false.
+func (b *Bot) tlsConfig(verify bool) *tls.Config {
+	serverName, _, _ := net.SplitHostPort(b.ConnectAddress)
+	return &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: !verify,
+	}
+}
+
+// startTLS upgrades the plaintext connection conn to TLS if the server offers the tls capability.
+// It runs before the socket reader is started and before registration, so it talks to conn directly.
+// If the upgrade fails and RequireStartTLS is not set, the plaintext connection is returned. The
+// certificate is verified unless StartTLSAnyCert is set; a failed verification fails the handshake.
+func (b *Bot) startTLS(conn net.Conn) (net.Conn, error) {
+	if b.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(time.Second * time.Duration(b.Timeout)))
+		defer conn.SetDeadline(time.Time{})
+	}
+	fail := func() (net.Conn, error) {
+		if b.RequireStartTLS {
+			return nil, ErrStartTLS
+		}
+		if err := writeLine(conn, "CAP END"); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	if err := writeLine(conn, "CAP LS 302"); err != nil {
+		return nil, err
+	}
+	offered := false
+CapLoop:
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Command {
+		case "PING":
+			if err := writeLine(conn, "PONG :"+msg.Trailing); err != nil {
+				return nil, err
+			}
+		case "421", "451":
+			// Server does not know CAP at all.
+			return fail()
+		case "CAP":
+			if len(msg.Params) < 2 || strings.ToUpper(msg.Params[1]) != "LS" {
+				continue CapLoop
+			}
+			for _, c := range strings.Fields(msg.Trailing) {
+				if name, _, _ := strings.Cut(c, "="); name == "tls" {
+					offered = true
+				}
+			}
+			// "CAP * LS * :..." announces more lines to come.
+			if len(msg.Params) > 2 && msg.Params[2] == "*" {
+				continue CapLoop
+			}
+			break CapLoop
+		}
+	}
+	if !offered {
+		return fail()
+	}
+	if err := writeLine(conn, "STARTTLS"); err != nil {
+		return nil, err
+	}
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Command {
+		case "PING":
+			if err := writeLine(conn, "PONG :"+msg.Trailing); err != nil {
+				return nil, err
+			}
+		case "670": // RPL_STARTTLS
+			tlsSocket := tls.Client(conn, b.tlsConfig(!b.StartTLSAnyCert))
+			if err := tlsSocket.Handshake(); err != nil {
+				// The stream is unusable after a failed handshake.
+				return nil, err
+			}
+			if err := writeLine(tlsSocket, "CAP END"); err != nil {
+				return nil, err
+			}
+			return tlsSocket, nil
+		case "691", "421": // ERR_STARTTLS, ERR_UNKNOWNCOMMAND
+			return fail()
+		}
+	}
+}
+
+// writeLine writes a single protocol line to w.
+func writeLine(w io.Writer, line string) error {
+	_, err := io.WriteString(w, line+"\r\n")
+	return err
+}
+
+// readMessage reads a single message from r. It reads byte by byte so that nothing beyond
+// the line is consumed, which matters when the stream is switched to TLS afterwards.
+func readMessage(r io.Reader) (*irc.Message, error) {
+	var line []byte
+	c := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return nil, err
+		}
+		if c[0] == '\n' {
+			if msg := irc.ParseMessage(string(line)); msg != nil {
+				return msg, nil
+			}
+			line = line[:0]
+			continue
+		}
+		if len(line) > 8192 {
+			return nil, ErrStartTLS
+		}
+		line = append(line, c[0])
+	}
+}
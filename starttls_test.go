@@ -0,0 +1,118 @@
+package flockerbot
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"irc.example"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startTLSServer runs the server side of a STARTTLS upgrade on server with a self-signed
+// certificate. It sends the first line read over TLS, or the handshake error, to done.
+func startTLSServer(t *testing.T, server net.Conn, done chan<- string) {
+	cert := testCertificate(t)
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		if l, _ := r.ReadString('\n'); l != "CAP LS 302\r\n" {
+			done <- "unexpected " + l
+			return
+		}
+		server.Write([]byte(":irc.example CAP * LS * :multi-prefix\r\n:irc.example CAP * LS :tls sasl\r\n"))
+		if l, _ := r.ReadString('\n'); l != "STARTTLS\r\n" {
+			done <- "unexpected " + l
+			return
+		}
+		server.Write([]byte(":irc.example 670 * :STARTTLS successful, go ahead with TLS handshake\r\n"))
+		tlsServer := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := tlsServer.Handshake(); err != nil {
+			done <- err.Error()
+			return
+		}
+		l, _ := bufio.NewReader(tlsServer).ReadString('\n')
+		done <- strings.TrimSpace(l)
+	}()
+}
+
+func TestStartTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan string, 1)
+	startTLSServer(t, server, done)
+	b := &Bot{ConnectAddress: "irc.example:6667", Timeout: 5, RequireStartTLS: true, StartTLSAnyCert: true}
+	conn, err := b.startTLS(client)
+	if err != nil {
+		t.Fatalf("startTLS: %s", err)
+	}
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Error("Connection not upgraded")
+	}
+	if got := <-done; got != "CAP END" {
+		t.Errorf("Expected CAP END over TLS, got %s", got)
+	}
+}
+
+func TestStartTLSVerify(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan string, 1)
+	startTLSServer(t, server, done)
+	// net.Pipe has no buffer, so the failing handshake only returns with the timeout.
+	b := &Bot{ConnectAddress: "irc.example:6667", Timeout: 1, RequireStartTLS: true}
+	var unknown x509.UnknownAuthorityError
+	if _, err := b.startTLS(client); !errors.As(err, &unknown) {
+		t.Errorf("Expected an unknown authority error for a self-signed certificate, got %v", err)
+	}
+	client.Close()
+	<-done
+}
+
+func TestStartTLSNotOffered(t *testing.T) {
+	for _, required := range []bool{false, true} {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			r := bufio.NewReader(server)
+			r.ReadString('\n')
+			server.Write([]byte("PING :cookie\r\n"))
+			r.ReadString('\n')
+			server.Write([]byte(":irc.example CAP * LS :sasl\r\n"))
+			r.ReadString('\n')
+		}()
+		b := &Bot{ConnectAddress: "irc.example:6667", Timeout: 5, RequireStartTLS: required}
+		conn, err := b.startTLS(client)
+		if required && err != ErrStartTLS {
+			t.Errorf("Expected ErrStartTLS, got %v", err)
+		}
+		if !required && (err != nil || conn != client) {
+			t.Errorf("Expected plaintext fallback, got %v", err)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,409 @@
+package flockerbot
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+)
+
+// Channel is a channel the bot is in, as tracked from the server's messages. Returned values are
+// copies and safe to keep.
+type Channel struct {
+	Name    string            // Channel name.
+	Topic   string            // Current topic.
+	Modes   map[byte]string   // Set flags and settings with their parameter, e.g. 'l': "20".
+	Lists   map[byte][]string // Entries of list modes like +b. Complete after FetchList, otherwise as far as seen.
+	Members map[string]string // Nick to status prefixes, highest first, e.g. "@+".
+}
+
+// member is a user in a channel.
+type member struct {
+	nick     string
+	prefixes string
+}
+
+// channelState is the tracked state of a channel.
+type channelState struct {
+	name    string
+	topic   string
+	modes   map[byte]string
+	lists   map[byte][]string
+	pending map[byte][]string  // lists being received
+	members map[string]*member // by folded nick
+}
+
+// state is the client state: the channels we are in and the users in them.
+type state struct {
+	mutex    sync.RWMutex
+	channels map[string]*channelState // by folded name
+	users    map[string]*User         // by folded nick
+}
+
+// newState returns an empty state.
+func newState() *state {
+	return &state{channels: make(map[string]*channelState), users: make(map[string]*User)}
+}
+
+// resetState clears the state, server features and capabilities for a new connection.
+func (b *Bot) resetState() {
+	b.mutex.Lock()
+	b.state = newState()
+	b.isupport = newISupport()
+	b.capsAvailable = make(map[string]string)
+	b.capsEnabled = make(map[string]bool)
+	b.capNegotiating = false
+	b.batches = make(map[string]string)
+	pr := b.presence
+	b.mutex.Unlock()
+	if pr != nil {
+		// The list is armed again at the end of the MOTD.
+		pr.mutex.Lock()
+		pr.ready = false
+		pr.online = make(map[string]bool)
+		pr.polls = nil
+		pr.mutex.Unlock()
+	}
+}
+
+// tracker returns the state of the current connection.
+func (b *Bot) tracker() *state {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.state
+}
+
+// isMe returns true if nick is our nick.
+func (b *Bot) isMe(nick string) bool {
+	return b.EqualFold(nick, b.CurrentNick())
+}
+
+// Channel returns the state of channel name, if we are in it.
+func (b *Bot) Channel(name string) (Channel, bool) {
+	st := b.tracker()
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	cs, ok := st.channels[b.Fold(name)]
+	if !ok {
+		return Channel{}, false
+	}
+	c := Channel{
+		Name:    cs.name,
+		Topic:   cs.topic,
+		Modes:   make(map[byte]string, len(cs.modes)),
+		Lists:   make(map[byte][]string, len(cs.lists)),
+		Members: make(map[string]string, len(cs.members)),
+	}
+	for m, v := range cs.modes {
+		c.Modes[m] = v
+	}
+	for m, l := range cs.lists {
+		c.Lists[m] = append([]string(nil), l...)
+	}
+	for _, mb := range cs.members {
+		c.Members[mb.nick] = mb.prefixes
+	}
+	return c, true
+}
+
+// Channels returns the names of the channels we are in.
+func (b *Bot) Channels() []string {
+	st := b.tracker()
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	names := make([]string, 0, len(st.channels))
+	for _, cs := range st.channels {
+		names = append(names, cs.name)
+	}
+	return names
+}
+
+// track updates the state from msg and its tags. For QUIT and NICK it returns the channels the
+// sender was in, which the state no longer tells once it is updated.
+func (b *Bot) track(msg *irc.Message, tags map[string]string) (shared []string) {
+	p := params(msg)
+	source := ""
+	if msg.Prefix != nil {
+		source = msg.Prefix.Name
+	}
+	arg := func(i int) string {
+		if i < len(p) {
+			return p[i]
+		}
+		return ""
+	}
+	st := b.tracker()
+	switch msg.Command {
+	case "005":
+		if len(p) > 1 {
+			b.ISupport().parse(p[1:])
+		}
+		return
+	case "NICK":
+		if b.isMe(source) {
+			b.mutex.Lock()
+			b.activeNick = arg(0)
+			b.mutex.Unlock()
+		}
+	case "JOIN":
+		if b.isMe(source) {
+			st.mutex.Lock()
+			st.channels[b.Fold(arg(0))] = &channelState{
+				name:    arg(0),
+				modes:   make(map[byte]string),
+				lists:   make(map[byte][]string),
+				pending: make(map[byte][]string),
+				members: make(map[string]*member),
+			}
+			st.mutex.Unlock()
+			b.SendString("MODE " + arg(0))
+			if _, ok := b.ISupport().Get("WHOX"); ok {
+				b.SendString("WHO " + arg(0) + " " + whoxFields + "," + whoxToken)
+			}
+			b.liftPendingBans(arg(0))
+		}
+	}
+	accountTag := b.HasCap("account-tag")
+	var events []Event
+	defer func() {
+		for _, ev := range events {
+			b.emit(ev)
+		}
+	}()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	// userEvent returns an event of type t for the sender, with its tracked state if known.
+	userEvent := func(t EventType) Event {
+		ev := Event{Type: t, Message: msg, Tags: tags}
+		if u := st.users[b.Fold(source)]; u != nil {
+			ev.User = *u
+		} else if msg.Prefix != nil {
+			ev.User = User{Nick: source, User: msg.Prefix.User, Host: msg.Prefix.Host}
+		}
+		return ev
+	}
+	if u := st.users[b.Fold(source)]; u != nil && msg.Prefix != nil && msg.Prefix.User != "" {
+		u.User, u.Host = msg.Prefix.User, msg.Prefix.Host
+		if accountTag {
+			u.Account, u.AccountKnown = tags["account"], true
+		}
+	}
+	switch msg.Command {
+	case "JOIN":
+		if cs := st.channels[b.Fold(arg(0))]; cs != nil {
+			cs.members[b.Fold(source)] = &member{nick: source}
+			u := st.addUser(b, source)
+			u.User, u.Host = msg.Prefix.User, msg.Prefix.Host
+			if len(p) > 2 {
+				// extended-join: channel account :realname
+				u.Account, u.AccountKnown, u.Realname = arg(1), true, arg(2)
+				if u.Account == "*" {
+					u.Account = ""
+				}
+			}
+		}
+	case "PART":
+		for _, name := range strings.Split(arg(0), ",") {
+			st.part(b, name, source)
+		}
+	case "KICK":
+		st.part(b, arg(0), arg(1))
+	case "QUIT":
+		key := b.Fold(source)
+		for _, cs := range st.channels {
+			if cs.members[key] != nil {
+				shared = append(shared, cs.name)
+			}
+			delete(cs.members, key)
+		}
+		delete(st.users, key)
+	case "NICK":
+		key := b.Fold(source)
+		for _, cs := range st.channels {
+			if mb := cs.members[key]; mb != nil {
+				shared = append(shared, cs.name)
+				delete(cs.members, key)
+				mb.nick = arg(0)
+				cs.members[b.Fold(arg(0))] = mb
+			}
+		}
+		if u := st.users[key]; u != nil {
+			delete(st.users, key)
+			u.Nick = arg(0)
+			st.users[b.Fold(arg(0))] = u
+		}
+	case "ACCOUNT":
+		if u := st.users[b.Fold(source)]; u != nil {
+			u.Account, u.AccountKnown = arg(0), true
+			if u.Account == "*" {
+				u.Account = ""
+			}
+		}
+	case "354":
+		// me token user host nick flags account :realname
+		if arg(1) == whoxToken {
+			if u := st.users[b.Fold(arg(4))]; u != nil {
+				u.User, u.Host, u.Account, u.AccountKnown, u.Realname = arg(2), arg(3), arg(6), true, arg(7)
+				u.Away = strings.HasPrefix(arg(5), "G")
+				if u.Account == "0" {
+					u.Account = ""
+				}
+			}
+		}
+	case "AWAY":
+		if u := st.users[b.Fold(source)]; u != nil {
+			u.Away, u.AwayMessage = len(p) > 0, arg(0)
+		}
+		ev := userEvent(EventAway)
+		ev.User.Away, ev.User.AwayMessage = len(p) > 0, arg(0)
+		events = append(events, ev)
+	case "301":
+		// me nick :away message
+		if u := st.users[b.Fold(arg(1))]; u != nil {
+			u.Away, u.AwayMessage = true, arg(2)
+		}
+	case "CHGHOST":
+		if u := st.users[b.Fold(source)]; u != nil {
+			u.User, u.Host = arg(0), arg(1)
+		}
+		ev := userEvent(EventHostChange)
+		ev.User.User, ev.User.Host = arg(0), arg(1)
+		events = append(events, ev)
+	case "SETNAME":
+		if u := st.users[b.Fold(source)]; u != nil {
+			u.Realname = arg(0)
+		}
+		ev := userEvent(EventRealnameChange)
+		ev.User.Realname = arg(0)
+		events = append(events, ev)
+	case "INVITE":
+		// invitee channel
+		ev := userEvent(EventInvite)
+		ev.Target, ev.Channel = arg(0), arg(1)
+		events = append(events, ev)
+	case "330":
+		// me nick account :is logged in as
+		if u := st.users[b.Fold(arg(1))]; u != nil {
+			u.Account, u.AccountKnown = arg(2), true
+		}
+	case "353":
+		// me symbol channel :names
+		cs := st.channels[b.Fold(arg(2))]
+		if cs == nil {
+			break
+		}
+		_, symbols := b.ISupport().Prefix()
+		for _, name := range strings.Fields(arg(3)) {
+			nick := strings.TrimLeft(name, symbols)
+			prefixes := name[:len(name)-len(nick)]
+			// userhost-in-names
+			prefix := irc.ParsePrefix(nick)
+			nick = prefix.Name
+			cs.members[b.Fold(nick)] = &member{nick: nick, prefixes: prefixes}
+			u := st.addUser(b, nick)
+			if prefix.Host != "" {
+				u.User, u.Host = prefix.User, prefix.Host
+			}
+		}
+	case "332":
+		if cs := st.channels[b.Fold(arg(1))]; cs != nil {
+			cs.topic = arg(2)
+		}
+	case "TOPIC":
+		if cs := st.channels[b.Fold(arg(0))]; cs != nil {
+			cs.topic = arg(1)
+		}
+	case "324":
+		if cs := st.channels[b.Fold(arg(1))]; cs != nil {
+			cs.modes = make(map[byte]string)
+			cs.applyModes(b, b.ParseModes(msg))
+		}
+	case "MODE":
+		if cs := st.channels[b.Fold(arg(0))]; cs != nil {
+			cs.applyModes(b, b.ParseModes(msg))
+		}
+	default:
+		mode, end, ok := listMode(msg.Command)
+		cs := st.channels[b.Fold(arg(1))]
+		if !ok || cs == nil {
+			break
+		}
+		if end {
+			// Replace the list with the complete one, which may be empty.
+			cs.lists[mode] = cs.pending[mode]
+			delete(cs.pending, mode)
+		} else if len(msg.Params) > 1 {
+			cs.pending[mode] = append(cs.pending[mode], parseListEntry(msg).Mask)
+		}
+	}
+	return shared
+}
+
+// part removes nick from channel name, or the channel if nick is us. Must be called with mutex held.
+func (st *state) part(b *Bot, name, nick string) {
+	if b.isMe(nick) {
+		delete(st.channels, b.Fold(name))
+		for key := range st.users {
+			st.prune(key)
+		}
+		return
+	}
+	if cs := st.channels[b.Fold(name)]; cs != nil {
+		delete(cs.members, b.Fold(nick))
+		st.prune(b.Fold(nick))
+	}
+}
+
+// applyModes applies changes to the channel. Must be called with mutex held.
+func (cs *channelState) applyModes(b *Bot, changes []ModeChange) {
+	is := b.ISupport()
+	status, symbols := is.Prefix()
+	for _, mc := range changes {
+		switch mc.Type {
+		case ModeStatus:
+			mb := cs.members[b.Fold(mc.Param)]
+			if mb == nil {
+				continue
+			}
+			symbol := symbols[strings.IndexByte(status, mc.Mode)]
+			mb.prefixes = setPrefix(mb.prefixes, symbol, mc.Add, symbols)
+		case ModeList:
+			if mc.Param == "" {
+				continue
+			}
+			list := cs.lists[mc.Mode]
+			for i, entry := range list {
+				if entry == mc.Param {
+					list = append(list[:i], list[i+1:]...)
+					break
+				}
+			}
+			if mc.Add {
+				list = append(list, mc.Param)
+			}
+			cs.lists[mc.Mode] = list
+		default:
+			if mc.Add {
+				cs.modes[mc.Mode] = mc.Param
+			} else {
+				delete(cs.modes, mc.Mode)
+			}
+		}
+	}
+}
+
+// setPrefix adds or removes symbol from prefixes, keeping the order of symbols.
+func setPrefix(prefixes string, symbol byte, add bool, symbols string) string {
+	var sb strings.Builder
+	for i := 0; i < len(symbols); i++ {
+		s := symbols[i]
+		if s == symbol {
+			if add {
+				sb.WriteByte(s)
+			}
+		} else if strings.IndexByte(prefixes, s) >= 0 {
+			sb.WriteByte(s)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,57 @@
+package flockerbot
+
+import (
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestStateTracking(t *testing.T) {
+	b := testBot("flocker")
+	for _, l := range []string{
+		":irc.example 005 flocker PREFIX=(ov)@+ CHANMODES=b,k,l,nt :are supported by this server",
+		":flocker!f@h JOIN #Flocker",
+		":irc.example 353 flocker = #flocker :@alice +bob flocker",
+		":irc.example 332 flocker #flocker :Welcome",
+		":irc.example 324 flocker #flocker +ntl 20",
+		":alice!a@h MODE #flocker +vb-l alice *!*@spam",
+		":carol!c@h JOIN #flocker",
+		":alice!a@h KICK #flocker carol :bye",
+	} {
+		b.track(irc.ParseMessage(l), nil)
+	}
+	if shared := b.track(irc.ParseMessage(":bob!b@h NICK robert"), nil); len(shared) != 1 || shared[0] != "#Flocker" {
+		t.Errorf("Unexpected shared channels of a nick change: %v", shared)
+	}
+	if shared := b.track(irc.ParseMessage(":dave!d@h QUIT :gone"), nil); len(shared) != 0 {
+		t.Errorf("Unexpected shared channels of a stranger: %v", shared)
+	}
+	if l := nextLine(t, b); l != "MODE #Flocker" {
+		t.Errorf("Modes not requested on join: %q", l)
+	}
+	c, ok := b.Channel("#FLOCKER")
+	if !ok {
+		t.Fatal("Channel not tracked")
+	}
+	if c.Topic != "Welcome" || len(c.Modes) != 2 || c.Lists['b'][0] != "*!*@spam" {
+		t.Errorf("Unexpected channel %v", c)
+	}
+	if c.Members["alice"] != "@+" || c.Members["robert"] != "+" || len(c.Members) != 3 {
+		t.Errorf("Unexpected members %v", c.Members)
+	}
+	b.track(irc.ParseMessage(":flocker!f@h NICK flocker2"), nil)
+	b.track(irc.ParseMessage(":flocker2!f@h PART #flocker"), nil)
+	if b.CurrentNick() != "flocker2" || len(b.Channels()) != 0 {
+		t.Errorf("Own nick or part not tracked: %s %v", b.CurrentNick(), b.Channels())
+	}
+}
+
+func TestFloodAfterJoin(t *testing.T) {
+	// The MODE and WHO requests on our join must not block the loop reading the flood.
+	b := &Bot{Nick: "flocker", User: "flocker"}
+	testFlood(t, b, "alice!a@h", 200,
+		":irc.example 001 flocker :Welcome",
+		":irc.example 005 flocker WHOX :are supported by this server",
+		":flocker!u@h JOIN #big",
+	)
+}
@@ -0,0 +1,376 @@
+package flockerbot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrNoStore signals that the bot has no Store configured
+	ErrNoStore = errors.New("Bot: No store configured")
+	// ErrStoreClosed signals an operation on a closed store
+	ErrStoreClosed = errors.New("Bot: Store closed")
+)
+
+// Store is a persistent key-value store. Keys live in namespaces, so features sharing a store
+// do not collide. Implementations must be safe for concurrent use.
+type Store interface {
+	Get(namespace, key string) (value []byte, ok bool, err error) // Returns the value of key.
+	Put(namespace, key string, value []byte) error                // Sets key to value.
+	Delete(namespace, key string) error                           // Removes key. Missing keys are no error.
+	Keys(namespace string) ([]string, error)                      // Returns the sorted keys of namespace.
+	Close() error                                                 // Flushes and releases the store.
+}
+
+// Bucket is a namespace of a Store.
+type Bucket struct {
+	store     Store
+	namespace string
+}
+
+// NewBucket returns the namespace of s.
+func NewBucket(s Store, namespace string) *Bucket {
+	return &Bucket{store: s, namespace: namespace}
+}
+
+// Bucket returns namespace of the bot's Store. Its operations fail with ErrNoStore if Store is nil.
+func (b *Bot) Bucket(namespace string) *Bucket {
+	return NewBucket(b.Store, namespace)
+}
+
+// Namespace returns the name of the bucket.
+func (bk *Bucket) Namespace() string {
+	return bk.namespace
+}
+
+// Get returns the value of key.
+func (bk *Bucket) Get(key string) ([]byte, bool, error) {
+	if bk.store == nil {
+		return nil, false, ErrNoStore
+	}
+	return bk.store.Get(bk.namespace, key)
+}
+
+// Put sets key to value.
+func (bk *Bucket) Put(key string, value []byte) error {
+	if bk.store == nil {
+		return ErrNoStore
+	}
+	return bk.store.Put(bk.namespace, key, value)
+}
+
+// Delete removes key.
+func (bk *Bucket) Delete(key string) error {
+	if bk.store == nil {
+		return ErrNoStore
+	}
+	return bk.store.Delete(bk.namespace, key)
+}
+
+// Keys returns the sorted keys of the bucket.
+func (bk *Bucket) Keys() ([]string, error) {
+	if bk.store == nil {
+		return nil, ErrNoStore
+	}
+	return bk.store.Keys(bk.namespace)
+}
+
+// GetJSON decodes the value of key into v. Returns false if key does not exist.
+func (bk *Bucket) GetJSON(key string, v interface{}) (bool, error) {
+	data, ok, err := bk.Get(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// PutJSON sets key to v, encoded as JSON.
+func (bk *Bucket) PutJSON(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bk.Put(key, data)
+}
+
+// MemoryStore is a Store in memory, for tests and bots that need no persistence.
+type MemoryStore struct {
+	mutex sync.RWMutex
+	data  map[string]map[string][]byte
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string]map[string][]byte)}
+}
+
+// Get implements Store.
+func (s *MemoryStore) Get(namespace, key string) ([]byte, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	value, ok := s.data[namespace][key]
+	return append([]byte(nil), value...), ok, nil
+}
+
+// Put implements Store.
+func (s *MemoryStore) Put(namespace, key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	storePut(s.data, namespace, key, append([]byte(nil), value...))
+	return nil
+}
+
+// Delete implements Store.
+func (s *MemoryStore) Delete(namespace, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	storeDelete(s.data, namespace, key)
+	return nil
+}
+
+// Keys implements Store.
+func (s *MemoryStore) Keys(namespace string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return sortedKeys(s.data[namespace]), nil
+}
+
+// Close implements Store.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// compactMinGarbage is the number of obsolete records in a FileStore before it is compacted,
+// if they also outnumber the live ones.
+const compactMinGarbage = 1000
+
+// FileStore is a Store in a single file of JSON lines, one record per change. The file is loaded
+// into memory on open and compacted when obsolete records dominate.
+type FileStore struct {
+	mutex   sync.RWMutex
+	path    string
+	file    *os.File
+	data    map[string]map[string][]byte
+	live    int // number of keys
+	garbage int // number of obsolete records in the file
+}
+
+// storeRecord is a line of a FileStore file. Value is nil for deletions.
+type storeRecord struct {
+	Namespace string `json:"ns"`
+	Key       string `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+	Delete    bool   `json:"delete,omitempty"`
+}
+
+// OpenFileStore opens or creates the store in file path. Broken lines, e.g. a last line cut
+// short by a crash while writing, are skipped and removed by compacting the file.
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, data: make(map[string]map[string][]byte)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	lines := bytes.Split(data, []byte{'\n'})
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var r storeRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			s.garbage++
+			continue
+		}
+		s.apply(r)
+	}
+	if s.garbage > 0 || len(lines[len(lines)-1]) > 0 {
+		// Rewrite, as appending to a broken or unterminated line would break the next record.
+		if err := s.compact(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	s.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// apply applies r to the data in memory and updates the counters.
+func (s *FileStore) apply(r storeRecord) {
+	_, exists := s.data[r.Namespace][r.Key]
+	if exists {
+		s.garbage++
+	}
+	if r.Delete {
+		if exists {
+			s.garbage++ // the deletion itself
+			s.live--
+		}
+		storeDelete(s.data, r.Namespace, r.Key)
+		return
+	}
+	if !exists {
+		s.live++
+	}
+	storePut(s.data, r.Namespace, r.Key, r.Value)
+}
+
+// write appends r to the file and applies it. The caller holds the mutex.
+func (s *FileStore) write(r storeRecord) error {
+	if s.file == nil {
+		return ErrStoreClosed
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.apply(r)
+	if s.garbage >= compactMinGarbage && s.garbage > s.live {
+		return s.compact()
+	}
+	return nil
+}
+
+// Get implements Store.
+func (s *FileStore) Get(namespace, key string) ([]byte, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	value, ok := s.data[namespace][key]
+	return append([]byte(nil), value...), ok, nil
+}
+
+// Put implements Store.
+func (s *FileStore) Put(namespace, key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(storeRecord{Namespace: namespace, Key: key, Value: append([]byte{}, value...)})
+}
+
+// Delete implements Store.
+func (s *FileStore) Delete(namespace, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.data[namespace][key]; !ok {
+		return nil
+	}
+	return s.write(storeRecord{Namespace: namespace, Key: key, Delete: true})
+}
+
+// Keys implements Store.
+func (s *FileStore) Keys(namespace string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return sortedKeys(s.data[namespace]), nil
+}
+
+// Compact rewrites the file with only the current values.
+func (s *FileStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return ErrStoreClosed
+	}
+	return s.compact()
+}
+
+// compact writes the current values to a new file and replaces the old one with it. The caller
+// holds the mutex.
+func (s *FileStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	namespaces := make([]string, 0, len(s.data))
+	for ns := range s.data {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		for _, key := range sortedKeys(s.data[ns]) {
+			if err = enc.Encode(storeRecord{Namespace: ns, Key: key, Value: s.data[ns][key]}); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.garbage = 0
+	return nil
+}
+
+// Close implements Store.
+func (s *FileStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
+
+// storePut sets data[namespace][key].
+func storePut(data map[string]map[string][]byte, namespace, key string, value []byte) {
+	ns, ok := data[namespace]
+	if !ok {
+		ns = make(map[string][]byte)
+		data[namespace] = ns
+	}
+	ns[key] = value
+}
+
+// storeDelete removes data[namespace][key] and empty namespaces.
+func storeDelete(data map[string]map[string][]byte, namespace, key string) {
+	delete(data[namespace], key)
+	if len(data[namespace]) == 0 {
+		delete(data, namespace)
+	}
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,89 @@
+package flockerbot
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.db")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := NewBucket(s, "seen")
+	if err := seen.PutJSON("alice", map[string]string{"channel": "#flocker"}); err != nil {
+		t.Fatal(err)
+	}
+	seen.Put("bob", []byte("x"))
+	seen.Delete("bob")
+	NewBucket(s, "karma").Put("alice", []byte("3"))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of a write.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"ns":"seen","key":"car`)
+	f.Close()
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var v map[string]string
+	if ok, err := NewBucket(s, "seen").GetJSON("alice", &v); !ok || err != nil || v["channel"] != "#flocker" {
+		t.Errorf("Unexpected value %v %v %v", v, ok, err)
+	}
+	if keys, _ := s.Keys("seen"); !reflect.DeepEqual(keys, []string{"alice"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	if value, ok, _ := s.Get("karma", "alice"); !ok || string(value) != "3" {
+		t.Errorf("Namespaces mixed up: %q", value)
+	}
+	data, _ := os.ReadFile(path)
+	if want := `{"ns":"karma","key":"alice","value":"Mw=="}` + "\n" + `{"ns":"seen","key":"alice","value":"eyJjaGFubmVsIjoiI2Zsb2NrZXIifQ=="}` + "\n"; string(data) != want {
+		t.Errorf("File not compacted:\n%s", data)
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.db")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < compactMinGarbage+1; i++ {
+		if err := s.Put("counter", "n", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.garbage >= compactMinGarbage {
+		t.Errorf("Not compacted, %d obsolete records", s.garbage)
+	}
+	s2, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if value, _, _ := s2.Get("counter", "n"); string(value) != strconv.Itoa(compactMinGarbage) {
+		t.Errorf("Unexpected value %v", value)
+	}
+}
+
+func TestBucketWithoutStore(t *testing.T) {
+	b := &Bot{}
+	if err := b.Bucket("seen").Put("alice", nil); err != ErrNoStore {
+		t.Errorf("Expected ErrNoStore, got %v", err)
+	}
+	b.Store = NewMemoryStore()
+	b.Bucket("seen").Put("alice", []byte("x"))
+	if value, ok, _ := b.Bucket("seen").Get("alice"); !ok || string(value) != "x" {
+		t.Errorf("Unexpected value %q", value)
+	}
+}
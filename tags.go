@@ -0,0 +1,116 @@
+package flockerbot
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// parseTags splits the IRCv3 message tags from line. It returns the tags, or nil if there are
+// none, and the line without them.
+func parseTags(line string) (map[string]string, string) {
+	raw, rest := cutTags(line)
+	if raw == "" {
+		return nil, line
+	}
+	return parseTagList(raw), rest
+}
+
+// parseTagList decodes tags in the wire format key=value;key2, without @.
+func parseTagList(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(tag, "=")
+		tags[key] = unescapeTag(value)
+	}
+	return tags
+}
+
+// cutTags splits line into the raw tags, without @, and the rest. raw is empty if there are none.
+func cutTags(line string) (raw, rest string) {
+	if !strings.HasPrefix(line, "@") {
+		return "", line
+	}
+	raw, rest, _ = strings.Cut(line[1:], " ")
+	return raw, strings.TrimLeft(rest, " ")
+}
+
+// withTags prepends tags to line, in key order.
+func withTags(tags map[string]string, line string) string {
+	if len(tags) == 0 {
+		return line
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteByte(';')
+		} else {
+			sb.WriteByte('@')
+		}
+		sb.WriteString(k)
+		if v := tags[k]; v != "" {
+			sb.WriteByte('=')
+			sb.WriteString(escapeTag(v))
+		}
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(line)
+	return sb.String()
+}
+
+// serverTime returns the time of the server-time tag, or the zero time if it is missing or invalid.
+func serverTime(tags map[string]string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, tags["time"])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// escapeTag encodes a tag value.
+func escapeTag(value string) string {
+	return tagEscaper.Replace(value)
+}
+
+var tagEscaper = strings.NewReplacer(`\`, `\\`, ";", `\:`, " ", `\s`, "\r", `\r`, "\n", `\n`)
+
+// unescapeTag decodes a tag value. Unknown escapes yield the character, a trailing lone
+// backslash is dropped.
+func unescapeTag(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(value) {
+			break
+		}
+		switch value[i] {
+		case ':':
+			sb.WriteByte(';')
+		case 's':
+			sb.WriteByte(' ')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'n':
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(value[i])
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,200 @@
+package flockerbot
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// ts6Capab are the capabilities we announce. EUID and ENCAP are required by charybdis/solanum
+// to send accounts and hosts.
+const ts6Capab = "QS EX IE KLN UNKLN ENCAP TB SERVICES EUID EOPMOD MLOCK"
+
+// TS6 implements the TS6 server protocol of charybdis, solanum and ratbox. It is the default
+// LinkProtocol.
+type TS6 struct{}
+
+func (TS6) register(b *Bot) {
+	b.SendString("PASS " + b.Password + " TS 6 :" + b.SID)
+	b.SendString("CAPAB :" + ts6Capab)
+	b.SendString("SERVER " + b.User + " 1 :" + b.serverDesc())
+	b.SendString("SVINFO 6 6 0 :" + strconv.FormatInt(now(), 10))
+}
+
+// burst sends our burst, which is terminated by a PING the uplink answers when it processed it.
+func (TS6) burst(b *Bot) {
+	b.burstPseudoClients()
+	b.SendAsServer("PING " + b.User + " :" + b.uplinkSID())
+}
+
+func (TS6) introduce(b *Bot, pc *PseudoClient) {
+	b.SendAsServer("UID " + pc.Nick + " 1 " + strconv.FormatInt(pc.timestamp(), 10) + " " + pc.Modes + " " + pc.User + " " + pc.Host + " 0 " + pc.uid + " :" + pc.Realname)
+}
+
+func (TS6) join(b *Bot, pc *PseudoClient, channel string, ts int64) {
+	b.SendAsServer("SJOIN " + strconv.FormatInt(ts, 10) + " " + channel + " + :" + pc.uid)
+}
+
+func (TS6) mode(b *Bot, pc *PseudoClient, channel string, ts int64, modes string, args []string) {
+	pc.Send(strings.TrimSpace("TMODE " + strconv.FormatInt(ts, 10) + " " + channel + " " + modes + " " + strings.Join(args, " ")))
+}
+
+func (TS6) ping(b *Bot) {
+	// Servers answer with their name instead of a token, see handle.
+	b.SendAsServer("PING " + b.User + " :" + b.uplinkSID())
+}
+
+func (TS6) caseMapping() CaseMapping {
+	return CaseRFC1459
+}
+
+func (TS6) chanModes() []string {
+	// TS6 does not announce channel modes; these are the ones of solanum.
+	return []string{"CHANMODES=eIbq,k,flj,CFLMPQRScgimnprstuz", "PREFIX=(ohv)@%+"}
+}
+
+func (t TS6) handle(b *Bot, msg *irc.Message) (bool, error) {
+	ls := b.Link()
+	source := ""
+	if msg.Prefix != nil {
+		source = msg.Prefix.Name
+	}
+	p := params(msg)
+	arg := func(i int) string {
+		if i < len(p) {
+			return p[i]
+		}
+		return ""
+	}
+	if b.handleLinkCommon(msg, p) {
+		return true, nil
+	}
+	switch msg.Command {
+	case "PASS":
+		b.setRemoteSID(arg(3))
+		if b.AcceptPassword != "" && arg(0) != b.AcceptPassword {
+			return false, ErrLinkPassword
+		}
+	case "CAPAB":
+	case "SERVER":
+		if source == "" {
+			ls.addServer(&LinkServer{SID: b.uplinkSID(), Name: arg(0), Description: arg(2)})
+		}
+	case "SVINFO":
+		if v, _ := strconv.Atoi(arg(0)); v < 6 {
+			return false, ErrLinkProtocol
+		}
+		t.burst(b)
+	case "SID":
+		ls.addServer(&LinkServer{SID: arg(2), Name: arg(0), Description: arg(3), Uplink: source})
+	case "UID":
+		// nick hops ts umodes user host ip uid :gecos
+		ts, _ := strconv.ParseInt(arg(2), 10, 64)
+		ls.addUser(&LinkUser{UID: arg(7), Nick: arg(0), TS: ts, Modes: arg(3), User: arg(4), Host: arg(5), IP: arg(6), Realname: arg(8), Server: source})
+	case "EUID":
+		// nick hops ts umodes user host ip uid realhost account :gecos
+		ts, _ := strconv.ParseInt(arg(2), 10, 64)
+		u := &LinkUser{UID: arg(7), Nick: arg(0), TS: ts, Modes: arg(3), User: arg(4), Host: arg(5), IP: arg(6), RealHost: arg(8), Account: arg(9), Realname: arg(10), Server: source}
+		if u.RealHost == "*" {
+			u.RealHost = ""
+		}
+		if u.Account == "*" {
+			u.Account = ""
+		}
+		ls.addUser(u)
+	case "SJOIN":
+		// ts channel modes [mode args] :members
+		if len(p) < 4 {
+			break
+		}
+		ts, _ := strconv.ParseInt(arg(0), 10, 64)
+		channel := arg(1)
+		ls.joinChannel(channel, ts, "", "")
+		ls.updateChannel(channel, func(c *LinkChannel) {
+			if ts <= c.TS {
+				applyModes(c, ls.modes, arg(2), p[3:len(p)-1])
+			}
+		})
+		for _, member := range strings.Fields(p[len(p)-1]) {
+			uid := strings.TrimLeft(member, "@+%")
+			ls.joinChannel(channel, ts, uid, member[:len(member)-len(uid)])
+		}
+	case "JOIN":
+		if arg(0) == "0" {
+			ls.partAll(source)
+			return true, nil
+		}
+		ts, _ := strconv.ParseInt(arg(0), 10, 64)
+		ls.joinChannel(arg(1), ts, source, "")
+		return true, nil
+	case "TMODE":
+		ts, _ := strconv.ParseInt(arg(0), 10, 64)
+		ls.updateChannel(arg(1), func(c *LinkChannel) {
+			if ts <= c.TS && len(p) > 2 {
+				applyModes(c, ls.modes, arg(2), p[3:])
+			}
+		})
+		return true, nil
+	case "MODE":
+		// User mode change: ":UID MODE UID :+i"
+		ls.updateUser(arg(0), func(u *LinkUser) {
+			u.Modes = mergeUserModes(u.Modes, arg(1))
+		})
+		return true, nil
+	case "TOPIC":
+		ls.updateChannel(arg(0), func(c *LinkChannel) {
+			c.Topic = arg(1)
+		})
+		return true, nil
+	case "TB":
+		// channel topicts [setter] :topic
+		ls.updateChannel(arg(0), func(c *LinkChannel) {
+			c.Topic = p[len(p)-1]
+		})
+	case "CHGHOST":
+		ls.updateUser(arg(0), func(u *LinkUser) {
+			u.Host = arg(1)
+		})
+		return true, nil
+	case "ENCAP":
+		// target subcommand args...
+		switch arg(1) {
+		case "LOGIN":
+			ls.updateUser(source, func(u *LinkUser) {
+				u.Account = arg(2)
+			})
+		case "SU":
+			ls.updateUser(arg(2), func(u *LinkUser) {
+				u.Account = arg(3)
+			})
+		case "CHGHOST":
+			ls.updateUser(arg(2), func(u *LinkUser) {
+				u.Host = arg(3)
+			})
+		case "REALHOST":
+			ls.updateUser(source, func(u *LinkUser) {
+				u.RealHost = arg(2)
+			})
+		}
+		return true, nil
+	case "PING":
+		// "PING :origin" or ":SID PING origin :destination"
+		origin := source
+		if origin == "" {
+			origin = arg(0)
+		}
+		b.SendAsServer("PONG " + b.User + " :" + origin)
+		if !b.Connected() {
+			// The first PING of the uplink ends its burst.
+			b.linkEstablished(msg)
+		}
+	case "PONG":
+		if token := b.oldestPing(); token != "" {
+			b.handlePong(token)
+		}
+	default:
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,112 @@
+package flockerbot
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestTS6Burst(t *testing.T) {
+	b := &Bot{IsServer: true, User: "flocker.example", SID: "42X", Password: "pw", AcceptPassword: "pw"}
+	b.Setup()
+	b.socketChan = make(chan *channelString, 64)
+	b.linkRegister()
+	var got []*irc.Message
+	b.Handler = func(msg *irc.Message) {}
+	sub := b.Subscribe(FilterCommand("PRIVMSG", "QUIT"))
+	for _, l := range []string{
+		"PASS pw TS 6 :42A",
+		"CAPAB :QS EX IE KLN UNKLN ENCAP TB SERVICES EUID",
+		"SERVER irc.example 1 :Example server",
+		"SVINFO 6 6 0 :1700000000",
+		":42A SID leaf.example 2 42B :Leaf",
+		":42A EUID alice 1 1600000000 +i ~alice host.example 10.0.0.1 42AAAAAAA * alice :Alice",
+		":42B UID bob 2 1600000001 +i ~bob bob.example 10.0.0.2 42BAAAAAA :Bob",
+		":42A SJOIN 1500000000 #flocker +nt :@42AAAAAAA 42BAAAAAA",
+		":42A PING :42A",
+		":42BAAAAAA PRIVMSG #flocker :hello",
+		":42AAAAAAA PRIVMSG 42BAAAAAA :psst",
+		":42BAAAAAA NICK robert :1600000002",
+		":42AAAAAAA TMODE 1500000000 #flocker +v 42BAAAAAA",
+		":42AAAAAAA TMODE 1500000000 #flocker +qo-o *!*@spam 42BAAAAAA 42AAAAAAA",
+		":42AAAAAAA TMODE 1500000000 #flocker +v 42AAAAAAA",
+		":42A SQUIT 42B :split",
+	} {
+		if err := b.handleLink(irc.ParseMessage(l)); err != nil {
+			t.Fatalf("handleLink(%s): %s", l, err)
+		}
+	}
+	if !b.Connected() {
+		t.Error("Link not established after uplink PING")
+	}
+	ls := b.Link()
+	if u, ok := ls.UserByNick("ALICE"); !ok || u.Account != "alice" || u.Server != "42A" {
+		t.Errorf("Unexpected user %v", u)
+	}
+	if _, ok := ls.User("42BAAAAAA"); ok {
+		t.Error("Users of split server not removed")
+	}
+	c, ok := ls.Channel("#flocker")
+	if !ok || c.Modes != "+nt" || c.Members["42AAAAAAA"] != "+" || len(c.Members) != 1 {
+		t.Errorf("Unexpected channel %v", c)
+	}
+	ev := <-sub.C
+	got = append(got, ev.Message)
+	if got[0].Prefix.Name != "bob" || got[0].Prefix.Host != "bob.example" {
+		t.Errorf("Source not translated: %v", got[0].Prefix)
+	}
+	if ev = <-sub.C; ev.Message.Prefix.Name != "alice" || ev.Message.Params[0] != "bob" {
+		t.Errorf("Target not translated: %v", ev.Message)
+	}
+	lines := make([]string, 0)
+	for len(b.socketChan) > 0 {
+		lines = append(lines, (<-b.socketChan).Data)
+	}
+	want := []string{"PASS pw TS 6 :42X\r\n", "CAPAB :" + ts6Capab + "\r\n", "SERVER flocker.example 1 :flockerbot\r\n"}
+	for i, w := range want {
+		if lines[i] != w {
+			t.Errorf("Line %d: got %q, want %q", i, lines[i], w)
+		}
+	}
+	if lines[4] != ":42X PING flocker.example :42A\r\n" || lines[5] != ":42X PONG flocker.example :42A\r\n" {
+		t.Errorf("Unexpected burst end / pong: %q", lines[4:])
+	}
+}
+
+func TestTS6Password(t *testing.T) {
+	b := &Bot{IsServer: true, User: "flocker.example", SID: "42X", AcceptPassword: "pw"}
+	b.Setup()
+	b.socketChan = make(chan *channelString, 8)
+	b.linkRegister()
+	if err := b.handleLink(irc.ParseMessage("PASS wrong TS 6 :42A")); err != ErrLinkPassword {
+		t.Errorf("Expected ErrLinkPassword, got %v", err)
+	}
+	if validSID("42x") || validSID("A2X") || !validSID("0AB") {
+		t.Error("validSID")
+	}
+}
+
+// addPseudoClients adds n pseudo-clients to b, to make its burst large.
+func addPseudoClients(t *testing.T, b *Bot, n int) {
+	b.Setup()
+	for i := 0; i < n; i++ {
+		if err := b.AddPseudoClient(&PseudoClient{Nick: "Helper" + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTS6Flood(t *testing.T) {
+	// The burst and PONGs are sent from the loop while the uplink bursts.
+	b := &Bot{IsServer: true, User: "flocker.example", SID: "42X", Password: "pw"}
+	addPseudoClients(t, b, 100)
+	testFlood(t, b, "42AAAAAAA", 500,
+		"PASS pw TS 6 :42A",
+		"CAPAB :QS EX IE KLN UNKLN ENCAP TB SERVICES EUID",
+		"SERVER irc.example 1 :Example server",
+		"SVINFO 6 6 0 :1700000000",
+		":42A UID alice 1 1600000000 +i ~alice host.example 10.0.0.1 42AAAAAAA :Alice",
+		":42A PING :42A",
+	)
+}
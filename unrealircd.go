@@ -0,0 +1,229 @@
+package flockerbot
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// unrealProtoctl are the protocol options we announce besides EAUTH and SID.
+const unrealProtoctl = "NOQUIT NICKv2 SJOIN SJ3 CLK NICKIP TKLEXT2 MLOCK ESVID EXTSWHOIS"
+
+// unrealStatus maps UnrealIRCd SJOIN member prefixes to status mode letters.
+var unrealStatus = map[rune]string{'*': "q", '~': "a", '@': "o", '%': "h", '+': "v"}
+
+// UnrealIRCd implements the server protocol of UnrealIRCd 6.
+type UnrealIRCd struct{}
+
+func (UnrealIRCd) register(b *Bot) {
+	b.SendString("PASS :" + b.Password)
+	b.SendString("PROTOCTL EAUTH=" + b.User + " SID=" + b.SID)
+	b.SendString("PROTOCTL " + unrealProtoctl)
+	b.SendString("SERVER " + b.User + " 1 :" + b.serverDesc())
+}
+
+// burst sends our burst, which is terminated by EOS.
+func (UnrealIRCd) burst(b *Bot) {
+	b.burstPseudoClients()
+	b.SendAsServer("EOS")
+}
+
+func (UnrealIRCd) introduce(b *Bot, pc *PseudoClient) {
+	// nick hops ts user host uid servicestamp umodes virthost cloakedhost ip :gecos
+	b.SendAsServer("UID " + pc.Nick + " 1 " + strconv.FormatInt(pc.timestamp(), 10) + " " + pc.User + " " + pc.Host + " " + pc.uid + " 0 " + pc.Modes + " * * * :" + pc.Realname)
+}
+
+func (UnrealIRCd) join(b *Bot, pc *PseudoClient, channel string, ts int64) {
+	b.SendAsServer("SJOIN " + strconv.FormatInt(ts, 10) + " " + channel + " :" + pc.uid)
+}
+
+func (UnrealIRCd) mode(b *Bot, pc *PseudoClient, channel string, ts int64, modes string, args []string) {
+	line := "MODE " + channel + " " + modes
+	if len(args) > 0 {
+		line += " " + strings.Join(args, " ")
+	}
+	pc.Send(line + " " + strconv.FormatInt(ts, 10))
+}
+
+func (UnrealIRCd) ping(b *Bot) {
+	b.SendAsServer("PING " + b.User + " :" + b.uplinkSID())
+}
+
+func (UnrealIRCd) caseMapping() CaseMapping {
+	return CaseASCII
+}
+
+func (UnrealIRCd) chanModes() []string {
+	// Replaced by those announced with PROTOCTL.
+	return []string{"CHANMODES=beI,fkL,lH,cdimnprstzCDGKMNOPQRSTVZ", "PREFIX=(qaohv)~&@%+"}
+}
+
+func (u UnrealIRCd) handle(b *Bot, msg *irc.Message) (bool, error) {
+	ls := b.Link()
+	source := ""
+	if msg.Prefix != nil {
+		source = msg.Prefix.Name
+	}
+	p := params(msg)
+	arg := func(i int) string {
+		if i < len(p) {
+			return p[i]
+		}
+		return ""
+	}
+	if b.handleLinkCommon(msg, p) {
+		return true, nil
+	}
+	switch msg.Command {
+	case "PASS":
+		if b.AcceptPassword != "" && arg(0) != b.AcceptPassword {
+			return false, ErrLinkPassword
+		}
+	case "PROTOCTL":
+		for _, o := range p {
+			if sid, ok := strings.CutPrefix(o, "SID="); ok {
+				b.setRemoteSID(sid)
+			}
+			if strings.HasPrefix(o, "CHANMODES=") || strings.HasPrefix(o, "PREFIX=") {
+				ls.modes.parse([]string{o})
+			}
+		}
+	case "SERVER":
+		if source == "" {
+			ls.addServer(&LinkServer{SID: b.uplinkSID(), Name: arg(0), Description: p[len(p)-1]})
+			u.burst(b)
+		}
+	case "SID":
+		// name hops sid :desc
+		ls.addServer(&LinkServer{SID: arg(2), Name: arg(0), Description: arg(3), Uplink: source})
+	case "EOS":
+		if source == b.uplinkSID() && !b.Connected() {
+			b.linkEstablished(msg)
+		}
+	case "NETINFO":
+	case "UID":
+		// nick hops ts user host uid servicestamp umodes virthost cloakedhost ip :gecos
+		if len(p) < 12 {
+			break
+		}
+		ts, _ := strconv.ParseInt(arg(2), 10, 64)
+		lu := &LinkUser{UID: arg(5), Nick: arg(0), TS: ts, User: arg(3), Host: arg(4), Modes: arg(7), IP: arg(10), Realname: arg(11), Server: source}
+		if account := arg(6); account != "0" && account != "*" {
+			lu.Account = account
+		}
+		if strings.Contains(lu.Modes, "x") {
+			lu.RealHost = lu.Host
+			if arg(8) != "*" {
+				lu.Host = arg(8)
+			} else if arg(9) != "*" {
+				lu.Host = arg(9)
+			}
+		}
+		ls.addUser(lu)
+	case "SJOIN":
+		// ts channel [modes [mode args]] :members
+		if len(p) < 3 {
+			break
+		}
+		ts, _ := strconv.ParseInt(arg(0), 10, 64)
+		channel := arg(1)
+		ls.joinChannel(channel, ts, "", "")
+		if len(p) > 3 {
+			ls.updateChannel(channel, func(c *LinkChannel) {
+				if ts <= c.TS {
+					applyModes(c, ls.modes, arg(2), p[3:len(p)-1])
+				}
+			})
+		}
+		for _, member := range strings.Fields(p[len(p)-1]) {
+			if strings.ContainsAny(member[:1], "&\"'") {
+				// Bans, exempts and invite exceptions.
+				continue
+			}
+			uid := strings.TrimLeft(member, "*~@%+")
+			modes := ""
+			for _, c := range member[:len(member)-len(uid)] {
+				modes += unrealStatus[c]
+			}
+			ls.joinChannel(channel, ts, uid, ls.statusPrefixes(modes))
+		}
+	case "JOIN":
+		for _, channel := range strings.Split(arg(0), ",") {
+			if channel == "0" {
+				ls.partAll(source)
+				continue
+			}
+			ls.joinChannel(channel, 0, source, "")
+		}
+		return true, nil
+	case "MODE":
+		// channel modes [args] [ts], or nick modes
+		if !strings.HasPrefix(arg(0), "#") {
+			u.userMode(ls, arg(0), arg(1))
+			return true, nil
+		}
+		var args []string
+		if len(p) > 2 {
+			args = make([]string, len(p)-2)
+			for i, a := range p[2:] {
+				args[i] = a
+				if lu, ok := ls.UserByNick(a); ok {
+					args[i] = lu.UID
+				}
+			}
+		}
+		ls.updateChannel(arg(0), func(c *LinkChannel) {
+			applyModes(c, ls.modes, arg(1), args)
+		})
+		return true, nil
+	case "UMODE2":
+		u.userMode(ls, source, arg(0))
+		return true, nil
+	case "SVSLOGIN":
+		// mask uid account
+		ls.updateUser(arg(1), func(lu *LinkUser) {
+			lu.Account = arg(2)
+			if lu.Account == "0" {
+				lu.Account = ""
+			}
+		})
+	case "SETHOST":
+		ls.updateUser(source, func(lu *LinkUser) {
+			lu.Host = arg(0)
+		})
+		return true, nil
+	case "CHGHOST":
+		ls.updateUser(arg(0), func(lu *LinkUser) {
+			lu.Host = arg(1)
+		})
+		return true, nil
+	case "TOPIC":
+		// channel [setter ts] :topic
+		ls.updateChannel(arg(0), func(c *LinkChannel) {
+			c.Topic = p[len(p)-1]
+		})
+		return true, nil
+	case "PING":
+		// "PING :origin" or ":SID PING origin :destination"
+		origin := arg(0)
+		b.SendAsServer("PONG " + b.User + " :" + origin)
+	case "PONG":
+		if token := b.oldestPing(); token != "" {
+			b.handlePong(token)
+		}
+	default:
+		return true, nil
+	}
+	return false, nil
+}
+
+// userMode applies a user mode change to the user with uid or nick target.
+func (UnrealIRCd) userMode(ls *LinkState, target, change string) {
+	if lu, ok := ls.UserByNick(target); ok {
+		target = lu.UID
+	}
+	ls.updateUser(target, func(lu *LinkUser) {
+		lu.Modes = mergeUserModes(lu.Modes, change)
+	})
+}
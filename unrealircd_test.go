@@ -0,0 +1,75 @@
+package flockerbot
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestUnrealIRCdBurst(t *testing.T) {
+	b := &Bot{IsServer: true, User: "flocker.example", SID: "42X", Password: "pw", AcceptPassword: "pw", LinkProtocol: UnrealIRCd{}}
+	b.Setup()
+	b.socketChan = make(chan *channelString, 64)
+	b.linkRegister()
+	b.AddPseudoClient(&PseudoClient{Nick: "Helper"})
+	for _, l := range []string{
+		"PASS :pw",
+		"PROTOCTL EAUTH=irc.example,6000 SID=001",
+		"PROTOCTL NOQUIT NICKv2 SJOIN SJ3 CHANMODES=beI,fkL,lH,cdimnprstzCDGKMNOPQRSTVZ PREFIX=(qaohv)~&@%+",
+		"SERVER irc.example 1 :U6000-Fhn6OoEmM-001 Example server",
+		":001 UID alice 0 1600000000 ~alice real.example 001AAAAAA alice +ixw * cloak.example CgAAAQ== :Alice",
+		":001 UID bob 0 1600000001 ~bob bob.example 001AAAAAB 0 +i * * CgAAAg== :Bob",
+		":001 SJOIN 1500000000 #flocker +nt :*001AAAAAA +001AAAAAB &*!*@bad.example",
+		":001 TOPIC #flocker alice 1500000001 :Welcome",
+		":001 SVSLOGIN * 001AAAAAB bob",
+		":001 EOS",
+		":001AAAAAB UMODE2 +x",
+		":001AAAAAA MODE #flocker -v bob 1500000000",
+		":001AAAAAA MODE #flocker +qaol bob bob bob 20 1500000000",
+		":001 PING irc.example :flocker.example",
+	} {
+		if err := b.handleLink(irc.ParseMessage(l)); err != nil {
+			t.Fatalf("handleLink(%s): %s", l, err)
+		}
+	}
+	if !b.Connected() {
+		t.Error("Link not established after EOS")
+	}
+	ls := b.Link()
+	if u, ok := ls.User("001AAAAAA"); !ok || u.Account != "alice" || u.Host != "cloak.example" || u.RealHost != "real.example" {
+		t.Errorf("Unexpected user %v", u)
+	}
+	if u, ok := ls.UserByNick("bob"); !ok || u.Account != "bob" || u.Modes != "+ix" {
+		t.Errorf("Unexpected user %v", u)
+	}
+	c, ok := ls.Channel("#flocker")
+	if !ok || c.Modes != "+nt" || c.Topic != "Welcome" || c.Members["001AAAAAA"] != "~" || c.Members["001AAAAAB"] != "~&@" || len(c.Members) != 2 {
+		t.Errorf("Unexpected channel %v", c)
+	}
+	lines := make([]string, 0)
+	for len(b.socketChan) > 0 {
+		lines = append(lines, (<-b.socketChan).Data)
+	}
+	want := []string{"PASS :pw\r\n", "PROTOCTL EAUTH=flocker.example SID=42X\r\n", "PROTOCTL " + unrealProtoctl + "\r\n", "SERVER flocker.example 1 :flockerbot\r\n"}
+	for i, w := range want {
+		if lines[i] != w {
+			t.Errorf("Line %d: got %q, want %q", i, lines[i], w)
+		}
+	}
+	if !strings.HasPrefix(lines[4], ":42X UID Helper 1 ") || lines[5] != ":42X EOS\r\n" || lines[6] != ":42X PONG flocker.example :irc.example\r\n" {
+		t.Errorf("Unexpected burst / pong: %q", lines[4:])
+	}
+}
+
+func TestUnrealIRCdFlood(t *testing.T) {
+	b := &Bot{IsServer: true, User: "flocker.example", SID: "42X", Password: "pw", LinkProtocol: UnrealIRCd{}}
+	addPseudoClients(t, b, 100)
+	testFlood(t, b, "001AAAAAA", 500,
+		"PASS :pw",
+		"PROTOCTL EAUTH=irc.example,6000 SID=001",
+		"SERVER irc.example 1 :U6000-Fhn6OoEmM-001 Example server",
+		":001 UID alice 0 1600000000 ~alice real.example 001AAAAAA alice +ixw * cloak.example CgAAAQ== :Alice",
+		":001 EOS",
+	)
+}
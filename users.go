@@ -0,0 +1,155 @@
+package flockerbot
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sorcix/irc"
+)
+
+var (
+	// ErrNoSuchNick signals that a nick is not online
+	ErrNoSuchNick = errors.New("Bot: No such nick")
+)
+
+const (
+	// whoxFields requests token, user, host, nick, flags, account and realname.
+	whoxFields = "%tuhnfar"
+	// whoxToken marks our WHOX requests for channel members.
+	whoxToken = "743"
+	// accountToken marks our WHOX requests of AccountFor.
+	accountToken = "744"
+)
+
+// User is a user sharing a channel with the bot, as tracked from the server's messages.
+type User struct {
+	Nick         string // Current nick.
+	User         string // Ident, if known.
+	Host         string // Host, if known.
+	Realname     string // Realname, if known.
+	Account      string // Services account, empty if not logged in or unknown.
+	AccountKnown bool   // True if Account is known from account-notify, extended-join, account-tag or WHOX.
+	Away         bool   // True if the user is away. Up to date with away-notify, otherwise as of joining.
+	AwayMessage  string // Away message, if known.
+}
+
+// LookupUser returns the user with nick, if they share a channel with the bot.
+func (b *Bot) LookupUser(nick string) (User, bool) {
+	st := b.tracker()
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	if u, ok := st.users[b.Fold(nick)]; ok {
+		return *u, true
+	}
+	return User{}, false
+}
+
+// addUser returns the user nick, adding it if needed. Must be called with mutex held.
+func (st *state) addUser(b *Bot, nick string) *User {
+	key := b.Fold(nick)
+	u, ok := st.users[key]
+	if !ok {
+		u = &User{Nick: nick}
+		st.users[key] = u
+	}
+	return u
+}
+
+// prune removes the user with folded nick key if it is in none of our channels. Must be called
+// with mutex held.
+func (st *state) prune(key string) {
+	for _, cs := range st.channels {
+		if _, ok := cs.members[key]; ok {
+			return
+		}
+	}
+	delete(st.users, key)
+}
+
+// AccountFor returns the services account nick is logged into, or "" if none. The account known
+// from the state is only used with account-notify, without which logouts go unnoticed. Otherwise
+// it is queried with WHOX, or WHOIS if the server lacks WHOX.
+func (b *Bot) AccountFor(ctx context.Context, nick string) (string, error) {
+	if u, ok := b.LookupUser(nick); ok && u.AccountKnown && b.HasCap("account-notify") {
+		return u.Account, nil
+	}
+	_, whox := b.ISupport().Get("WHOX")
+	sub := b.Subscribe(func(ev Event) bool {
+		if ev.Type != EventMessage || ev.Message == nil || len(ev.Message.Params) < 2 {
+			return false
+		}
+		p := ev.Message.Params
+		switch ev.Message.Command {
+		case "354":
+			return p[1] == accountToken && len(p) > 3 && b.EqualFold(p[2], nick)
+		case "315", "318", "330", "401":
+			return b.EqualFold(p[1], nick)
+		}
+		return false
+	})
+	defer sub.Cancel()
+	if whox {
+		b.SendString("WHO " + nick + " %tna," + accountToken)
+	} else {
+		b.SendString("WHOIS " + nick)
+	}
+	account, found := "", false
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case ev, ok := <-sub.C:
+			if !ok {
+				return "", ctx.Err()
+			}
+			msg := ev.Message
+			switch msg.Command {
+			case "354":
+				// me token nick account
+				found = true
+				if account = msg.Params[3]; account == "0" {
+					account = ""
+				}
+				b.setAccount(nick, account)
+			case "330":
+				// me nick account :is logged in as
+				account = params(msg)[2]
+			case "401":
+				return "", ErrNoSuchNick
+			case "315":
+				if !found {
+					return "", ErrNoSuchNick
+				}
+				return account, nil
+			case "318":
+				b.setAccount(nick, account)
+				return account, nil
+			}
+		}
+	}
+}
+
+// setAccount records the account of nick, if tracked.
+func (b *Bot) setAccount(nick, account string) {
+	st := b.tracker()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if u := st.users[b.Fold(nick)]; u != nil {
+		u.Account, u.AccountKnown = account, true
+	}
+}
+
+// identity returns the identity of the sender of msg, with the account if known. With
+// account-tag, only the account tag of msg counts: without it, the sender is not logged in.
+func (b *Bot) identity(msg *irc.Message, tags map[string]string) Identity {
+	if msg.Prefix == nil {
+		return Identity{}
+	}
+	id := Identity{Nick: msg.Prefix.Name, User: msg.Prefix.User, Host: msg.Prefix.Host}
+	if b.HasCap("account-tag") {
+		id.Account = tags["account"]
+	} else if u, ok := b.LookupUser(id.Nick); ok {
+		id.Account = u.Account
+	}
+	return id
+}
@@ -0,0 +1,187 @@
+package flockerbot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+func TestCapNegotiation(t *testing.T) {
+	b := testBot("flocker")
+	b.Caps = []string{"draft/example"}
+	b.capLS()
+	nextLine(t, b)
+	for _, l := range []string{
+		":irc.example CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL account-notify",
+		":irc.example CAP * LS :extended-join draft/example unknown",
+	} {
+		b.handleCap(irc.ParseMessage(l))
+	}
+	if l := nextLine(t, b); l != "CAP REQ :multi-prefix account-notify extended-join draft/example" {
+		t.Errorf("Unexpected request %q", l)
+	}
+	b.handleCap(irc.ParseMessage(":irc.example CAP flocker ACK :multi-prefix account-notify extended-join draft/example"))
+	if l := nextLine(t, b); l != "CAP END" {
+		t.Errorf("Expected CAP END, got %q", l)
+	}
+	if v, _ := b.CapValue("sasl"); !b.HasCap("extended-join") || b.HasCap("sasl") || v != "PLAIN,EXTERNAL" {
+		t.Error("Capabilities not recorded")
+	}
+	b.handleCap(irc.ParseMessage(":irc.example CAP flocker DEL :extended-join"))
+	if b.HasCap("extended-join") {
+		t.Error("CAP DEL not applied")
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags, line := parseTags(`@account=alice;msgid=a\sb\:c\;+draft/x;time=2024-01-01T00:00:00.000Z :alice!a@h PRIVMSG #c :hi`)
+	if line != ":alice!a@h PRIVMSG #c :hi" || tags["account"] != "alice" || tags["msgid"] != "a b;c" || tags["+draft/x"] != "" || len(tags) != 4 {
+		t.Errorf("Unexpected tags %q %q", tags, line)
+	}
+	if tags, line := parseTags("PING :x"); tags != nil || line != "PING :x" {
+		t.Error("Untagged line changed")
+	}
+}
+
+func TestAccountTracking(t *testing.T) {
+	b := testBot("flocker")
+	b.capsEnabled["account-tag"] = true
+	b.track(irc.ParseMessage(":irc.example 005 flocker WHOX :are supported by this server"), nil)
+	for _, l := range []string{
+		":flocker!f@h JOIN #flocker * :Flocker",
+		":irc.example 353 flocker = #flocker :flocker alice bob carol",
+		":irc.example 354 flocker 743 ~al alice.example alice H alice :Alice",
+		":irc.example 354 flocker 743 ~bo bob.example bob G 0 :Bob",
+		":dave!d@dave.example JOIN #flocker dave :Dave",
+		":bob!~bo@bob.example ACCOUNT robert",
+	} {
+		b.track(irc.ParseMessage(l), nil)
+	}
+	b.track(irc.ParseMessage(":carol!c@carol.example PRIVMSG #flocker :hi"), map[string]string{"account": "carol"})
+	if l := nextLine(t, b); l != "MODE #flocker" {
+		t.Errorf("Unexpected line %q", l)
+	}
+	if l := nextLine(t, b); l != "WHO #flocker %tuhnfar,743" {
+		t.Errorf("Expected WHOX on join, got %q", l)
+	}
+	for nick, want := range map[string]string{"alice": "alice", "bob": "robert", "carol": "carol", "dave": "dave"} {
+		if u, ok := b.LookupUser(nick); !ok || !u.AccountKnown || u.Account != want {
+			t.Errorf("%s: unexpected user %v", nick, u)
+		}
+	}
+	if u, _ := b.LookupUser("alice"); u.Host != "alice.example" || u.Realname != "Alice" {
+		t.Errorf("WHOX reply not applied: %v", u)
+	}
+	b.track(irc.ParseMessage(":dave!d@dave.example PART #flocker"), nil)
+	if _, ok := b.LookupUser("dave"); ok {
+		t.Error("User not pruned after part")
+	}
+	go func() {
+		if l := nextLine(t, b); l != "WHO erin %tna,744" {
+			t.Errorf("Unexpected query %q", l)
+		}
+		for _, l := range []string{
+			":irc.example 354 flocker 744 erin erin",
+			":irc.example 315 flocker erin :End of WHO list",
+		} {
+			b.dispatch(irc.ParseMessage(l))
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if account, err := b.AccountFor(ctx, "erin"); err != nil || account != "erin" {
+		t.Errorf("AccountFor: %q %v", account, err)
+	}
+	// Without account-notify, the tracked account may be stale after a logout.
+	go func() {
+		if l := nextLine(t, b); l != "WHO ALICE %tna,744" {
+			t.Errorf("Unexpected query %q", l)
+		}
+		for _, l := range []string{
+			":irc.example 354 flocker 744 alice 0",
+			":irc.example 315 flocker alice :End of WHO list",
+		} {
+			b.dispatch(irc.ParseMessage(l))
+		}
+	}()
+	if account, err := b.AccountFor(ctx, "ALICE"); err != nil || account != "" {
+		t.Errorf("AccountFor logged out: %q %v", account, err)
+	}
+	b.capsEnabled["account-notify"] = true
+	b.track(irc.ParseMessage(":bob!~bo@bob.example ACCOUNT *"), nil)
+	if account, err := b.AccountFor(ctx, "bob"); err != nil || account != "" {
+		t.Errorf("AccountFor after ACCOUNT *: %q %v", account, err)
+	}
+	b.track(irc.ParseMessage(":bob!~bo@bob.example ACCOUNT robert"), nil)
+	if account, err := b.AccountFor(ctx, "BOB"); err != nil || account != "robert" {
+		t.Errorf("AccountFor known: %q %v", account, err)
+	}
+	if len(b.socketChan) != 0 {
+		t.Error("Known account queried with account-notify")
+	}
+}
+
+func TestUserUpdates(t *testing.T) {
+	b := testBot("flocker")
+	sub := b.Subscribe(func(ev Event) bool { return ev.Type != EventMessage })
+	defer sub.Cancel()
+	for _, l := range []string{
+		":flocker!f@h JOIN #flocker",
+		":alice!a@alice.example JOIN #flocker",
+		":alice!a@alice.example AWAY :lunch",
+		":alice!a@alice.example CHGHOST ali staff.example",
+		":alice!ali@staff.example SETNAME :Alice A.",
+		":alice!ali@staff.example AWAY",
+		":alice!ali@staff.example INVITE bob #secret",
+	} {
+		b.track(irc.ParseMessage(l), nil)
+	}
+	want := []EventType{EventAway, EventHostChange, EventRealnameChange, EventAway, EventInvite}
+	for i, w := range want {
+		ev := <-sub.C
+		if ev.Type != w || ev.User.Nick != "alice" {
+			t.Errorf("Event %d: got %s %v, want %s", i, ev.Type, ev.User, w)
+		}
+		switch i {
+		case 0:
+			if !ev.User.Away || ev.User.AwayMessage != "lunch" {
+				t.Errorf("Unexpected away event %v", ev.User)
+			}
+		case 4:
+			if ev.Target != "bob" || ev.Channel != "#secret" {
+				t.Errorf("Unexpected invite event %v", ev)
+			}
+		}
+	}
+	u, _ := b.LookupUser("alice")
+	if u.Away || u.User != "ali" || u.Host != "staff.example" || u.Realname != "Alice A." {
+		t.Errorf("Unexpected user %v", u)
+	}
+}
+
+func TestCapFullSocketChan(t *testing.T) {
+	// The loop handles CAP itself, so the replies must not wait for room in socketChan.
+	b := testBot("flocker")
+	b.socketChan = make(chan *channelString, 1)
+	b.socketChan <- &channelString{Dir: socketRead, Data: "busy"}
+	done := make(chan struct{})
+	go func() {
+		b.capLS()
+		b.handleCap(irc.ParseMessage(":irc.example CAP * LS :multi-prefix account-notify"))
+		b.handleCap(irc.ParseMessage(":irc.example CAP flocker ACK :multi-prefix account-notify"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Capability negotiation blocked on a full socketChan")
+	}
+	<-b.socketChan
+	for _, want := range []string{"CAP LS 302", "CAP REQ :multi-prefix account-notify", "CAP END"} {
+		if l := nextLine(t, b); l != want {
+			t.Errorf("Got %q, want %q", l, want)
+		}
+	}
+}